@@ -0,0 +1,214 @@
+// Package auth verifies inter-service JWTs sent by the Bluesky AppView on behalf of a viewer
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// Allowed difference between our clock and the clock of the token issuer
+const clockLeeway = 30 * time.Second
+
+// How often the cached identity of an issuer is refreshed after a bad signature, so forged tokens
+// can't make us resolve the issuer on every request
+const purgeInterval = time.Minute
+
+var (
+	ErrMalformedToken   = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrInvalidAudience  = errors.New("invalid audience")
+	ErrInvalidMethod    = errors.New("invalid lexicon method")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrMissingBearer    = errors.New("missing bearer token")
+	ErrIssuerUnresolved = errors.New("could not resolve issuer signing key")
+	ErrInvalidIssuer    = errors.New("issuer is not a valid DID")
+)
+
+// Claims holds the subset of the service JWT claims we care about
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	Method    string `json:"lxm,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// Verifier validates service JWTs addressed to this feed generator
+type Verifier struct {
+	// ServiceDID is the expected audience, e.g. did:web:<hostname>
+	ServiceDID string
+
+	// Directory resolves issuer DIDs to their signing keys. Wrap it in an
+	// identity.CacheDirectory to avoid resolving on every request.
+	Directory identity.Directory
+
+	// Now returns the current time, overridable in tests
+	Now func() time.Time
+
+	purgeMu  sync.Mutex
+	purgedAt map[syntax.DID]time.Time
+}
+
+// NewVerifier creates a verifier for the given service DID. A nil directory falls
+// back to the default cached PLC and did:web resolver.
+func NewVerifier(serviceDID string, directory identity.Directory) *Verifier {
+	if directory == nil {
+		directory = identity.DefaultDirectory()
+	}
+	return &Verifier{
+		ServiceDID: serviceDID,
+		Directory:  directory,
+		Now:        time.Now,
+	}
+}
+
+// BearerToken extracts the token from an Authorization header value
+func BearerToken(authorization string) (string, error) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrMissingBearer
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// Verify validates the token for the given lexicon method and returns the viewer DID
+func (v *Verifier) Verify(ctx context.Context, token string, method string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrMalformedToken
+	}
+
+	var hdr header
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return "", fmt.Errorf("%w: header: %v", ErrMalformedToken, err)
+	}
+	if hdr.Alg != "ES256K" && hdr.Alg != "ES256" {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedAlg, hdr.Alg)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("%w: claims: %v", ErrMalformedToken, err)
+	}
+
+	now := v.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(clockLeeway)) {
+		return "", ErrTokenExpired
+	}
+	if claims.Audience != v.ServiceDID {
+		return "", fmt.Errorf("%w: %s", ErrInvalidAudience, claims.Audience)
+	}
+	// Older tokens may not carry lxm, but when they do it must match the endpoint
+	if claims.Method != "" && claims.Method != method {
+		return "", fmt.Errorf("%w: %s", ErrInvalidMethod, claims.Method)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: signature: %v", ErrMalformedToken, err)
+	}
+
+	// The issuer may carry a service fragment, e.g. did:plc:abc#atproto_labeler
+	issuer, _, _ := strings.Cut(claims.Issuer, "#")
+	did, err := syntax.ParseDID(issuer)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidIssuer, claims.Issuer)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	key, err := v.signingKey(ctx, did)
+	if err != nil {
+		return "", err
+	}
+	if err := key.HashAndVerifyLenient(signingInput, signature); err != nil {
+		// The issuer may have rotated keys since we cached the identity, refresh once and retry
+		if !v.allowPurge(did, now) {
+			return "", ErrInvalidSignature
+		}
+		if purgeErr := v.Directory.Purge(ctx, did.AtIdentifier()); purgeErr != nil {
+			return "", ErrInvalidSignature
+		}
+		key, err = v.signingKey(ctx, did)
+		if err != nil {
+			return "", err
+		}
+		if err := key.HashAndVerifyLenient(signingInput, signature); err != nil {
+			return "", ErrInvalidSignature
+		}
+	}
+
+	return did.String(), nil
+}
+
+// allowPurge reports whether the issuer's identity may be refreshed, at most once per purgeInterval
+func (v *Verifier) allowPurge(did syntax.DID, now time.Time) bool {
+	v.purgeMu.Lock()
+	defer v.purgeMu.Unlock()
+
+	if last, ok := v.purgedAt[did]; ok && now.Sub(last) < purgeInterval {
+		return false
+	}
+	if v.purgedAt == nil {
+		v.purgedAt = make(map[syntax.DID]time.Time)
+	}
+	// Forget issuers that may be refreshed again, so the map only holds those of the last interval
+	for other, last := range v.purgedAt {
+		if now.Sub(last) >= purgeInterval {
+			delete(v.purgedAt, other)
+		}
+	}
+	v.purgedAt[did] = now
+	return true
+}
+
+func (v *Verifier) signingKey(ctx context.Context, did syntax.DID) (crypto.PublicKey, error) {
+	ident, err := v.Directory.LookupDID(ctx, did)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIssuerUnresolved, err)
+	}
+	key, err := ident.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIssuerUnresolved, err)
+	}
+	return key, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+type contextKey string
+
+const viewerKey contextKey = "viewer"
+
+// WithViewer returns a copy of ctx carrying the authenticated viewer DID
+func WithViewer(ctx context.Context, did string) context.Context {
+	return context.WithValue(ctx, viewerKey, did)
+}
+
+// ViewerFromContext returns the viewer DID, or an empty string for anonymous requests
+func ViewerFromContext(ctx context.Context) string {
+	did, _ := ctx.Value(viewerKey).(string)
+	return did
+}
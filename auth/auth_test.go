@@ -0,0 +1,218 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"norsky/auth"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	serviceDID = "did:web:norsky.example.com"
+	viewerDID  = "did:plc:viewer123"
+	method     = "app.bsky.feed.getFeedSkeleton"
+)
+
+func signToken(t *testing.T, key crypto.PrivateKey, alg string, claims map[string]interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signingInput := encode(map[string]string{"alg": alg, "typ": "JWT"}) + "." + encode(claims)
+	sig, err := key.HashAndSign([]byte(signingInput))
+	require.NoError(t, err)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newVerifier(t *testing.T) (*auth.Verifier, crypto.PrivateKey, time.Time) {
+	t.Helper()
+
+	key, err := crypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	pub, err := key.PublicKey()
+	require.NoError(t, err)
+
+	// Local stand-in for PLC resolution
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(viewerDID),
+		Handle: syntax.Handle("invalid.handle"),
+		Keys: map[string]identity.Key{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	})
+
+	now := time.Unix(1_700_000_000, 0)
+	verifier := auth.NewVerifier(serviceDID, &dir)
+	verifier.Now = func() time.Time { return now }
+
+	return verifier, key, now
+}
+
+func TestVerify(t *testing.T) {
+	verifier, key, now := newVerifier(t)
+
+	otherKey, err := crypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": viewerDID,
+			"aud": serviceDID,
+			"exp": now.Add(time.Minute).Unix(),
+			"iat": now.Unix(),
+			"lxm": method,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		token    func() string
+		expected error
+	}{
+		{
+			name:  "valid token",
+			token: func() string { return signToken(t, key, "ES256K", validClaims()) },
+		},
+		{
+			name: "valid token without lxm",
+			token: func() string {
+				claims := validClaims()
+				delete(claims, "lxm")
+				return signToken(t, key, "ES256K", claims)
+			},
+		},
+		{
+			name:     "malformed token",
+			token:    func() string { return "not-a-jwt" },
+			expected: auth.ErrMalformedToken,
+		},
+		{
+			name:     "unsupported algorithm",
+			token:    func() string { return signToken(t, key, "HS256", validClaims()) },
+			expected: auth.ErrUnsupportedAlg,
+		},
+		{
+			name: "expired token",
+			token: func() string {
+				claims := validClaims()
+				claims["exp"] = now.Add(-time.Hour).Unix()
+				return signToken(t, key, "ES256K", claims)
+			},
+			expected: auth.ErrTokenExpired,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := validClaims()
+				claims["aud"] = "did:web:other.example.com"
+				return signToken(t, key, "ES256K", claims)
+			},
+			expected: auth.ErrInvalidAudience,
+		},
+		{
+			name: "wrong lexicon method",
+			token: func() string {
+				claims := validClaims()
+				claims["lxm"] = "com.atproto.repo.createRecord"
+				return signToken(t, key, "ES256K", claims)
+			},
+			expected: auth.ErrInvalidMethod,
+		},
+		{
+			name: "unknown issuer",
+			token: func() string {
+				claims := validClaims()
+				claims["iss"] = "did:plc:unknown"
+				return signToken(t, key, "ES256K", claims)
+			},
+			expected: auth.ErrIssuerUnresolved,
+		},
+		{
+			name:     "signed by another key",
+			token:    func() string { return signToken(t, otherKey, "ES256K", validClaims()) },
+			expected: auth.ErrInvalidSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			did, err := verifier.Verify(context.Background(), tt.token(), method)
+			if tt.expected != nil {
+				assert.ErrorIs(t, err, tt.expected)
+				assert.Empty(t, did)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, viewerDID, did)
+		})
+	}
+}
+
+// purgeCounter counts the identities purged from the directory it wraps
+type purgeCounter struct {
+	identity.Directory
+	purges int
+}
+
+func (d *purgeCounter) Purge(ctx context.Context, atid syntax.AtIdentifier) error {
+	d.purges++
+	return d.Directory.Purge(ctx, atid)
+}
+
+func TestVerifyLimitsPurgesPerIssuer(t *testing.T) {
+	verifier, _, now := newVerifier(t)
+	dir := &purgeCounter{Directory: verifier.Directory}
+	verifier.Directory = dir
+
+	otherKey, err := crypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	token := signToken(t, otherKey, "ES256K", map[string]interface{}{
+		"iss": viewerDID,
+		"aud": serviceDID,
+		"exp": now.Add(time.Hour).Unix(),
+	})
+
+	for i := 0; i < 5; i++ {
+		_, err := verifier.Verify(context.Background(), token, method)
+		assert.ErrorIs(t, err, auth.ErrInvalidSignature)
+	}
+	assert.Equal(t, 1, dir.purges)
+
+	// The issuer may have rotated keys again a minute later
+	verifier.Now = func() time.Time { return now.Add(time.Minute) }
+	_, err = verifier.Verify(context.Background(), token, method)
+	assert.ErrorIs(t, err, auth.ErrInvalidSignature)
+	assert.Equal(t, 2, dir.purges)
+}
+
+func TestBearerToken(t *testing.T) {
+	token, err := auth.BearerToken("Bearer abc.def.ghi")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc.def.ghi", token)
+
+	for _, header := range []string{"", "Bearer", "Basic abc", "Bearer   "} {
+		_, err := auth.BearerToken(header)
+		assert.ErrorIs(t, err, auth.ErrMissingBearer, strings.TrimSpace(header))
+	}
+}
+
+func TestViewerContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Empty(t, auth.ViewerFromContext(ctx))
+	assert.Equal(t, viewerDID, auth.ViewerFromContext(auth.WithViewer(ctx, viewerDID)))
+}
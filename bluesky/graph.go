@@ -0,0 +1,122 @@
+package bluesky
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"norsky/models"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// GraphRecordsClient lists the follow and block records of an account from its PDS without authentication.
+// Unlike the AppView the PDS returns the uri of each record, which deletes on the firehose refer to.
+type GraphRecordsClient struct {
+	directory identity.Directory
+	client    *http.Client
+}
+
+// NewGraphRecordsClient resolves PDS hosts with the directory, identity.DefaultDirectory when nil
+func NewGraphRecordsClient(directory identity.Directory) *GraphRecordsClient {
+	if directory == nil {
+		directory = identity.DefaultDirectory()
+	}
+	return &GraphRecordsClient{
+		directory: directory,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// GetFollows pages through all app.bsky.graph.follow records in the repo of the actor
+func (c *GraphRecordsClient) GetFollows(ctx context.Context, actor string) ([]models.Follow, error) {
+	var follows []models.Follow
+	err := c.listRecords(ctx, actor, "app.bsky.graph.follow", func(uri string, value any) {
+		follow, ok := value.(*bsky.GraphFollow)
+		if !ok {
+			return
+		}
+		follows = append(follows, models.Follow{
+			Uri:       uri,
+			Follower:  actor,
+			Subject:   follow.Subject,
+			CreatedAt: parseCreatedAt(follow.CreatedAt),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list follows: %w", err)
+	}
+	return follows, nil
+}
+
+// GetBlocks pages through all app.bsky.graph.block records in the repo of the actor
+func (c *GraphRecordsClient) GetBlocks(ctx context.Context, actor string) ([]models.Block, error) {
+	var blocks []models.Block
+	err := c.listRecords(ctx, actor, "app.bsky.graph.block", func(uri string, value any) {
+		block, ok := value.(*bsky.GraphBlock)
+		if !ok {
+			return
+		}
+		blocks = append(blocks, models.Block{
+			Uri:       uri,
+			Author:    actor,
+			Subject:   block.Subject,
+			CreatedAt: parseCreatedAt(block.CreatedAt),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %w", err)
+	}
+	return blocks, nil
+}
+
+// listRecords resolves the PDS of the actor and calls fn with every record in the collection
+func (c *GraphRecordsClient) listRecords(ctx context.Context, actor string, collection string, fn func(uri string, value any)) error {
+	did, err := syntax.ParseDID(actor)
+	if err != nil {
+		return fmt.Errorf("invalid actor: %w", err)
+	}
+	ident, err := c.directory.LookupDID(ctx, did)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", actor, err)
+	}
+	host := ident.PDSEndpoint()
+	if host == "" {
+		return fmt.Errorf("no PDS in the DID document of %s", actor)
+	}
+
+	client := &xrpc.Client{Host: host, Client: c.client}
+	cursor := ""
+
+	for {
+		resp, err := atproto.RepoListRecords(ctx, client, collection, cursor, 100, actor, false, "", "")
+		if err != nil {
+			return err
+		}
+
+		for _, record := range resp.Records {
+			if record.Value == nil {
+				continue
+			}
+			fn(record.Uri, record.Value.Val)
+		}
+
+		if resp.Cursor == nil || *resp.Cursor == "" || len(resp.Records) == 0 {
+			return nil
+		}
+		cursor = *resp.Cursor
+	}
+}
+
+// parseCreatedAt falls back to now for records with a missing or malformed createdAt
+func parseCreatedAt(value string) int64 {
+	createdAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		createdAt = time.Now()
+	}
+	return createdAt.Unix()
+}
@@ -0,0 +1,84 @@
+package bluesky_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"norsky/bluesky"
+	"norsky/models"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const viewerDID = "did:plc:viewer1234567890abcdefgh"
+
+func TestGetFollowsListsRecordsFromPDS(t *testing.T) {
+	createdAt := time.Date(2025, 2, 1, 12, 0, 0, 0, time.UTC)
+	pages := map[string]string{
+		"": `{"cursor": "page2", "records": [{"uri": "at://` + viewerDID + `/app.bsky.graph.follow/3kfollow1", "cid": "bafyreia",
+			"value": {"$type": "app.bsky.graph.follow", "subject": "did:plc:author1", "createdAt": "2025-02-01T12:00:00Z"}}]}`,
+		"page2": `{"records": [{"uri": "at://` + viewerDID + `/app.bsky.graph.follow/3kfollow2", "cid": "bafyreib",
+			"value": {"$type": "app.bsky.graph.follow", "subject": "did:plc:author2", "createdAt": "2025-02-01T12:00:00Z"}}]}`,
+	}
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/xrpc/com.atproto.repo.listRecords", r.URL.Path)
+		assert.Equal(t, viewerDID, r.URL.Query().Get("repo"))
+		assert.Equal(t, "app.bsky.graph.follow", r.URL.Query().Get("collection"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(json.RawMessage(pages[r.URL.Query().Get("cursor")]))
+	}))
+	defer pds.Close()
+
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:      syntax.DID(viewerDID),
+		Handle:   syntax.Handle("invalid.handle"),
+		Services: map[string]identity.Service{"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: pds.URL}},
+	})
+
+	follows, err := bluesky.NewGraphRecordsClient(&dir).GetFollows(context.Background(), viewerDID)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Follow{
+		{Uri: "at://" + viewerDID + "/app.bsky.graph.follow/3kfollow1", Follower: viewerDID, Subject: "did:plc:author1", CreatedAt: createdAt.Unix()},
+		{Uri: "at://" + viewerDID + "/app.bsky.graph.follow/3kfollow2", Follower: viewerDID, Subject: "did:plc:author2", CreatedAt: createdAt.Unix()},
+	}, follows)
+}
+
+func TestGetFollowsUnknownViewer(t *testing.T) {
+	dir := identity.NewMockDirectory()
+
+	_, err := bluesky.NewGraphRecordsClient(&dir).GetFollows(context.Background(), viewerDID)
+	assert.ErrorContains(t, err, "failed to resolve")
+}
+
+func TestGetBlocksListsRecordsFromPDS(t *testing.T) {
+	createdAt := time.Date(2025, 2, 1, 12, 0, 0, 0, time.UTC)
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/xrpc/com.atproto.repo.listRecords", r.URL.Path)
+		assert.Equal(t, viewerDID, r.URL.Query().Get("repo"))
+		assert.Equal(t, "app.bsky.graph.block", r.URL.Query().Get("collection"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"records": [{"uri": "at://` + viewerDID + `/app.bsky.graph.block/3kblock1", "cid": "bafyreia",
+			"value": {"$type": "app.bsky.graph.block", "subject": "did:plc:author1", "createdAt": "2025-02-01T12:00:00Z"}}]}`))
+	}))
+	defer pds.Close()
+
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:      syntax.DID(viewerDID),
+		Handle:   syntax.Handle("invalid.handle"),
+		Services: map[string]identity.Service{"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: pds.URL}},
+	})
+
+	blocks, err := bluesky.NewGraphRecordsClient(&dir).GetBlocks(context.Background(), viewerDID)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Block{
+		{Uri: "at://" + viewerDID + "/app.bsky.graph.block/3kblock1", Author: viewerDID, Subject: "did:plc:author1", CreatedAt: createdAt.Unix()},
+	}, blocks)
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"norsky/plc"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/urfave/cli/v2"
+)
+
+// serviceDIDFlag is the DID the feed generator is known by, shared by the commands that advertise it
+func serviceDIDFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "service-did",
+		Usage:   "DID of the feed generator, did:plc or did:web, defaults to did:web:<hostname>",
+		EnvVars: []string{"NORSKY_SERVICE_DID"},
+	}
+}
+
+// resolveServiceDID returns the configured DID of the feed generator, or did:web:<hostname> when none is set
+func resolveServiceDID(ctx *cli.Context) (string, error) {
+	configured := ctx.String("service-did")
+	if configured == "" {
+		if ctx.String("hostname") == "" {
+			return "", errors.New("missing required flag: --hostname or --service-did")
+		}
+		return "did:web:" + ctx.String("hostname"), nil
+	}
+
+	did, err := syntax.ParseDID(configured)
+	if err != nil {
+		return "", fmt.Errorf("invalid service DID: %w", err)
+	}
+	if method := did.Method(); method != "plc" && method != "web" {
+		return "", fmt.Errorf("unsupported service DID method %q, use did:plc or did:web", method)
+	}
+	return did.String(), nil
+}
+
+// plcCmd creates or updates the did:plc of the feed generator
+func plcCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "plc",
+		Usage: "Create or update the did:plc of the feed generator",
+		Description: `Points the #bsky_fg service of a did:plc at https://<hostname>.
+
+Without --service-did a new did:plc is created, save the DID it prints and use it as
+--service-did for serve and publish. With --service-did the endpoint of the existing
+DID is updated, e.g. after moving the feed generator to a new hostname, so the URIs
+of published feeds stay the same.
+
+The rotation key signs the operations and is the only key able to update the DID
+later. It is a multibase private key, a new one is generated and printed when
+creating a DID without it.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "hostname",
+				Aliases: []string{"n"},
+				Usage:   "The hostname where the server is running",
+				EnvVars: []string{"NORSKY_HOSTNAME"},
+			},
+			serviceDIDFlag(),
+			&cli.StringFlag{
+				Name:    "rotation-key",
+				Usage:   "Multibase private key that controls the did:plc",
+				EnvVars: []string{"NORSKY_PLC_ROTATION_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "plc-host",
+				Usage:   "PLC directory to submit the operation to",
+				EnvVars: []string{"NORSKY_PLC_HOST"},
+				Value:   plc.DefaultDirectory,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			hostname := ctx.String("hostname")
+			if hostname == "" {
+				return errors.New("missing required flag: --hostname")
+			}
+			endpoint := "https://" + hostname
+			client := plc.NewDirectoryClient(ctx.String("plc-host"))
+
+			did := ctx.String("service-did")
+			if did != "" {
+				parsed, err := syntax.ParseDID(did)
+				if err != nil || parsed.Method() != "plc" {
+					return fmt.Errorf("--service-did must be a did:plc, got %q", did)
+				}
+				if ctx.String("rotation-key") == "" {
+					return errors.New("missing required flag: --rotation-key")
+				}
+				key, err := crypto.ParsePrivateMultibase(ctx.String("rotation-key"))
+				if err != nil {
+					return fmt.Errorf("invalid rotation key: %w", err)
+				}
+
+				changed, err := plc.SetFeedGeneratorEndpoint(ctx.Context, client, key, did, endpoint)
+				if err != nil {
+					return err
+				}
+				if !changed {
+					fmt.Printf("%s already points to %s\n", did, endpoint)
+					return nil
+				}
+				fmt.Printf("Updated %s to point to %s\n", did, endpoint)
+				return nil
+			}
+
+			var key crypto.PrivateKey
+			if encoded := ctx.String("rotation-key"); encoded != "" {
+				parsed, err := crypto.ParsePrivateMultibase(encoded)
+				if err != nil {
+					return fmt.Errorf("invalid rotation key: %w", err)
+				}
+				key = parsed
+			} else {
+				generated, err := crypto.GeneratePrivateKeyK256()
+				if err != nil {
+					return fmt.Errorf("failed to generate rotation key: %w", err)
+				}
+				key = generated
+				fmt.Println("Generated rotation key, store it safely, it is needed to update the DID:")
+				fmt.Println(generated.Multibase())
+			}
+
+			did, err := plc.CreateFeedGenerator(ctx.Context, client, key, endpoint)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Created %s pointing to %s\n", did, endpoint)
+			fmt.Printf("Run serve and publish with --service-did %s\n", did)
+			return nil
+		},
+	}
+}
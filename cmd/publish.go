@@ -4,7 +4,6 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"errors"
 	"fmt"
 	"norsky/bluesky"
 	"os"
@@ -37,6 +36,7 @@ Registers the feed with your preferred name, description, etc.`,
 				Usage:   "The hostname where the server is running",
 				EnvVars: []string{"NORSKY_HOSTNAME"},
 			},
+			serviceDIDFlag(),
 			&cli.StringFlag{
 				Name:    "config",
 				Aliases: []string{"c"},
@@ -48,11 +48,10 @@ Registers the feed with your preferred name, description, etc.`,
 		Action: func(ctx *cli.Context) error {
 			// This command was made possible thanks to the appreciated work by the Bluesky Furry Feed team
 
-			// Hostname of the Feed Generator
-			hostname := ctx.String("hostname")
-
-			if hostname == "" {
-				return errors.New("please specify a hostname in the config")
+			// DID of the Feed Generator, did:web:<hostname> unless another is configured
+			serviceDID, err := resolveServiceDID(ctx)
+			if err != nil {
+				return err
 			}
 
 			handle, err := prompt.New().Ask("Handle:").Input("myname.bsky.social")
@@ -114,7 +113,7 @@ Registers the feed with your preferred name, description, etc.`,
 
 				err := client.PutFeedGenerator(ctx.Context, feed.Id, &bsky.FeedGenerator{
 					Avatar:      blob,
-					Did:         fmt.Sprintf("did:web:%s", hostname),
+					Did:         serviceDID,
 					CreatedAt:   bluesky.FormatTime(time.Now().UTC()),
 					DisplayName: feed.DisplayName,
 					Description: &feed.Description,
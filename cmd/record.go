@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"norsky/firehose"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func recordCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "record",
+		Usage: "Record raw Jetstream traffic to a file",
+		Description: `Connect to Jetstream and write every raw message to a recording,
+together with the time it was received.
+
+Recordings can be fed through the ingest pipeline with the replay command,
+e.g. to reproduce problems or to benchmark ingest without a live connection.
+
+Messages are stored exactly as received, zstd compressed when
+--jetstream-compress is set. Stops after --duration or on interrupt.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "output",
+				Aliases:  []string{"o"},
+				Usage:    "Path of the recording to write",
+				Required: true,
+			},
+			&cli.DurationFlag{
+				Name:  "duration",
+				Usage: "Stop recording after this long, 0 records until interrupted",
+			},
+			&cli.Int64Flag{
+				Name:  "cursor",
+				Usage: "Jetstream cursor to start from, in unix microseconds",
+			},
+			&cli.StringSliceFlag{
+				Name:    "jetstream-hosts",
+				Usage:   "List of Jetstream hosts to connect to, fallbacks to next host in list if connection fails",
+				EnvVars: []string{"NORSKY_JETSTREAM_HOSTS"},
+				Value: cli.NewStringSlice(
+					"wss://jetstream1.us-east.bsky.network",
+					"wss://jetstream2.us-east.bsky.network",
+				),
+			},
+			&cli.BoolFlag{
+				Name:    "jetstream-compress",
+				Usage:   "Record zstd compressed messages, which makes the recording considerably smaller",
+				EnvVars: []string{"NORSKY_JETSTREAM_COMPRESS"},
+				Value:   true,
+			},
+			&cli.StringFlag{
+				Name:    "user-agent",
+				Usage:   "User agent string for Jetstream connection",
+				EnvVars: []string{"NORSKY_USER_AGENT"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "jetstream-wanted-collections",
+				Usage:   "List of collections to subscribe to (e.g. app.bsky.feed.post)",
+				EnvVars: []string{"NORSKY_JETSTREAM_WANTED_COLLECTIONS"},
+				Value:   cli.NewStringSlice("app.bsky.feed.post"),
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			file, err := os.Create(ctx.String("output"))
+			if err != nil {
+				return fmt.Errorf("failed to create recording: %w", err)
+			}
+			defer file.Close()
+
+			compress := ctx.Bool("jetstream-compress")
+			writer, err := firehose.NewRecordingWriter(file, compress)
+			if err != nil {
+				return err
+			}
+
+			recordCtx, stop := signal.NotifyContext(ctx.Context, syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+			if duration := ctx.Duration("duration"); duration > 0 {
+				var cancel context.CancelFunc
+				recordCtx, cancel = context.WithTimeout(recordCtx, duration)
+				defer cancel()
+			}
+
+			log.WithField("path", ctx.String("output")).Info("Recording Jetstream traffic")
+			frames, err := firehose.Record(recordCtx, firehose.JetstreamConfig{
+				Hosts:             ctx.StringSlice("jetstream-hosts"),
+				Compress:          compress,
+				UserAgent:         ctx.String("user-agent"),
+				WantedCollections: ctx.StringSlice("jetstream-wanted-collections"),
+				Cursor:            ctx.Int64("cursor"),
+			}, writer)
+			log.WithField("frames", frames).Info("Recording finished")
+			if err != nil {
+				return err
+			}
+			return file.Close()
+		},
+	}
+}
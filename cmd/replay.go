@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"norsky/config"
+	"norsky/feeds"
+	"norsky/firehose"
+	"norsky/sink"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func replayCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "replay",
+		Usage: "Replay a Jetstream recording through the ingest pipeline",
+		Description: `Feed a recording made with the record command through the same
+filtering and language detection as live ingest, and print the accepted posts
+as JSON lines to stdout. No database is needed.
+
+By default frames are replayed as fast as they can be processed, which makes
+the command a throughput benchmark: the number of frames and the time it took
+are logged to stderr when done. Use --speed 1 to replay in real time, or
+--speed 10 to replay ten times as fast as recorded.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "input",
+				Aliases:  []string{"i"},
+				Usage:    "Path of the recording to replay",
+				Required: true,
+			},
+			&cli.Float64Flag{
+				Name:  "speed",
+				Usage: "Multiple of the recorded pace to replay at, 0 replays as fast as possible",
+			},
+			&cli.BoolFlag{
+				Name:  "quiet",
+				Usage: "Don't print the posts, e.g. when benchmarking",
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Path to feeds configuration file to take the languages from, optional",
+				EnvVars: []string{"NORSKY_CONFIG"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "languages",
+				Usage:   "Languages to collect when no config is given",
+				EnvVars: []string{"NORSKY_LANGUAGES"},
+				Value:   cli.NewStringSlice("nb", "nn", "no", "se"),
+			},
+			&cli.Float64Flag{
+				Name:    "confidence-threshold",
+				Usage:   "Confidence threshold for language detection (0-1)",
+				EnvVars: []string{"NORSKY_CONFIDENCE_THRESHOLD"},
+				Value:   0.6,
+			},
+			&cli.BoolFlag{
+				Name:    "run-language-detection",
+				Usage:   "Run language detection on posts",
+				EnvVars: []string{"NORSKY_RUN_LANGUAGE_DETECTION"},
+				Value:   true,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			// Keep stdout for posts only
+			log.SetOutput(os.Stderr)
+
+			targetLanguages := ctx.StringSlice("languages")
+			if path := ctx.String("config"); path != "" {
+				cfg, err := config.LoadConfig(path)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				targetLanguages = feeds.TargetLanguages(cfg)
+			}
+
+			file, err := os.Open(ctx.String("input"))
+			if err != nil {
+				return fmt.Errorf("failed to open recording: %w", err)
+			}
+			defer file.Close()
+
+			reader, err := firehose.NewRecordingReader(file)
+			if err != nil {
+				return err
+			}
+
+			// Deletes are only printed for posts printed before them
+			var postSink sink.PostSink = sink.NewKnownPostsFilter(sink.NewJSONSink(os.Stdout), sink.DefaultKnownPosts)
+			if ctx.Bool("quiet") {
+				postSink = sink.NewFanout()
+			}
+
+			replayCtx, stop := signal.NotifyContext(ctx.Context, syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+
+			stats, err := firehose.Replay(replayCtx, reader, postSink, nil, firehose.FirehoseConfig{
+				RunLanguageDetection: ctx.Bool("run-language-detection"),
+				ConfidenceThreshold:  ctx.Float64("confidence-threshold"),
+				Languages:            targetLanguages,
+			}, firehose.ReplayOptions{Speed: ctx.Float64("speed")})
+			if err != nil {
+				return err
+			}
+
+			log.WithFields(log.Fields{
+				"frames":            stats.Frames,
+				"duration":          stats.Duration,
+				"frames_per_second": float64(stats.Frames) / stats.Duration.Seconds(),
+			}).Info("Replay throughput")
+
+			return postSink.Close()
+		},
+	}
+}
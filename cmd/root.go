@@ -29,8 +29,11 @@ func RootApp() *cli.App {
 			rollbackCmd(),
 			tidyCmd(),
 			subscribeCmd(),
+			recordCmd(),
+			replayCmd(),
 			publishCmd(),
 			unpublishCmd(),
+			plcCmd(),
 		},
 		Action: func(ctx *cli.Context) error {
 			// Show help if no command is specified
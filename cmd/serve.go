@@ -4,27 +4,25 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"context"
 	"errors"
 	"fmt"
+	"norsky/auth"
+	"norsky/bluesky"
 	"norsky/config"
 	"norsky/db"
 	"norsky/feeds"
 	"norsky/firehose"
-	"norsky/models"
+	"norsky/maintenance"
 	"norsky/server"
-	"sync/atomic"
+	"norsky/sink"
 	"time"
 
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
-type contextKey string
-
-const cancelKey contextKey = "cancel"
-
 func serveCmd() *cli.Command {
 
 	return &cli.Command{
@@ -43,6 +41,7 @@ func serveCmd() *cli.Command {
 				Usage:   "The hostname where the server is running",
 				EnvVars: []string{"NORSKY_HOSTNAME"},
 			},
+			serviceDIDFlag(),
 			&cli.StringFlag{
 				Name:    "host",
 				Aliases: []string{"o"},
@@ -107,6 +106,113 @@ func serveCmd() *cli.Command {
 					"app.bsky.feed.post", // Default to posts only
 				),
 			},
+			&cli.DurationFlag{
+				Name:    "ready-max-lag",
+				Usage:   "Report not ready on /readyz when ingest is further behind than this, 0 disables the check",
+				EnvVars: []string{"NORSKY_READY_MAX_LAG"},
+				Value:   5 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:    "jetstream-stall-timeout",
+				Usage:   "Reconnect to the next Jetstream host when nothing arrives for this long",
+				EnvVars: []string{"NORSKY_JETSTREAM_STALL_TIMEOUT"},
+				Value:   firehose.DefaultStallTimeout,
+			},
+			&cli.StringFlag{
+				Name:    "retention",
+				Usage:   "Remove posts older than this when scheduled retention is enabled, e.g. 90d",
+				EnvVars: []string{"NORSKY_RETENTION"},
+				Value:   "90d",
+			},
+			&cli.DurationFlag{
+				Name:    "retention-interval",
+				Usage:   "How often to remove old posts, 0 disables scheduled retention (use the tidy command instead)",
+				EnvVars: []string{"NORSKY_RETENTION_INTERVAL"},
+				Value:   0,
+			},
+			&cli.DurationFlag{
+				Name:    "vacuum-interval",
+				Usage:   "How often to VACUUM and ANALYZE the posts tables, 0 disables it",
+				EnvVars: []string{"NORSKY_VACUUM_INTERVAL"},
+				Value:   0,
+			},
+			&cli.DurationFlag{
+				Name:    "refresh-views-interval",
+				Usage:   "How often to refresh materialized views, 0 disables it",
+				EnvVars: []string{"NORSKY_REFRESH_VIEWS_INTERVAL"},
+				Value:   0,
+			},
+			&cli.DurationFlag{
+				Name:    "stats-rollup-interval",
+				Usage:   "How often to update the hourly dashboard statistics, 0 disables it",
+				EnvVars: []string{"NORSKY_STATS_ROLLUP_INTERVAL"},
+				Value:   5 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:    "stats-rollup-lookback",
+				Usage:   "How many hours back each statistics update recomputes, to count posts stored late",
+				EnvVars: []string{"NORSKY_STATS_ROLLUP_LOOKBACK"},
+				Value:   db.DefaultStatsLookback,
+			},
+			&cli.IntFlag{
+				Name:    "write-batch-size",
+				Usage:   "Number of posts written to the database per batch",
+				EnvVars: []string{"NORSKY_WRITE_BATCH_SIZE"},
+				Value:   sink.DefaultWriteBatchSize,
+			},
+			&cli.DurationFlag{
+				Name:    "write-flush-interval",
+				Usage:   "Maximum time posts are buffered before they are written to the database",
+				EnvVars: []string{"NORSKY_WRITE_FLUSH_INTERVAL"},
+				Value:   sink.DefaultWriteFlushInterval,
+			},
+			&cli.IntFlag{
+				Name:    "rate-limit-ip",
+				Usage:   "XRPC and dashboard requests allowed per client IP within the rate limit window, 0 disables it",
+				EnvVars: []string{"NORSKY_RATE_LIMIT_IP"},
+				Value:   0,
+			},
+			&cli.IntFlag{
+				Name:    "rate-limit-viewer",
+				Usage:   "XRPC requests allowed per authenticated viewer within the rate limit window, 0 disables it",
+				EnvVars: []string{"NORSKY_RATE_LIMIT_VIEWER"},
+				Value:   120,
+			},
+			&cli.DurationFlag{
+				Name:    "rate-limit-window",
+				Usage:   "Sliding window the rate limits are counted in",
+				EnvVars: []string{"NORSKY_RATE_LIMIT_WINDOW"},
+				Value:   server.DefaultRateLimitWindow,
+			},
+			&cli.StringFlag{
+				Name:    "proxy-header",
+				Usage:   "Header with the client IP when running behind a reverse proxy, e.g. X-Forwarded-For",
+				EnvVars: []string{"NORSKY_PROXY_HEADER"},
+			},
+			&cli.DurationFlag{
+				Name:    "skeleton-cache-ttl",
+				Usage:   "How long feed pages of anonymous viewers are cached, 0 disables caching",
+				EnvVars: []string{"NORSKY_SKELETON_CACHE_TTL"},
+				Value:   feeds.DefaultSkeletonCacheTTL,
+			},
+			&cli.IntFlag{
+				Name:    "live-buffer-size",
+				Usage:   "Number of posts buffered per dashboard live stream client before it is dropped",
+				EnvVars: []string{"NORSKY_LIVE_BUFFER_SIZE"},
+				Value:   sink.DefaultBroadcastBuffer,
+			},
+			&cli.StringFlag{
+				Name:    "partition-interval",
+				Usage:   "Time range of each posts partition created ahead of time, day or week",
+				EnvVars: []string{"NORSKY_PARTITION_INTERVAL"},
+				Value:   string(db.PartitionWeekly),
+			},
+			&cli.IntFlag{
+				Name:    "partitions-ahead",
+				Usage:   "Number of future posts partitions to keep ready",
+				EnvVars: []string{"NORSKY_PARTITIONS_AHEAD"},
+				Value:   db.DefaultPartitionsAhead,
+			},
 			&cli.StringFlag{
 				Name:    "db-host",
 				Usage:   "PostgreSQL host",
@@ -163,6 +269,17 @@ func serveCmd() *cli.Command {
 				ctx.String("db-name"),
 			)
 
+			// Make sure incoming posts have a partition before the firehose starts writing,
+			// posts without one end up in the default partition until the next run
+			partitionInterval, err := db.ParsePartitionInterval(ctx.String("partition-interval"))
+			if err != nil {
+				return err
+			}
+			partitionsAhead := ctx.Int("partitions-ahead")
+			if _, err := database.EnsurePostPartitions(ctx.Context, partitionInterval, partitionsAhead); err != nil {
+				log.WithError(err).Error("Failed to create posts partitions")
+			}
+
 			hostname := ctx.String("hostname")
 			host := ctx.String("host")
 			port := ctx.Int("port")
@@ -176,16 +293,15 @@ func serveCmd() *cli.Command {
 			if hostname == "" {
 				return errors.New("missing required flag: --hostname")
 			}
+			serviceDID, err := resolveServiceDID(ctx)
+			if err != nil {
+				return err
+			}
 
 			if confidenceThreshold < 0 || confidenceThreshold > 1.0 {
 				return errors.New("confidence-threshold must be between 0 and 1")
 			}
 
-			// Channel for subscribing to bluesky posts
-			firehoseCtx := context.Context(ctx.Context)
-			livenessTicker := time.NewTicker(15 * time.Minute)
-			postChan := make(chan interface{}, 1000)
-
 			// Get initial sequence
 			// seq, err := database.GetSequence()
 			// if err != nil {
@@ -199,137 +315,102 @@ func serveCmd() *cli.Command {
 			}
 
 			// Initialize feeds and pass to server
-			feedMap, err := feeds.InitializeFeeds(cfg, database)
+			viewers := feeds.NewViewerTracker(database, bluesky.NewGraphRecordsClient(nil))
+			feedMap, err := feeds.InitializeFeeds(cfg, database, viewers)
 			if err != nil {
 				return fmt.Errorf("failed to initialize feeds: %w", err)
 			}
 
-			// Get unique languages from all feeds
-			languages := make(map[string]struct{})
-			detectAllLanguages := false
-
-			// First pass to check if any feed wants all languages
-			for _, feed := range cfg.Feeds {
-				hasLanguageFilter := false
-				for _, filter := range feed.Filters {
-					if filter.Type == "language" && len(filter.Languages) > 0 {
-						hasLanguageFilter = true
-						for _, lang := range filter.Languages {
-							languages[lang] = struct{}{}
-						}
-					}
-				}
-				if !hasLanguageFilter {
-					detectAllLanguages = true
-					break
+			// Posts accepted by the firehose workers are written to the database in batches and
+			// streamed to the dashboard clients, written posts expire the cached pages of their feeds
+			live := sink.NewBroadcaster(ctx.Int("live-buffer-size"))
+			skeletons := feeds.NewSkeletonCache(feedMap, ctx.Duration("skeleton-cache-ttl"))
+			postSink := sink.NewFanout(sink.NewDBSink(database, sink.DBConfig{
+				BatchSize:     ctx.Int("write-batch-size"),
+				FlushInterval: ctx.Duration("write-flush-interval"),
+				Flushed:       skeletons,
+			}), live)
+
+			// Personalized feeds need graph records from the firehose as well as posts
+			for _, collection := range feeds.WantedCollections(cfg) {
+				if !lo.Contains(wantedCollections, collection) {
+					log.Infof("Adding %s to wanted collections for personalized feeds", collection)
+					wantedCollections = append(wantedCollections, collection)
 				}
 			}
 
-			// Convert to slice
-			targetLanguages := make([]string, 0)
-			if detectAllLanguages {
-				// If any feed wants all languages, we'll pass an empty slice
-				// which the firehose will interpret as "detect all languages"
+			// Only detect the languages the feeds filter on, an empty slice detects all languages
+			targetLanguages := feeds.TargetLanguages(cfg)
+			if len(targetLanguages) == 0 {
 				log.Info("Detecting all languages due to feed with empty language specification")
 			} else {
-				targetLanguages = make([]string, 0, len(languages))
-				for lang := range languages {
-					targetLanguages = append(targetLanguages, lang)
-				}
 				log.Infof("Detecting specific languages: %v", targetLanguages)
 			}
 
+			// The firehose supervisor reconnects by itself, resuming from the last processed event
+			fmt.Println("Subscribing to firehose...")
+			subscription := firehose.Subscribe(ctx.Context, postSink, database, firehose.FirehoseConfig{
+				RunLanguageDetection: runLanguageDetection,
+				ConfidenceThreshold:  confidenceThreshold,
+				Languages:            targetLanguages,
+				JetstreamHosts:       jetstreamHosts,
+				JetstreamCompress:    jetstreamCompress,
+				UserAgent:            userAgent,
+				WantedCollections:    wantedCollections,
+				Session: firehose.SupervisorConfig{
+					StallTimeout: ctx.Duration("jetstream-stall-timeout"),
+				},
+			})
+
 			// Create the server with unified database connection
 			app := server.Server(&server.ServerConfig{
-				Hostname: hostname,
-				DB:       database,
-				Feeds:    feedMap,
+				Hostname:   hostname,
+				ServiceDID: serviceDID,
+				DB:         database,
+				Feeds:      feedMap,
+				Auth:       auth.NewVerifier(serviceDID, nil),
+				Firehose:   subscription,
+				MaxLag:     ctx.Duration("ready-max-lag"),
+				Live:       live,
+				Skeletons:  skeletons,
+
+				RateLimitIP:     ctx.Int("rate-limit-ip"),
+				RateLimitViewer: ctx.Int("rate-limit-viewer"),
+				RateLimitWindow: ctx.Duration("rate-limit-window"),
+				ProxyHeader:     ctx.String("proxy-header"),
 			})
 
-			// Process posts using the unified database connection
-			go func() {
-				defer func() {
-					if r := recover(); r != nil {
-						log.Errorf("Recovered from panic in post processing routine: %v", r)
-					}
-				}()
-				for post := range postChan {
-					switch event := post.(type) {
-					case models.CreatePostEvent:
-						if err := database.CreatePost(ctx.Context, event.Post); err != nil {
-							log.Errorf("Failed to create post: %v", err)
-						}
-					case models.DeletePostEvent:
-						if err := database.DeletePost(ctx.Context, event.Post); err != nil {
-							log.Errorf("Failed to delete post: %v", err)
-						}
-					default:
-						log.Info("Unknown post type")
-					}
-				}
-			}()
-
-			go func() {
-				fmt.Println("Subscribing to firehose...")
-				firehose.Subscribe(firehoseCtx, postChan, livenessTicker, database, firehose.FirehoseConfig{
-					RunLanguageDetection: runLanguageDetection,
-					ConfidenceThreshold:  confidenceThreshold,
-					Languages:            targetLanguages,
-					JetstreamHosts:       jetstreamHosts,
-					JetstreamCompress:    jetstreamCompress,
-					UserAgent:            userAgent,
-					WantedCollections:    wantedCollections,
-				})
-			}()
-
 			go func() {
 				<-ctx.Done()
 				log.Info("Context canceled with reason:", ctx.Err())
 			}()
 
-			// Add liveness probe to the server, to check if we are still receiving posts on the web socket
-			// If not we need to restart the firehose connection
+			// Schedule database maintenance, guarded by advisory locks so only one replica runs each job
+			retention, err := config.ParseDuration(ctx.String("retention"))
+			if err != nil || retention <= 0 {
+				return fmt.Errorf("invalid retention: %s", ctx.String("retention"))
+			}
+			retentionRules, err := feeds.RetentionRules(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to create retention rules: %w", err)
+			}
 
-			go func() {
-				defer func() {
-					if r := recover(); r != nil {
-						log.Errorf("Recovered from panic in firehose liveness ticker: %v", r)
-					}
-				}()
+			statsFeeds, err := feeds.StatsFeeds(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to create statistics feeds: %w", err)
+			}
 
-				var lastActivity atomic.Int64
-
-				for range livenessTicker.C {
-					select {
-					case <-ctx.Done():
-						return
-					default:
-						if time.Since(time.Unix(lastActivity.Load(), 0)) > 15*time.Minute {
-							log.Warn("Firehose inactive for 15 minutes, restarting connection")
-
-							// Cancel existing context
-							if cancel, ok := firehoseCtx.Value(cancelKey).(context.CancelFunc); ok {
-								cancel()
-							}
-
-							// Create new context with cancel
-							firehoseCtx, cancel := context.WithCancel(ctx.Context)
-							firehoseCtx = context.WithValue(firehoseCtx, cancelKey, cancel)
-
-							// Restart subscription in new goroutine
-							go firehose.Subscribe(firehoseCtx, postChan, livenessTicker, database, firehose.FirehoseConfig{
-								RunLanguageDetection: ctx.Bool("run-language-detection"),
-								ConfidenceThreshold:  ctx.Float64("confidence-threshold"),
-								Languages:            targetLanguages,
-								JetstreamHosts:       ctx.StringSlice("jetstream-hosts"),
-								JetstreamCompress:    ctx.Bool("jetstream-compress"),
-								UserAgent:            ctx.String("user-agent"),
-								WantedCollections:    ctx.StringSlice("jetstream-wanted-collections"),
-							})
-						}
-					}
-				}
-			}()
+			scheduler := maintenance.NewScheduler(database)
+			scheduler.Add(maintenance.SeenPostsJob(database, 10*time.Minute))
+			scheduler.Add(maintenance.PartitionsJob(database, partitionInterval, partitionsAhead, time.Hour))
+			scheduler.Add(maintenance.RetentionJob(database, db.TidyOptions{
+				Retention: retention,
+				Rules:     retentionRules,
+			}, ctx.Duration("retention-interval")))
+			scheduler.Add(maintenance.VacuumJob(database, ctx.Duration("vacuum-interval")))
+			scheduler.Add(maintenance.RefreshViewsJob(database, ctx.Duration("refresh-views-interval")))
+			scheduler.Add(maintenance.StatsRollupJob(database, statsFeeds, ctx.Duration("stats-rollup-lookback"), ctx.Duration("stats-rollup-interval")))
+			scheduler.Start(ctx.Context)
 
 			go func() {
 				defer func() {
@@ -349,9 +430,15 @@ func serveCmd() *cli.Command {
 			<-ctx.Context.Done()
 
 			log.Info("Stopping server")
+			// End the live streams first, they would keep the server from shutting down
+			live.Close()
 			if err := app.ShutdownWithContext(ctx.Context); err != nil {
 				log.Error(err)
 			}
+			subscription.Wait()
+			if err := postSink.Close(); err != nil {
+				log.Error(err)
+			}
 			log.Info("Norsky feed generator stopped")
 
 			return nil
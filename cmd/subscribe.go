@@ -4,13 +4,12 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"norsky/feeds"
 	"norsky/firehose"
-	"norsky/models"
+	"norsky/sink"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"norsky/config"
@@ -28,13 +27,73 @@ func subscribeCmd() *cli.Command {
 Norwegian bokmål, nynorsk and sami to the command line.
 
 Can be used if you want to collect all posts written in Norwegian by
-passing the output to a file or another application.
+passing the output to a file or another application. No database is needed.
 
-Returns each post as a JSON object on a single line. Use a tool like jq to process
+Returns each post as a JSON object on a single line, including the detected
+language and the confidence of the detection. Use a tool like jq to process
 the output.
 
+The languages are taken from the language filters in --config when given,
+otherwise from --languages.
+
+Start from an earlier point in time with --cursor or --since, Jetstream keeps
+roughly a day of events.
+
+Use --output to write to rotating files in a directory instead, as JSON lines,
+CSV or Parquet, optionally compressed with gzip or zstd. Files are rotated daily
+by default and keep a .part suffix until they are complete.
+
 Prints all other log messages to stderr.`,
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Path to feeds configuration file to take the languages from, optional",
+				EnvVars: []string{"NORSKY_CONFIG"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "languages",
+				Usage:   "Languages to collect when no config is given",
+				EnvVars: []string{"NORSKY_LANGUAGES"},
+				Value:   cli.NewStringSlice("nb", "nn", "no", "se"),
+			},
+			&cli.Int64Flag{
+				Name:  "cursor",
+				Usage: "Jetstream cursor to start from, in unix microseconds",
+			},
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "Start from this long ago or from this time, e.g. 2h or 2025-02-01T12:00:00Z",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "Directory to write rotating files to instead of printing JSON lines to stdout",
+				EnvVars: []string{"NORSKY_OUTPUT"},
+			},
+			&cli.StringFlag{
+				Name:    "format",
+				Usage:   "File format when writing to --output: jsonl, csv or parquet",
+				EnvVars: []string{"NORSKY_OUTPUT_FORMAT"},
+				Value:   string(sink.FormatJSONL),
+			},
+			&cli.StringFlag{
+				Name:    "compression",
+				Usage:   "Compression of output files: none, gzip or zstd",
+				EnvVars: []string{"NORSKY_OUTPUT_COMPRESSION"},
+				Value:   string(sink.CompressionNone),
+			},
+			&cli.DurationFlag{
+				Name:    "rotate-interval",
+				Usage:   "Start a new output file at every multiple of this interval in UTC, 0 disables it",
+				EnvVars: []string{"NORSKY_ROTATE_INTERVAL"},
+				Value:   24 * time.Hour,
+			},
+			&cli.Int64Flag{
+				Name:    "rotate-size-mb",
+				Usage:   "Start a new output file when the current one reaches this many megabytes, 0 disables it",
+				EnvVars: []string{"NORSKY_ROTATE_SIZE_MB"},
+			},
 			&cli.BoolFlag{
 				Name:    "detect-false-negatives",
 				Usage:   "Detect false negatives in language detection",
@@ -50,6 +109,10 @@ Prints all other log messages to stderr.`,
 				Name:    "jetstream-hosts",
 				Usage:   "Jetstream hosts",
 				EnvVars: []string{"NORSKY_JETSTREAM_HOSTS"},
+				Value: cli.NewStringSlice(
+					"wss://jetstream1.us-east.bsky.network",
+					"wss://jetstream2.us-east.bsky.network",
+				),
 			},
 			&cli.BoolFlag{
 				Name:    "jetstream-compress",
@@ -74,124 +137,110 @@ Prints all other log messages to stderr.`,
 			},
 		},
 		Action: func(ctx *cli.Context) error {
-			// Get the context for this process to pass to firehose
-
-			// Disable logging to stdout
+			// Keep stdout for posts only
 			log.SetOutput(os.Stderr)
 
-			// Load feed configuration
-			cfg, err := config.LoadConfig("feeds.toml")
-			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
-			}
-
-			// Get unique languages from all feeds
-			languages := make(map[string]struct{})
-			detectAllLanguages := false
-
-			// First pass to check if any feed wants all languages
-			for _, feed := range cfg.Feeds {
-				hasLanguageFilter := false
-				for _, filter := range feed.Filters {
-					if filter.Type == "language" && len(filter.Languages) > 0 {
-						hasLanguageFilter = true
-						for _, lang := range filter.Languages {
-							languages[lang] = struct{}{}
-						}
-					}
-				}
-				if !hasLanguageFilter {
-					detectAllLanguages = true
-					break
+			targetLanguages := ctx.StringSlice("languages")
+			if path := ctx.String("config"); path != "" {
+				cfg, err := config.LoadConfig(path)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
 				}
+				targetLanguages = feeds.TargetLanguages(cfg)
 			}
 
-			// Convert to slice
-			targetLanguages := make([]string, 0)
-			if detectAllLanguages {
-				// If any feed wants all languages, we'll pass an empty slice
-				// which the firehose will interpret as "detect all languages"
-				log.Info("Detecting all languages due to feed with empty language specification")
+			if len(targetLanguages) == 0 {
+				log.Info("Detecting all languages")
 			} else {
-				targetLanguages = make([]string, 0, len(languages))
-				for lang := range languages {
-					targetLanguages = append(targetLanguages, lang)
-				}
 				log.Infof("Detecting specific languages: %v", targetLanguages)
 			}
 
-			// Channel for subscribing to bluesky posts
-			postChan := make(chan interface{})
-
-			ticker := time.NewTicker(5 * time.Minute)
-
-			go func() {
-				fmt.Println("Subscribing to firehose...")
-				firehose.Subscribe(
-					ctx.Context,
-					postChan,
-					ticker,
-					nil,
-					firehose.FirehoseConfig{
-						RunLanguageDetection: ctx.Bool("run-language-detection"),
-						ConfidenceThreshold:  ctx.Float64("confidence-threshold"),
-						Languages:            targetLanguages,
-						JetstreamHosts:       ctx.StringSlice("jetstream-hosts"),
-						JetstreamCompress:    ctx.Bool("jetstream-compress"),
-						UserAgent:            ctx.String("user-agent"),
-						WantedCollections:    ctx.StringSlice("jetstream-wanted-collections"),
-					},
-				)
-			}()
-
-			go func() {
-				// Subscribe to the post channel and log the posts
-				// Stop if the context is cancelled
-				for message := range postChan {
-					select {
-					case <-ctx.Context.Done():
-						fmt.Println("Stopping subscription")
-						return
-					default:
-						switch message := message.(type) {
-						case models.CreatePostEvent:
-							printStdout(&message.Post)
-						case models.UpdatePostEvent:
-							printStdout(&message.Post)
-						case models.DeletePostEvent:
-							printStdout(&message.Post)
-						}
-					}
-				}
-			}()
-
-			// Create a signal channel to wait for interrupt
-			sigChan := make(chan os.Signal, 1)
-			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-			// Wait for either interrupt signal or context cancellation
-			select {
-			case <-sigChan:
-				fmt.Println("Received interrupt signal, shutting down...")
-			case <-ctx.Context.Done():
-				fmt.Println("Context cancelled, shutting down...")
+			cursor, err := subscribeCursor(ctx.Int64("cursor"), ctx.String("since"))
+			if err != nil {
+				return err
 			}
 
-			// Clean up
-			ticker.Stop()
-			close(postChan)
+			postSink, err := subscribeSink(ctx)
+			if err != nil {
+				return err
+			}
 
-			return nil
+			log.Info("Subscribing to firehose...")
+			subscription := firehose.Subscribe(ctx.Context, postSink, nil, firehose.FirehoseConfig{
+				RunLanguageDetection: ctx.Bool("run-language-detection"),
+				ConfidenceThreshold:  ctx.Float64("confidence-threshold"),
+				Languages:            targetLanguages,
+				JetstreamHosts:       ctx.StringSlice("jetstream-hosts"),
+				JetstreamCompress:    ctx.Bool("jetstream-compress"),
+				UserAgent:            ctx.String("user-agent"),
+				WantedCollections:    ctx.StringSlice("jetstream-wanted-collections"),
+				Cursor:               cursor,
+			})
+
+			// Stops on interrupt, the context is cancelled by main
+			<-ctx.Context.Done()
+			log.Info("Shutting down...")
+
+			// Let the workers finish before closing the sink
+			subscription.Wait()
+
+			return postSink.Close()
 		},
 	}
 }
 
-func printStdout(post *models.Post) {
-	// Print as single JSON string on a single line
+// subscribeCursor turns the --cursor and --since flags into a Jetstream cursor, zero starts live
+func subscribeCursor(cursor int64, since string) (int64, error) {
+	if cursor != 0 && since != "" {
+		return 0, errors.New("use either --cursor or --since, not both")
+	}
+	if since == "" {
+		return cursor, nil
+	}
+
+	if start, err := time.Parse(time.RFC3339, since); err == nil {
+		return start.UnixMicro(), nil
+	}
+	ago, err := config.ParseDuration(since)
+	if err != nil || ago <= 0 {
+		return 0, fmt.Errorf("invalid --since, expected a duration or RFC3339 time: %s", since)
+	}
+	return time.Now().Add(-ago).UnixMicro(), nil
+}
+
+// subscribeSink prints JSON lines to stdout, or writes rotating files when --output is set. Deletes are
+// only written for posts written before them.
+func subscribeSink(ctx *cli.Context) (sink.PostSink, error) {
+	output, err := outputSink(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sink.NewKnownPostsFilter(output, sink.DefaultKnownPosts), nil
+}
+
+func outputSink(ctx *cli.Context) (sink.PostSink, error) {
+	format, err := sink.ParseFileFormat(ctx.String("format"))
+	if err != nil {
+		return nil, err
+	}
+	compression, err := sink.ParseCompression(ctx.String("compression"))
+	if err != nil {
+		return nil, err
+	}
 
-	// Convert Post to JSON string
-	postJson, err := json.Marshal(post)
-	if err == nil {
-		fmt.Println(string(postJson))
+	dir := ctx.String("output")
+	if dir == "" {
+		if format != sink.FormatJSONL || compression != sink.CompressionNone {
+			return nil, errors.New("--format and --compression need --output")
+		}
+		return sink.NewJSONSink(os.Stdout), nil
 	}
+
+	return sink.NewFileSink(sink.FileConfig{
+		Dir:            dir,
+		Format:         format,
+		Compression:    compression,
+		RotateInterval: ctx.Duration("rotate-interval"),
+		RotateSize:     ctx.Int64("rotate-size-mb") * 1024 * 1024,
+	})
 }
@@ -5,7 +5,9 @@ package cmd
 
 import (
 	"fmt"
+	"norsky/config"
 	"norsky/db"
+	"norsky/feeds"
 
 	"github.com/urfave/cli/v2"
 )
@@ -15,22 +17,115 @@ func tidyCmd() *cli.Command {
 		Name:  "tidy",
 		Usage: "Tidy up the database",
 		Description: `Tidy up the database by removing posts that are old.
-		
-		Remove posts that are older than 90 days from the database.
-		This is to keep the database size down and to keep the feed fresh.`,
+
+		Remove posts that are older than the retention period (90 days by default) from the database.
+		This is to keep the database size down and to keep the feed fresh.
+
+		Posts can be kept longer or shorter per language or per feed by adding retention
+		overrides to the feeds configuration file. When several overrides match a post the
+		longest retention wins. Posts are deleted in batches to avoid long running locks.`,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:    "database",
-				Aliases: []string{"d"},
-				Value:   "feed.db",
-				Usage:   "SQLite database file location",
-				EnvVars: []string{"NORSKY_DATABASE"},
+				Name:    "retention",
+				Usage:   "Remove posts older than this, e.g. 90d or 720h",
+				EnvVars: []string{"NORSKY_RETENTION"},
+				Value:   "90d",
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Path to feeds configuration file with retention overrides, optional",
+				EnvVars: []string{"NORSKY_CONFIG"},
+			},
+			&cli.IntFlag{
+				Name:    "batch-size",
+				Usage:   "Number of posts to delete per statement",
+				EnvVars: []string{"NORSKY_TIDY_BATCH_SIZE"},
+				Value:   db.DefaultTidyBatchSize,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report how many posts would be removed without removing them",
+			},
+			&cli.StringFlag{
+				Name:    "db-host",
+				Usage:   "PostgreSQL host",
+				EnvVars: []string{"NORSKY_DB_HOST"},
+				Value:   "localhost",
+			},
+			&cli.IntFlag{
+				Name:    "db-port",
+				Usage:   "PostgreSQL port",
+				EnvVars: []string{"NORSKY_DB_PORT"},
+				Value:   5432,
+			},
+			&cli.StringFlag{
+				Name:    "db-user",
+				Usage:   "PostgreSQL user",
+				EnvVars: []string{"NORSKY_DB_USER"},
+				Value:   "norsky",
+			},
+			&cli.StringFlag{
+				Name:    "db-password",
+				Usage:   "PostgreSQL password",
+				EnvVars: []string{"NORSKY_DB_PASSWORD"},
+				Value:   "norsky",
+			},
+			&cli.StringFlag{
+				Name:    "db-name",
+				Usage:   "PostgreSQL database name",
+				EnvVars: []string{"NORSKY_DB_NAME"},
+				Value:   "norsky",
 			},
 		},
 		Action: func(ctx *cli.Context) error {
-			database := ctx.String("database")
-			fmt.Println("Database configured: ", database)
-			err := db.Tidy(database)
+			fmt.Printf("Database configured: %s:%d/%s\n",
+				ctx.String("db-host"),
+				ctx.Int("db-port"),
+				ctx.String("db-name"),
+			)
+
+			retention, err := config.ParseDuration(ctx.String("retention"))
+			if err != nil || retention <= 0 {
+				return fmt.Errorf("invalid retention: %s", ctx.String("retention"))
+			}
+
+			var rules []db.RetentionRule
+			if path := ctx.String("config"); path != "" {
+				cfg, err := config.LoadConfig(path)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				rules, err = feeds.RetentionRules(cfg)
+				if err != nil {
+					return fmt.Errorf("failed to create retention rules: %w", err)
+				}
+			}
+
+			database := db.NewDB(
+				ctx.String("db-host"),
+				ctx.Int("db-port"),
+				ctx.String("db-user"),
+				ctx.String("db-password"),
+				ctx.String("db-name"),
+			)
+
+			dryRun := ctx.Bool("dry-run")
+			results, err := database.Tidy(ctx.Context, db.TidyOptions{
+				Retention: retention,
+				Rules:     rules,
+				BatchSize: ctx.Int("batch-size"),
+				DryRun:    dryRun,
+			})
+
+			verb := "Removed"
+			if dryRun {
+				verb = "Would remove"
+			}
+			for _, result := range results {
+				fmt.Printf("%s %d posts (rule %s, retention %s)\n", verb, result.Posts, result.Rule, result.Retention)
+			}
+
 			return err
 		},
 	}
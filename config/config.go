@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -22,6 +25,8 @@ type TomlFilter struct {
 	Languages []string `toml:"languages,omitempty"`
 	Include   []string `toml:"include,omitempty"` // References to keyword lists
 	Exclude   []string `toml:"exclude,omitempty"` // References to keyword lists
+	Max       string   `toml:"max,omitempty"`     // Maximum post age for age filters, e.g. "72h"
+	Min       string   `toml:"min,omitempty"`     // Minimum post age for age filters, e.g. "10m"
 }
 
 // TomlScoring represents a scoring strategy configuration
@@ -30,6 +35,7 @@ type TomlScoring struct {
 	Weight   float64      `toml:"weight"`
 	Keywords string       `toml:"keywords,omitempty"` // Reference to keyword list
 	Authors  []TomlAuthor `toml:"authors,omitempty"`
+	Window   string       `toml:"window,omitempty"` // Only count interactions this recent, e.g. "7d", for interactions scoring
 }
 
 // TomlFeed represents feed configuration
@@ -40,12 +46,22 @@ type TomlFeed struct {
 	AvatarPath  string        `toml:"avatar_path"`
 	Filters     []TomlFilter  `toml:"filters"`
 	Scoring     []TomlScoring `toml:"scoring"`
+	SeenTTL     string        `toml:"seen_ttl,omitempty"`     // How long served posts are down-ranked for a viewer, e.g. "12h"
+	SeenPenalty *float64      `toml:"seen_penalty,omitempty"` // Score multiplier for seen posts, defaults to 0.1 when unset
+	Retention   string        `toml:"retention,omitempty"`    // Keep posts matching the feed filters this long, e.g. "180d"
+	Window      string        `toml:"window,omitempty"`       // Only consider posts created within this window, e.g. "7d"
+}
+
+// TomlRetention holds retention overrides used by tidy
+type TomlRetention struct {
+	Languages map[string]string `toml:"languages,omitempty"` // Language code to retention, e.g. se = "365d"
 }
 
 // TomlConfig represents the top-level configuration
 type TomlConfig struct {
-	Keywords TomlKeywords `toml:"keywords"`
-	Feeds    []TomlFeed   `toml:"feeds"`
+	Keywords  TomlKeywords  `toml:"keywords"`
+	Feeds     []TomlFeed    `toml:"feeds"`
+	Retention TomlRetention `toml:"retention"`
 }
 
 func LoadConfig(path string) (*TomlConfig, error) {
@@ -61,3 +77,15 @@ func LoadConfig(path string) (*TomlConfig, error) {
 
 	return &config, nil
 }
+
+// ParseDuration parses a Go duration, additionally accepting whole days such as "90d"
+func ParseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -43,109 +43,131 @@ func NewDB(host string, port int, user, password, dbname string) *DB {
 	return &DB{db: db}
 }
 
+// Ping checks that the database is reachable
+func (db *DB) Ping(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
 // Write operations
 
-func (db *DB) CreatePost(ctx context.Context, post models.Post) error {
+// CreatePosts upserts posts with multi-row inserts, all chunks are written in one transaction
+func (db *DB) CreatePosts(ctx context.Context, posts []models.Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	log.WithFields(log.Fields{
-		"uri":        post.Uri,
-		"parent_uri": post.ParentUri,
-		"languages":  post.Languages,
-		"created_at": time.Unix(post.CreatedAt, 0).Format(time.RFC3339),
-		"lagSeconds": time.Since(time.Unix(post.CreatedAt, 0)).Seconds(),
-	}).Info("Creating post")
-
-	_, err := db.db.ExecContext(ctx, `
-		INSERT INTO posts (uri, created_at, indexed_at, text, parent_uri, languages, author_did)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		ON CONFLICT (uri) DO UPDATE SET
-			indexed_at = $3,
-			text = $4,
-			parent_uri = $5,
-			languages = $6,
-			author_did = $7`,
-		post.Uri,
-		time.Unix(post.CreatedAt, 0),
-		time.Now(),
-		post.Text,
-		post.ParentUri,
-		pq.Array(post.Languages),
-		post.Author,
-	)
+	// A single insert can't update the same row twice, keep the last version of duplicated posts
+	seen := make(map[string]bool, len(posts))
+	unique := make([]models.Post, 0, len(posts))
+	for i := len(posts) - 1; i >= 0; i-- {
+		if !seen[posts[i].Uri] {
+			seen[posts[i].Uri] = true
+			unique = append(unique, posts[i])
+		}
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("insert error: %w", err)
+		return fmt.Errorf("begin error: %w", err)
 	}
+	defer tx.Rollback()
+
+	indexedAt := time.Now()
+
+	// Insert in chunks to stay well below the PostgreSQL parameter limit
+	for start := 0; start < len(unique); start += 1000 {
+		end := min(start+1000, len(unique))
+
+		// The partitioned table is only unique on (uri, created_at). Move stored posts whose created_at
+		// changed to the new one first, keeping their id, so the upsert below finds them and a uri is
+		// never stored twice.
+		uris := make([]string, 0, end-start)
+		createdAts := make([]int64, 0, end-start)
+		for _, post := range unique[start:end] {
+			uris = append(uris, post.Uri)
+			createdAts = append(createdAts, post.CreatedAt)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE posts SET created_at = to_timestamp(incoming.created_at)
+			FROM unnest($1::text[], $2::bigint[]) AS incoming(uri, created_at)
+			WHERE posts.uri = incoming.uri AND posts.created_at <> to_timestamp(incoming.created_at)`,
+			pq.Array(uris), pq.Array(createdAts),
+		); err != nil {
+			return fmt.Errorf("update created_at error: %w", err)
+		}
 
+		ib := sqlbuilder.PostgreSQL.NewInsertBuilder()
+		ib.InsertInto("posts").Cols("uri", "created_at", "indexed_at", "text", "parent_uri", "languages", "author_did")
+		for _, post := range unique[start:end] {
+			ib.Values(
+				post.Uri,
+				time.Unix(post.CreatedAt, 0),
+				indexedAt,
+				post.Text,
+				post.ParentUri,
+				pq.Array(post.Languages),
+				post.Author,
+			)
+		}
+		ib.SQL(`ON CONFLICT (uri, created_at) DO UPDATE SET
+			indexed_at = EXCLUDED.indexed_at,
+			text = EXCLUDED.text,
+			parent_uri = EXCLUDED.parent_uri,
+			languages = EXCLUDED.languages,
+			author_did = EXCLUDED.author_did`)
+
+		sql, args := ib.Build()
+		if _, err := tx.ExecContext(ctx, sql, args...); err != nil {
+			return fmt.Errorf("insert error: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error: %w", err)
+	}
 	return nil
 }
 
-func (db *DB) DeletePost(ctx context.Context, post models.Post) error {
+// DeletePosts removes posts by uri in a single statement
+func (db *DB) DeletePosts(ctx context.Context, uris []string) error {
+	if len(uris) == 0 {
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	log.Info("Deleting post")
-	_, err := db.db.ExecContext(ctx, "DELETE FROM posts WHERE uri = $1", post.Uri)
-	if err != nil {
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM posts WHERE uri = ANY($1)", pq.Array(uris)); err != nil {
 		return fmt.Errorf("delete error: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) GetPostCountPerTime(lang string, timeAgg string) ([]models.PostsAggregatedByTime, error) {
-	var sqlFormat string
-	var timeParse func(string) (time.Time, error)
-
-	switch timeAgg {
-	case "hour":
-		sqlFormat = "date_trunc('hour', created_at)"
-	case "day":
-		sqlFormat = "date_trunc('day', created_at)"
-	case "week":
-		sqlFormat = "date_trunc('week', created_at)"
-	default:
-		sqlFormat = "date_trunc('hour', created_at)"
+// CreateInteractions stores interactions sent by clients in a single multi-row insert, an interaction a
+// viewer already sent for a post in a feed is only stored once
+func (db *DB) CreateInteractions(ctx context.Context, interactions []models.Interaction) error {
+	if len(interactions) == 0 {
+		return nil
 	}
 
-	timeParse = func(str string) (time.Time, error) {
-		return time.Parse(time.RFC3339, str)
-	}
-
-	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
-	sb.Select(sqlFormat, "count(*) as count").From("posts")
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 
-	if lang != "" {
-		sb.Where(fmt.Sprintf("languages && %s", sb.Args.Add(pq.Array([]string{lang}))))
+	ib := sqlbuilder.PostgreSQL.NewInsertBuilder()
+	ib.InsertInto("interactions").Cols("feed", "post_uri", "user_did", "event")
+	for _, interaction := range interactions {
+		ib.Values(interaction.Feed, interaction.PostUri, interaction.UserDid, interaction.Event)
 	}
+	ib.SQL("ON CONFLICT (feed, post_uri, user_did, event) DO NOTHING")
 
-	sb.GroupBy(sqlFormat)
-	sb.OrderBy(sqlFormat).Asc()
-
-	sql, args := sb.Build()
-	rows, err := db.db.Query(sql, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var postCounts []models.PostsAggregatedByTime
-	for rows.Next() {
-		var sqlTime string
-		var postCount models.PostsAggregatedByTime
-
-		if err := rows.Scan(&sqlTime, &postCount.Count); err != nil {
-			continue
-		}
-
-		postTime, err := timeParse(sqlTime)
-		if err == nil {
-			postCount.Time = postTime
-		}
-		postCounts = append(postCounts, postCount)
+	sql, args := ib.Build()
+	if _, err := db.db.ExecContext(ctx, sql, args...); err != nil {
+		return fmt.Errorf("insert error: %w", err)
 	}
-
-	return postCounts, nil
+	return nil
 }
 
 func (db *DB) GetLatestPostTimestamp(ctx context.Context) (time.Time, error) {
@@ -161,15 +183,16 @@ func (db *DB) GetLatestPostTimestamp(ctx context.Context) (time.Time, error) {
 }
 
 // GetFeedPosts executes a feed query and returns posts
-func (db *DB) GetFeedPosts(builder query.Builder, limit int, cursor int64) ([]models.FeedPost, error) {
-	query, args := builder.Build(limit, cursor)
+func (db *DB) GetFeedPosts(builder query.Builder, params query.Params) ([]models.FeedPost, error) {
+	query, args := builder.Build(params)
 
 	// Debug the actual SQL query
 	log.WithFields(log.Fields{
 		"query":  query,
 		"args":   args,
-		"limit":  limit,
-		"cursor": cursor,
+		"limit":  params.Limit,
+		"cursor": params.Cursor,
+		"viewer": params.Viewer,
 	}).Infof("Executing feed posts query")
 
 	// Prettyprint (whitespaces and all the query)
@@ -0,0 +1,13 @@
+package db
+
+// Query builders exported for the query shape tests of package db_test, which has no database to run them on
+var (
+	ExpiredPosts         = expiredPosts
+	RollupStatements     = rollupStatements
+	StatsQuery           = statsQuery
+	BucketQuery          = bucketQuery
+	PostCountsQuery      = postCountsQuery
+	ReplaceFollowsInsert = replaceFollowsInsert
+	ReplaceBlocksInsert  = replaceBlocksInsert
+	UniqueFollows        = uniqueFollows
+)
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithAdvisoryLock runs fn only if the named PostgreSQL advisory lock could be taken.
+// Returns false without running fn when another process holds the lock, e.g. another replica.
+func (db *DB) WithAdvisoryLock(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error) {
+	// Advisory locks belong to a session, so pin a connection for the duration of the lock
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("connection error: %w", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&locked); err != nil {
+		return false, fmt.Errorf("lock error: %w", err)
+	}
+	if !locked {
+		return false, nil
+	}
+
+	defer func() {
+		// Use a fresh context so the lock is released even if ctx was cancelled
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := conn.ExecContext(unlockCtx, "SELECT pg_advisory_unlock(hashtext($1))", name); err != nil {
+			log.WithError(err).WithField("lock", name).Error("Failed to release advisory lock")
+		}
+	}()
+
+	return true, fn(ctx)
+}
+
+// VacuumAnalyze reclaims space left by deleted rows and refreshes planner statistics
+func (db *DB) VacuumAnalyze(ctx context.Context, tables ...string) error {
+	for _, table := range tables {
+		if _, err := db.db.ExecContext(ctx, "VACUUM (ANALYZE) "+pq.QuoteIdentifier(table)); err != nil {
+			return fmt.Errorf("vacuum %s error: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// RefreshMaterializedViews refreshes all materialized views in the public schema and returns their names
+func (db *DB) RefreshMaterializedViews(ctx context.Context) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT matviewname FROM pg_matviews WHERE schemaname = 'public'")
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+
+	var views []string
+	for rows.Next() {
+		var view string
+		if err := rows.Scan(&view); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		views = append(views, view)
+	}
+	rows.Close()
+
+	for _, view := range views {
+		// Concurrent refreshes don't block readers but need a unique index, fall back to a plain refresh
+		if _, err := db.db.ExecContext(ctx, "REFRESH MATERIALIZED VIEW CONCURRENTLY "+pq.QuoteIdentifier(view)); err != nil {
+			if _, err := db.db.ExecContext(ctx, "REFRESH MATERIALIZED VIEW "+pq.QuoteIdentifier(view)); err != nil {
+				return views, fmt.Errorf("refresh %s error: %w", view, err)
+			}
+		}
+	}
+
+	return views, nil
+}
@@ -0,0 +1,13 @@
+CREATE TABLE interactions (
+    id BIGSERIAL PRIMARY KEY,
+    feed TEXT NOT NULL DEFAULT '',
+    post_uri TEXT NOT NULL,
+    user_did TEXT NOT NULL DEFAULT '',
+    event TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Scoring looks up interactions by post and feed
+CREATE INDEX interactions_post_uri_feed_idx ON interactions(post_uri, feed);
+CREATE INDEX interactions_user_did_idx ON interactions(user_did);
+CREATE INDEX interactions_created_at_idx ON interactions(created_at DESC);
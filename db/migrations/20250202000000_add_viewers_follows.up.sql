@@ -0,0 +1,18 @@
+-- Viewers are authenticated users that have requested one of our personalized feeds
+CREATE TABLE viewers (
+    did TEXT PRIMARY KEY,
+    first_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    follows_backfilled_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Follows of viewers, uri is NULL for follows that were backfilled from the AppView
+CREATE TABLE follows (
+    follower_did TEXT NOT NULL,
+    subject_did TEXT NOT NULL,
+    uri TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (follower_did, subject_did)
+);
+
+CREATE INDEX follows_uri_idx ON follows(uri);
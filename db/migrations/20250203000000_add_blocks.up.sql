@@ -0,0 +1,10 @@
+-- Blocks created by or targeting viewers of personalized feeds
+CREATE TABLE blocks (
+    uri TEXT PRIMARY KEY,
+    author_did TEXT NOT NULL,
+    subject_did TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX blocks_author_did_idx ON blocks(author_did);
+CREATE INDEX blocks_subject_did_idx ON blocks(subject_did);
@@ -0,0 +1,11 @@
+-- Posts served to authenticated viewers, used to down-rank repeats on the first page.
+-- Unlogged since losing it on a crash only means viewers may see some posts again.
+CREATE UNLOGGED TABLE seen_posts (
+    viewer_did TEXT NOT NULL,
+    feed TEXT NOT NULL,
+    post_id BIGINT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (viewer_did, feed, post_id)
+);
+
+CREATE INDEX seen_posts_expires_at_idx ON seen_posts(expires_at);
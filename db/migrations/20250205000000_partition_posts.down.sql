@@ -0,0 +1,41 @@
+ALTER TABLE posts RENAME TO posts_partitioned;
+ALTER TABLE posts_partitioned RENAME CONSTRAINT posts_pkey TO posts_partitioned_pkey;
+ALTER TABLE posts_partitioned RENAME CONSTRAINT posts_uri_created_at_key TO posts_partitioned_uri_created_at_key;
+ALTER TABLE posts_partitioned DROP CONSTRAINT parent_uri_not_empty;
+DROP INDEX IF EXISTS posts_created_at_idx;
+DROP INDEX IF EXISTS posts_indexed_at_idx;
+DROP INDEX IF EXISTS posts_uri_idx;
+DROP INDEX IF EXISTS posts_parent_uri_idx;
+DROP INDEX IF EXISTS posts_ts_vector_idx;
+DROP INDEX IF EXISTS posts_languages_idx;
+DROP INDEX IF EXISTS posts_author_did_idx;
+
+CREATE TABLE posts (
+    id BIGINT PRIMARY KEY DEFAULT nextval('posts_id_seq'),
+    uri TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    indexed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    text TEXT,
+    parent_uri TEXT,
+    languages TEXT[] NOT NULL DEFAULT '{}',
+    ts_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(text, ''))) STORED,
+    author_did TEXT NOT NULL DEFAULT '',
+    CONSTRAINT parent_uri_not_empty CHECK (parent_uri IS NULL OR parent_uri <> '')
+);
+
+ALTER SEQUENCE posts_id_seq OWNED BY posts.id;
+
+CREATE INDEX posts_created_at_idx ON posts(created_at DESC);
+CREATE INDEX posts_indexed_at_idx ON posts(indexed_at DESC);
+CREATE INDEX posts_uri_idx ON posts(uri);
+CREATE INDEX posts_parent_uri_idx ON posts(parent_uri);
+CREATE INDEX posts_ts_vector_idx ON posts USING GIN(ts_vector);
+CREATE INDEX posts_languages_idx ON posts USING GIN(languages);
+CREATE INDEX posts_author_did_idx ON posts(author_did);
+
+INSERT INTO posts (id, uri, created_at, indexed_at, text, parent_uri, languages, author_did)
+SELECT id, uri, created_at, indexed_at, text, parent_uri, languages, author_did
+FROM posts_partitioned
+ON CONFLICT (uri) DO NOTHING;
+
+DROP TABLE posts_partitioned;
@@ -0,0 +1,81 @@
+-- Convert posts into a table partitioned by created_at. Existing rows are copied into
+-- weekly partitions, new partitions are created ahead of time by the serve command.
+--
+-- The copy runs in the migration's single transaction and holds an exclusive lock on posts
+-- until it commits, so ingest and feed requests wait for the whole copy. Run `norsky migrate`
+-- with serve stopped on large databases, and run tidy first to copy fewer posts.
+--
+-- Unique constraints of a partitioned table must include the partition key, so uri is only
+-- unique together with created_at. CreatePosts keeps uris unique by moving a stored post to
+-- its new created_at before upserting it.
+ALTER TABLE posts RENAME TO posts_unpartitioned;
+ALTER TABLE posts_unpartitioned RENAME CONSTRAINT posts_pkey TO posts_unpartitioned_pkey;
+ALTER TABLE posts_unpartitioned RENAME CONSTRAINT posts_uri_key TO posts_unpartitioned_uri_key;
+ALTER TABLE posts_unpartitioned DROP CONSTRAINT parent_uri_not_empty;
+DROP INDEX IF EXISTS posts_created_at_idx;
+DROP INDEX IF EXISTS posts_indexed_at_idx;
+DROP INDEX IF EXISTS posts_uri_idx;
+DROP INDEX IF EXISTS posts_parent_uri_idx;
+DROP INDEX IF EXISTS posts_ts_vector_idx;
+DROP INDEX IF EXISTS posts_languages_idx;
+DROP INDEX IF EXISTS posts_author_did_idx;
+
+-- Unique constraints on a partitioned table must include the partition key
+CREATE TABLE posts (
+    id BIGINT NOT NULL DEFAULT nextval('posts_id_seq'),
+    uri TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    indexed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    text TEXT,
+    parent_uri TEXT,
+    languages TEXT[] NOT NULL DEFAULT '{}',
+    ts_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(text, ''))) STORED,
+    author_did TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (id, created_at),
+    UNIQUE (uri, created_at),
+    CONSTRAINT parent_uri_not_empty CHECK (parent_uri IS NULL OR parent_uri <> '')
+) PARTITION BY RANGE (created_at);
+
+ALTER SEQUENCE posts_id_seq OWNED BY posts.id;
+
+-- Indexes on the parent are created on every partition
+CREATE INDEX posts_created_at_idx ON posts(created_at DESC);
+CREATE INDEX posts_indexed_at_idx ON posts(indexed_at DESC);
+CREATE INDEX posts_uri_idx ON posts(uri);
+CREATE INDEX posts_parent_uri_idx ON posts(parent_uri);
+CREATE INDEX posts_ts_vector_idx ON posts USING GIN(ts_vector);
+CREATE INDEX posts_languages_idx ON posts USING GIN(languages);
+CREATE INDEX posts_author_did_idx ON posts(author_did);
+
+-- Weekly partitions from the oldest post (at most a year back) until two weeks from now
+DO $$
+DECLARE
+    partition_start TIMESTAMP WITH TIME ZONE;
+    partition_end TIMESTAMP WITH TIME ZONE;
+BEGIN
+    SELECT GREATEST(
+        date_trunc('week', COALESCE(MIN(created_at), NOW())),
+        date_trunc('week', NOW() - INTERVAL '1 year')
+    ) INTO partition_start FROM posts_unpartitioned;
+
+    partition_end := date_trunc('week', NOW()) + INTERVAL '2 weeks';
+
+    WHILE partition_start < partition_end LOOP
+        EXECUTE format(
+            'CREATE TABLE %I PARTITION OF posts FOR VALUES FROM (%L) TO (%L)',
+            'posts_' || to_char(partition_start, 'YYYYMMDD'),
+            partition_start,
+            partition_start + INTERVAL '1 week'
+        );
+        partition_start := partition_start + INTERVAL '1 week';
+    END LOOP;
+END $$;
+
+-- Catches posts with a created_at outside all partitions, e.g. backdated or future dated posts
+CREATE TABLE posts_default PARTITION OF posts DEFAULT;
+
+INSERT INTO posts (id, uri, created_at, indexed_at, text, parent_uri, languages, author_did)
+SELECT id, uri, created_at, indexed_at, text, parent_uri, languages, author_did
+FROM posts_unpartitioned;
+
+DROP TABLE posts_unpartitioned;
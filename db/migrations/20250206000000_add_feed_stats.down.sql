@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS feed_hashtags_hourly;
+DROP TABLE IF EXISTS feed_authors_hourly;
+DROP TABLE IF EXISTS feed_languages_hourly;
+DROP TABLE IF EXISTS feed_stats_hourly;
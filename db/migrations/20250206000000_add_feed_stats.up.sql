@@ -0,0 +1,34 @@
+-- Hourly rollups of the posts of each feed for the dashboard statistics, maintained by the stats
+-- rollup job. The empty feed '' holds the statistics of all posts. Rollups outlive the posts they
+-- were computed from, so the dashboard can show more history than the retention keeps.
+CREATE TABLE feed_stats_hourly (
+    feed TEXT NOT NULL,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    posts BIGINT NOT NULL,
+    replies BIGINT NOT NULL,
+    PRIMARY KEY (feed, hour)
+);
+
+CREATE TABLE feed_languages_hourly (
+    feed TEXT NOT NULL,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    language TEXT NOT NULL,
+    posts BIGINT NOT NULL,
+    PRIMARY KEY (feed, hour, language)
+);
+
+CREATE TABLE feed_authors_hourly (
+    feed TEXT NOT NULL,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    author_did TEXT NOT NULL,
+    posts BIGINT NOT NULL,
+    PRIMARY KEY (feed, hour, author_did)
+);
+
+CREATE TABLE feed_hashtags_hourly (
+    feed TEXT NOT NULL,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    tag TEXT NOT NULL,
+    posts BIGINT NOT NULL,
+    PRIMARY KEY (feed, hour, tag)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE interactions DROP CONSTRAINT IF EXISTS interactions_feed_post_uri_user_did_event_key;
+ALTER TABLE interactions DROP CONSTRAINT IF EXISTS interactions_user_did_check;
+ALTER TABLE interactions ALTER COLUMN user_did SET DEFAULT '';
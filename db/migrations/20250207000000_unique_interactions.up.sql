@@ -0,0 +1,15 @@
+-- Interactions are only accepted from verified viewers, drop the anonymous ones
+DELETE FROM interactions WHERE user_did = '';
+
+-- Keep the first of each repeated interaction so a viewer counts once
+DELETE FROM interactions a
+USING interactions b
+WHERE a.feed = b.feed
+  AND a.post_uri = b.post_uri
+  AND a.user_did = b.user_did
+  AND a.event = b.event
+  AND a.id > b.id;
+
+ALTER TABLE interactions ALTER COLUMN user_did DROP DEFAULT;
+ALTER TABLE interactions ADD CONSTRAINT interactions_user_did_check CHECK (user_did <> '');
+ALTER TABLE interactions ADD CONSTRAINT interactions_feed_post_uri_user_did_event_key UNIQUE (feed, post_uri, user_did, event);
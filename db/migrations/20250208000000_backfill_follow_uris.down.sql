@@ -0,0 +1,2 @@
+-- Nothing to undo, viewers are backfilled again on their next request
+SELECT 1;
@@ -0,0 +1,3 @@
+-- Follows backfilled from the AppView have no uri, so their unfollows were never removed.
+-- Backfill every viewer again, follows are now listed from the PDS together with their uri.
+UPDATE viewers SET follows_backfilled_at = NULL;
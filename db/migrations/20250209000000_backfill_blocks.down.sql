@@ -0,0 +1 @@
+ALTER TABLE viewers RENAME COLUMN graph_backfilled_at TO follows_backfilled_at;
@@ -0,0 +1,4 @@
+-- The backfill now lists the blocks of a viewer together with their follows.
+-- Backfill every viewer again so blocks created before they were tracked are stored.
+ALTER TABLE viewers RENAME COLUMN follows_backfilled_at TO graph_backfilled_at;
+UPDATE viewers SET graph_backfilled_at = NULL;
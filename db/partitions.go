@@ -0,0 +1,225 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// PartitionInterval is the time range covered by each posts partition
+type PartitionInterval string
+
+const (
+	PartitionDaily  PartitionInterval = "day"
+	PartitionWeekly PartitionInterval = "week"
+)
+
+// DefaultPartitionsAhead is the number of future partitions kept ready for incoming posts
+const DefaultPartitionsAhead = 4
+
+func ParsePartitionInterval(value string) (PartitionInterval, error) {
+	switch PartitionInterval(value) {
+	case PartitionDaily, PartitionWeekly:
+		return PartitionInterval(value), nil
+	default:
+		return "", fmt.Errorf("invalid partition interval %q, expected day or week", value)
+	}
+}
+
+// start returns the beginning of the interval containing t, weeks start on Monday
+func (i PartitionInterval) start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if i == PartitionWeekly {
+		offset := (int(day.Weekday()) + 6) % 7
+		day = day.AddDate(0, 0, -offset)
+	}
+	return day
+}
+
+// next returns the beginning of the interval following the one containing t
+func (i PartitionInterval) next(t time.Time) time.Time {
+	if i == PartitionWeekly {
+		return i.start(t).AddDate(0, 0, 7)
+	}
+	return i.start(t).AddDate(0, 0, 1)
+}
+
+// PostPartition is a range partition of the posts table covering [From, To)
+type PostPartition struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// GetPostPartitions lists the range partitions of the posts table ordered by start, the default partition is left out
+func (db *DB) GetPostPartitions(ctx context.Context) ([]PostPartition, error) {
+	// Bounds are extracted and cast in the same session so their text format always round-trips
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT name, lower_bound, upper_bound FROM (
+			SELECT
+				c.relname AS name,
+				(regexp_match(pg_get_expr(c.relpartbound, c.oid), 'FROM \(''([^'']+)''\)'))[1]::timestamptz AS lower_bound,
+				(regexp_match(pg_get_expr(c.relpartbound, c.oid), 'TO \(''([^'']+)''\)'))[1]::timestamptz AS upper_bound
+			FROM pg_inherits i
+			JOIN pg_class c ON c.oid = i.inhrelid
+			WHERE i.inhparent = 'posts'::regclass
+		) bounds
+		WHERE lower_bound IS NOT NULL AND upper_bound IS NOT NULL
+		ORDER BY lower_bound`)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var partitions []PostPartition
+	for rows.Next() {
+		var partition PostPartition
+		if err := rows.Scan(&partition.Name, &partition.From, &partition.To); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		partitions = append(partitions, partition)
+	}
+
+	return partitions, rows.Err()
+}
+
+// EnsurePostPartitions creates the partitions needed from the current interval until ahead intervals
+// into the future and returns their names. Ranges already covered by existing partitions, possibly of
+// another interval, are skipped so the interval can be changed at any time.
+func (db *DB) EnsurePostPartitions(ctx context.Context, interval PartitionInterval, ahead int) ([]string, error) {
+	existing, err := db.GetPostPartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	end := interval.start(now)
+	for i := 0; i <= ahead; i++ {
+		end = interval.next(end)
+	}
+
+	var created []string
+	for _, partition := range missingPartitions(existing, interval, interval.start(now), end) {
+		if err := db.createPostPartition(ctx, partition); err != nil {
+			return created, fmt.Errorf("create partition %s: %w", partition.Name, err)
+		}
+		log.WithFields(log.Fields{
+			"partition": partition.Name,
+			"from":      partition.From,
+			"to":        partition.To,
+		}).Info("Created posts partition")
+		created = append(created, partition.Name)
+	}
+
+	return created, nil
+}
+
+// missingPartitions returns the partitions needed to cover [from, to) given the existing partitions
+func missingPartitions(existing []PostPartition, interval PartitionInterval, from, to time.Time) []PostPartition {
+	var missing []PostPartition
+
+	cursor := from
+	for cursor.Before(to) {
+		covered := false
+		for _, partition := range existing {
+			if !cursor.Before(partition.From) && cursor.Before(partition.To) {
+				cursor = partition.To
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+
+		// Stop at the next interval boundary, or earlier where an existing partition begins
+		next := interval.next(cursor)
+		for _, partition := range existing {
+			if partition.From.After(cursor) && partition.From.Before(next) {
+				next = partition.From
+			}
+		}
+
+		name := "posts_" + cursor.Format("20060102")
+		if !cursor.Equal(interval.start(cursor)) {
+			name += cursor.Format("_1504")
+		}
+		missing = append(missing, PostPartition{Name: name, From: cursor, To: next})
+		cursor = next
+	}
+
+	return missing
+}
+
+// createPostPartition creates a partition, moving any of its posts out of the default partition first
+func (db *DB) createPostPartition(ctx context.Context, partition PostPartition) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("transaction error: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Postgres refuses to create a partition while the default partition holds rows in its range
+	statements := []struct {
+		sql  string
+		args []interface{}
+	}{
+		{`CREATE TEMP TABLE posts_moved ON COMMIT DROP AS
+			SELECT id, uri, created_at, indexed_at, text, parent_uri, languages, author_did
+			FROM posts_default WHERE created_at >= $1 AND created_at < $2`, []interface{}{partition.From, partition.To}},
+		{"DELETE FROM posts_default WHERE created_at >= $1 AND created_at < $2", []interface{}{partition.From, partition.To}},
+		{fmt.Sprintf("CREATE TABLE %s PARTITION OF posts FOR VALUES FROM (%s) TO (%s)",
+			pq.QuoteIdentifier(partition.Name),
+			pq.QuoteLiteral(partition.From.Format(time.RFC3339)),
+			pq.QuoteLiteral(partition.To.Format(time.RFC3339)),
+		), nil},
+		{`INSERT INTO posts (id, uri, created_at, indexed_at, text, parent_uri, languages, author_did)
+			SELECT id, uri, created_at, indexed_at, text, parent_uri, languages, author_did FROM posts_moved`, nil},
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement.sql, statement.args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// dropPostPartitions drops partitions and returns how many posts they held, with dryRun the posts are only counted
+func (db *DB) dropPostPartitions(ctx context.Context, partitions []PostPartition, dryRun bool) (int64, error) {
+	var total int64
+	for _, partition := range partitions {
+		var count int64
+		err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+pq.QuoteIdentifier(partition.Name)).Scan(&count)
+		if err != nil {
+			return total, fmt.Errorf("count %s error: %w", partition.Name, err)
+		}
+
+		if !dryRun {
+			if _, err := db.db.ExecContext(ctx, "DROP TABLE "+pq.QuoteIdentifier(partition.Name)); err != nil {
+				return total, fmt.Errorf("drop %s error: %w", partition.Name, err)
+			}
+			log.WithFields(log.Fields{
+				"partition": partition.Name,
+				"posts":     count,
+			}).Info("Dropped posts partition")
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// expiredPartitions returns the partitions that only hold posts older than cutoff
+func expiredPartitions(partitions []PostPartition, cutoff time.Time) []PostPartition {
+	var expired []PostPartition
+	for _, partition := range partitions {
+		if !partition.To.After(cutoff) {
+			expired = append(expired, partition)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,340 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"norsky/models"
+	"norsky/query"
+
+	sqlbuilder "github.com/huandu/go-sqlbuilder"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultStatsLookback is how far back each rollup recomputes the hourly statistics, so posts
+// stored late, e.g. while ingest catches up, are still counted
+const DefaultStatsLookback = 3 * time.Hour
+
+// StatsFeed selects the posts a feed's statistics are computed from
+type StatsFeed struct {
+	// ID of the feed, empty for the statistics of all posts
+	ID string
+	// Filters select the feed's posts, as seen by an anonymous viewer
+	Filters []query.FilterStrategy
+}
+
+// StatsRange selects the statistics of a feed between From and To, an empty Feed selects all posts.
+// A zero From or To leaves that end of the range open.
+type StatsRange struct {
+	Feed string
+	From time.Time
+	To   time.Time
+}
+
+// TimeBucket is the width of the time buckets hourly statistics are summed into
+type TimeBucket string
+
+const (
+	BucketHour TimeBucket = "hour"
+	BucketDay  TimeBucket = "day"
+	BucketWeek TimeBucket = "week"
+)
+
+func ParseTimeBucket(value string) (TimeBucket, error) {
+	switch TimeBucket(value) {
+	case BucketHour, BucketDay, BucketWeek:
+		return TimeBucket(value), nil
+	default:
+		return "", fmt.Errorf("invalid time bucket %q, expected hour, day or week", value)
+	}
+}
+
+// PostCountQuery selects the number of posts per time bucket, of all posts or a feed, optionally in one language
+type PostCountQuery struct {
+	StatsRange
+	Language string
+	Bucket   TimeBucket
+}
+
+// rollupVolume inserts the hourly statistics of the posts in the feed_posts CTE for the feed and every
+// hour from the start until the end. Hours without posts get a row too, so charts don't skip them and
+// new feeds are only backfilled once.
+const rollupVolume = `WITH feed_posts AS (%v)
+	INSERT INTO feed_stats_hourly (feed, hour, posts, replies)
+	SELECT %v, hours.hour, COUNT(feed_posts.id), COUNT(feed_posts.parent_uri)
+	FROM generate_series(%v::timestamptz, %v::timestamptz - interval '1 hour', interval '1 hour') AS hours(hour)
+	LEFT JOIN feed_posts ON feed_posts.created_at >= hours.hour AND feed_posts.created_at < hours.hour + interval '1 hour'
+	GROUP BY hours.hour`
+
+// rollupBreakdowns insert the hourly breakdowns of the posts in the feed_posts CTE for the feed
+var rollupBreakdowns = []string{
+	`WITH feed_posts AS (%v)
+	INSERT INTO feed_languages_hourly (feed, hour, language, posts)
+	SELECT %v, date_trunc('hour', feed_posts.created_at), language, COUNT(*)
+	FROM feed_posts CROSS JOIN LATERAL unnest(feed_posts.languages) AS language
+	GROUP BY 2, 3`,
+
+	`WITH feed_posts AS (%v)
+	INSERT INTO feed_authors_hourly (feed, hour, author_did, posts)
+	SELECT %v, date_trunc('hour', feed_posts.created_at), feed_posts.author_did, COUNT(*)
+	FROM feed_posts
+	WHERE feed_posts.author_did <> ''
+	GROUP BY 2, 3`,
+
+	// A post using a hashtag more than once is counted once
+	`WITH feed_posts AS (%v)
+	INSERT INTO feed_hashtags_hourly (feed, hour, tag, posts)
+	SELECT %v, date_trunc('hour', feed_posts.created_at), lower(tag[1]), COUNT(DISTINCT feed_posts.id)
+	FROM feed_posts CROSS JOIN LATERAL regexp_matches(feed_posts.text, '#([[:alnum:]_]+)', 'g') AS tag
+	GROUP BY 2, 3`,
+}
+
+var statsTables = []string{"feed_stats_hourly", "feed_languages_hourly", "feed_authors_hourly", "feed_hashtags_hourly"}
+
+// RollupFeedStats recomputes the hourly statistics of each feed from the last rolled up hour minus the
+// lookback until now. Feeds without statistics are backfilled from the oldest post.
+func (db *DB) RollupFeedStats(ctx context.Context, feeds []StatsFeed, lookback time.Duration) error {
+	if lookback <= 0 {
+		lookback = DefaultStatsLookback
+	}
+	for _, feed := range feeds {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.rollupFeed(ctx, feed, lookback); err != nil {
+			return fmt.Errorf("rollup feed %q: %w", feed.ID, err)
+		}
+	}
+	return nil
+}
+
+func (db *DB) rollupFeed(ctx context.Context, feed StatsFeed, lookback time.Duration) error {
+	var from sql.NullTime
+	var to time.Time
+	if err := db.db.QueryRowContext(ctx, `
+		SELECT
+			date_trunc('hour', COALESCE(MAX(hour) - make_interval(secs => $2), (SELECT MIN(created_at) FROM posts))),
+			date_trunc('hour', NOW()) + interval '1 hour'
+		FROM feed_stats_hourly WHERE feed = $1`,
+		feed.ID, lookback.Seconds(),
+	).Scan(&from, &to); err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	if !from.Valid {
+		// No statistics and no posts yet
+		return nil
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range statsTables {
+		if _, err := tx.ExecContext(ctx,
+			fmt.Sprintf("DELETE FROM %s WHERE feed = $1 AND hour >= $2", table),
+			feed.ID, from.Time,
+		); err != nil {
+			return fmt.Errorf("delete %s error: %w", table, err)
+		}
+	}
+
+	for _, statement := range rollupStatements(feed, from.Time, to) {
+		sql, args := statement.BuildWithFlavor(sqlbuilder.PostgreSQL)
+		if _, err := tx.ExecContext(ctx, sql, args...); err != nil {
+			return fmt.Errorf("insert error: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"feed": feed.ID,
+		"from": from.Time,
+		"to":   to,
+	}).Debug("Rolled up feed statistics")
+	return nil
+}
+
+// rollupStatements insert the hourly statistics of the feed's posts created from the start until the end
+func rollupStatements(feed StatsFeed, from time.Time, to time.Time) []sqlbuilder.Builder {
+	posts := sqlbuilder.PostgreSQL.NewSelectBuilder()
+	posts.Select("posts.id", "posts.created_at", "posts.parent_uri", "posts.author_did", "posts.languages", "posts.text").From("posts")
+	posts.Where(posts.GreaterEqualThan("posts.created_at", from), posts.LessThan("posts.created_at", to))
+	for _, filter := range feed.Filters {
+		filter.ApplyFilter(posts, query.Params{})
+	}
+
+	statements := []sqlbuilder.Builder{sqlbuilder.Buildf(rollupVolume, posts, feed.ID, from, to)}
+	for _, breakdown := range rollupBreakdowns {
+		statements = append(statements, sqlbuilder.Buildf(breakdown, posts, feed.ID))
+	}
+	return statements
+}
+
+// statsQuery selects from a rollup table within the range
+func statsQuery(table string, r StatsRange) *sqlbuilder.SelectBuilder {
+	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
+	sb.From(table)
+	sb.Where(sb.Equal("feed", r.Feed))
+	if !r.From.IsZero() {
+		sb.Where(fmt.Sprintf("hour >= date_trunc('hour', %s::timestamptz)", sb.Args.Add(r.From)))
+	}
+	if !r.To.IsZero() {
+		sb.Where(sb.LessThan("hour", r.To))
+	}
+	return sb
+}
+
+// bucketQuery sums the columns of a rollup table per time bucket within the range
+func bucketQuery(table string, r StatsRange, bucket TimeBucket, columns ...string) (*sqlbuilder.SelectBuilder, error) {
+	if _, err := ParseTimeBucket(string(bucket)); err != nil {
+		return nil, err
+	}
+
+	sb := statsQuery(table, r)
+	sb.Select(fmt.Sprintf("date_trunc('%s', hour) AS bucket", bucket))
+	for _, column := range columns {
+		sb.SelectMore(fmt.Sprintf("SUM(%s)", column))
+	}
+	sb.GroupBy("bucket").OrderBy("bucket")
+	return sb, nil
+}
+
+// postCountsQuery sums the posts per time bucket, from the language breakdown when a language is set
+func postCountsQuery(q PostCountQuery) (*sqlbuilder.SelectBuilder, error) {
+	if q.Language == "" {
+		return bucketQuery("feed_stats_hourly", q.StatsRange, q.Bucket, "posts")
+	}
+	sb, err := bucketQuery("feed_languages_hourly", q.StatsRange, q.Bucket, "posts")
+	if err != nil {
+		return nil, err
+	}
+	sb.Where(sb.Equal("language", q.Language))
+	return sb, nil
+}
+
+// GetPostCounts returns the number of posts per time bucket from the hourly rollups
+func (db *DB) GetPostCounts(ctx context.Context, q PostCountQuery) ([]models.PostsAggregatedByTime, error) {
+	sb, err := postCountsQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	sql, args := sb.Build()
+	rows, err := db.db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make([]models.PostsAggregatedByTime, 0)
+	for rows.Next() {
+		var count models.PostsAggregatedByTime
+		if err := rows.Scan(&count.Time, &count.Count); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// GetFeedVolume returns the posts and replies of a feed per time bucket
+func (db *DB) GetFeedVolume(ctx context.Context, r StatsRange, bucket TimeBucket) ([]models.FeedVolume, error) {
+	sb, err := bucketQuery("feed_stats_hourly", r, bucket, "posts", "replies")
+	if err != nil {
+		return nil, err
+	}
+
+	sql, args := sb.Build()
+	rows, err := db.db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	volume := make([]models.FeedVolume, 0)
+	for rows.Next() {
+		var v models.FeedVolume
+		if err := rows.Scan(&v.Time, &v.Posts, &v.Replies); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		volume = append(volume, v)
+	}
+	return volume, rows.Err()
+}
+
+// GetTopAuthors returns the authors with the most posts in a feed
+func (db *DB) GetTopAuthors(ctx context.Context, r StatsRange, limit int) ([]models.AuthorCount, error) {
+	sb := statsQuery("feed_authors_hourly", r)
+	sb.Select("author_did", "SUM(posts) AS total")
+	sb.GroupBy("author_did").OrderBy("total DESC", "author_did").Limit(limit)
+
+	return queryCounts(ctx, db, sb, func(author string, posts int64) models.AuthorCount {
+		return models.AuthorCount{Author: author, Posts: posts}
+	})
+}
+
+// GetTopHashtags returns the hashtags used by the most posts in a feed
+func (db *DB) GetTopHashtags(ctx context.Context, r StatsRange, limit int) ([]models.HashtagCount, error) {
+	sb := statsQuery("feed_hashtags_hourly", r)
+	sb.Select("tag", "SUM(posts) AS total")
+	sb.GroupBy("tag").OrderBy("total DESC", "tag").Limit(limit)
+
+	return queryCounts(ctx, db, sb, func(tag string, posts int64) models.HashtagCount {
+		return models.HashtagCount{Tag: tag, Posts: posts}
+	})
+}
+
+// GetLanguageMix returns the number of posts per language in a feed, posts in several languages count for each
+func (db *DB) GetLanguageMix(ctx context.Context, r StatsRange) ([]models.LanguageCount, error) {
+	sb := statsQuery("feed_languages_hourly", r)
+	sb.Select("language", "SUM(posts) AS total")
+	sb.GroupBy("language").OrderBy("total DESC", "language")
+
+	return queryCounts(ctx, db, sb, func(language string, posts int64) models.LanguageCount {
+		return models.LanguageCount{Language: language, Posts: posts}
+	})
+}
+
+// GetReplyRatio returns the share of the posts in a feed that are replies
+func (db *DB) GetReplyRatio(ctx context.Context, r StatsRange) (models.ReplyRatio, error) {
+	sb := statsQuery("feed_stats_hourly", r)
+	sb.Select("COALESCE(SUM(posts), 0)", "COALESCE(SUM(replies), 0)")
+
+	var ratio models.ReplyRatio
+	sql, args := sb.Build()
+	if err := db.db.QueryRowContext(ctx, sql, args...).Scan(&ratio.Posts, &ratio.Replies); err != nil {
+		return ratio, fmt.Errorf("query error: %w", err)
+	}
+	if ratio.Posts > 0 {
+		ratio.Ratio = float64(ratio.Replies) / float64(ratio.Posts)
+	}
+	return ratio, nil
+}
+
+// queryCounts runs a query selecting a name and a count, and converts each row
+func queryCounts[T any](ctx context.Context, db *DB, sb *sqlbuilder.SelectBuilder, convert func(name string, count int64) T) ([]T, error) {
+	sql, args := sb.Build()
+	rows, err := db.db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make([]T, 0)
+	for rows.Next() {
+		var name string
+		var count int64
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		counts = append(counts, convert(name, count))
+	}
+	return counts, rows.Err()
+}
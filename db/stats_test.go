@@ -0,0 +1,100 @@
+package db_test
+
+import (
+	"norsky/db"
+	"norsky/query"
+	"testing"
+	"time"
+
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// languageFilter keeps the posts in one language
+type languageFilter string
+
+func (f languageFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder, params query.Params) {
+	sb.Where(sb.Equal("posts.language", string(f)))
+}
+
+func TestRollupStatements(t *testing.T) {
+	from := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(3 * time.Hour)
+	feed := db.StatsFeed{ID: "norwegian", Filters: []query.FilterStrategy{languageFilter("nb")}}
+
+	statements := db.RollupStatements(feed, from, to)
+	if !assert.Len(t, statements, 4) {
+		return
+	}
+
+	// Every statement rolls up the feed's posts in the range
+	for i, table := range []string{"feed_stats_hourly", "feed_languages_hourly", "feed_authors_hourly", "feed_hashtags_hourly"} {
+		sql, args := statements[i].BuildWithFlavor(sqlbuilder.PostgreSQL)
+		assert.Contains(t, sql, "WITH feed_posts AS (SELECT posts.id")
+		assert.Contains(t, sql, "posts.created_at >= $1 AND posts.created_at < $2 AND posts.language = $3")
+		assert.Contains(t, sql, "INSERT INTO "+table+" ")
+		assert.Contains(t, sql, "SELECT $4, ")
+		assert.Equal(t, []interface{}{from, to, "nb", "norwegian"}, args[:4])
+	}
+
+	// Every hour in the range gets a volume row
+	sql, args := statements[0].BuildWithFlavor(sqlbuilder.PostgreSQL)
+	assert.Contains(t, sql, "generate_series($5::timestamptz, $6::timestamptz - interval '1 hour', interval '1 hour')")
+	assert.Contains(t, sql, "LEFT JOIN feed_posts")
+	assert.Equal(t, []interface{}{from, to}, args[4:])
+}
+
+func TestStatsQuery(t *testing.T) {
+	from := time.Date(2025, 2, 1, 0, 30, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	sb := db.StatsQuery("feed_authors_hourly", db.StatsRange{Feed: "norwegian", From: from, To: to})
+	sb.Select("author_did")
+	sql, args := sb.Build()
+	assert.Contains(t, sql, "FROM feed_authors_hourly")
+	assert.Contains(t, sql, "feed = $1")
+	assert.Contains(t, sql, "hour >= date_trunc('hour', $2::timestamptz)")
+	assert.Contains(t, sql, "hour < $3")
+	assert.Equal(t, []interface{}{"norwegian", from, to}, args)
+
+	// Open ranges select every hour of all posts
+	sb = db.StatsQuery("feed_authors_hourly", db.StatsRange{})
+	sb.Select("author_did")
+	sql, args = sb.Build()
+	assert.NotContains(t, sql, "hour >=")
+	assert.NotContains(t, sql, "hour <")
+	assert.Equal(t, []interface{}{""}, args)
+}
+
+func TestBucketQuery(t *testing.T) {
+	sb, err := db.BucketQuery("feed_stats_hourly", db.StatsRange{Feed: "norwegian"}, db.BucketDay, "posts", "replies")
+	require.NoError(t, err)
+	sql, args := sb.Build()
+	assert.Contains(t, sql, "date_trunc('day', hour) AS bucket")
+	assert.Contains(t, sql, "SUM(posts), SUM(replies)")
+	assert.Contains(t, sql, "GROUP BY bucket ORDER BY bucket")
+	assert.Equal(t, []interface{}{"norwegian"}, args)
+
+	// The bucket is formatted into the SQL, only known buckets are accepted
+	_, err = db.BucketQuery("feed_stats_hourly", db.StatsRange{}, db.TimeBucket("month'); DROP TABLE posts; --"), "posts")
+	assert.ErrorContains(t, err, "invalid time bucket")
+}
+
+func TestPostCountsQuery(t *testing.T) {
+	sb, err := db.PostCountsQuery(db.PostCountQuery{Bucket: db.BucketHour})
+	require.NoError(t, err)
+	sql, args := sb.Build()
+	assert.Contains(t, sql, "FROM feed_stats_hourly")
+	assert.NotContains(t, sql, "language")
+	assert.Equal(t, []interface{}{""}, args)
+
+	// Counts in one language come from the language breakdown
+	sb, err = db.PostCountsQuery(db.PostCountQuery{StatsRange: db.StatsRange{Feed: "norwegian"}, Language: "nb", Bucket: db.BucketWeek})
+	require.NoError(t, err)
+	sql, args = sb.Build()
+	assert.Contains(t, sql, "date_trunc('week', hour) AS bucket")
+	assert.Contains(t, sql, "FROM feed_languages_hourly")
+	assert.Contains(t, sql, "language = $2")
+	assert.Equal(t, []interface{}{"norwegian", "nb"}, args)
+}
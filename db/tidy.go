@@ -1,37 +1,214 @@
 package db
 
 import (
-	"database/sql"
+	"context"
+	"fmt"
 	"time"
 
-	sb "github.com/huandu/go-sqlbuilder"
+	sqlbuilder "github.com/huandu/go-sqlbuilder"
+	"github.com/lib/pq"
+	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 )
 
-// Tidy removes posts that are older than 90 days from the database
-func Tidy(database string) error {
-	db, err := connection(database)
+// DefaultRetention is how long posts are kept unless a retention rule says otherwise
+const DefaultRetention = 90 * 24 * time.Hour
+
+// DefaultTidyBatchSize is the number of posts deleted per statement, small enough to avoid long locks
+const DefaultTidyBatchSize = 5000
+
+// RetentionRule keeps matching posts for a different duration than the default retention.
+// When several rules match a post the longest retention wins.
+type RetentionRule struct {
+	// Name identifies the rule in logs and results, e.g. "language:se" or "feed:tech"
+	Name      string
+	Retention time.Duration
+	// Match selects the ids of the posts the rule applies to, e.g. SELECT posts.id FROM posts WHERE ...
+	Match *sqlbuilder.SelectBuilder
+}
+
+// TidyOptions configures a tidy run
+type TidyOptions struct {
+	Retention time.Duration
+	Rules     []RetentionRule
+	BatchSize int
+	// DryRun counts the posts that would be deleted without deleting them
+	DryRun bool
+}
+
+// TidyResult reports the posts deleted, or that would be deleted, for one rule
+type TidyResult struct {
+	Rule      string
+	Retention time.Duration
+	Posts     int64
+}
+
+// Tidy removes posts that are older than their retention, in batches
+func (db *DB) Tidy(ctx context.Context, opts TidyOptions) ([]TidyResult, error) {
+	if opts.Retention <= 0 {
+		opts.Retention = DefaultRetention
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultTidyBatchSize
+	}
+
+	// Use a single reference time so rules agree on which posts they own
+	now := time.Now()
+
+	results := make([]TidyResult, 0, len(opts.Rules)+2)
+
+	// Partitions past the longest retention only hold posts every rule has expired, drop them whole
+	longest := opts.Retention
+	for _, rule := range opts.Rules {
+		longest = max(longest, rule.Retention)
+	}
+	partitions, err := db.GetPostPartitions(ctx)
 	if err != nil {
-		return err
+		return results, fmt.Errorf("tidy partitions: %w", err)
+	}
+	expired := expiredPartitions(partitions, now.Add(-longest))
+	if len(expired) > 0 {
+		posts, err := db.dropPostPartitions(ctx, expired, opts.DryRun)
+		if err != nil {
+			return results, fmt.Errorf("tidy partitions: %w", err)
+		}
+		log.WithFields(log.Fields{
+			"partitions": len(expired),
+			"posts":      posts,
+			"dryRun":     opts.DryRun,
+		}).Info("Tidied posts partitions")
+		results = append(results, TidyResult{Rule: "partitions", Retention: longest, Posts: posts})
+	}
+
+	// In a dry run the posts of expired partitions are still there, don't count them again below
+	var skip []string
+	if opts.DryRun {
+		skip = lo.Map(expired, func(p PostPartition, _ int) string { return p.Name })
+	}
+
+	for i := -1; i < len(opts.Rules); i++ {
+		name, retention := "default", opts.Retention
+		if i >= 0 {
+			name, retention = opts.Rules[i].Name, opts.Rules[i].Retention
+		}
+
+		var posts int64
+		var err error
+		if opts.DryRun {
+			posts, err = db.countExpired(ctx, opts, i, now, skip)
+		} else {
+			posts, err = db.deleteExpired(ctx, opts, i, now, skip)
+		}
+		if err != nil {
+			return results, fmt.Errorf("tidy %s: %w", name, err)
+		}
+
+		log.WithFields(log.Fields{
+			"rule":      name,
+			"retention": retention,
+			"posts":     posts,
+			"dryRun":    opts.DryRun,
+		}).Info("Tidied posts")
+
+		results = append(results, TidyResult{Rule: name, Retention: retention, Posts: posts})
 	}
 
-	return tidy(db)
+	return results, nil
 }
 
-func tidy(db *sql.DB) error {
-	ninetyDaysAgo := time.Now().Add(90 * 24 * -1 * time.Hour).Unix()
-	deletePosts := sb.NewDeleteBuilder()
-	sql, args := deletePosts.DeleteFrom("posts").Where(deletePosts.LessEqualThan("created_at", ninetyDaysAgo)).Build()
+// expiredPosts selects the posts that rule (-1 for the default) is responsible for and that have expired,
+// posts stored in the skipped partitions are left out
+func expiredPosts(opts TidyOptions, rule int, now time.Time, skip []string) *sqlbuilder.SelectBuilder {
+	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
+	sb.Select("posts.id").From("posts")
+	if len(skip) > 0 {
+		sb.Where(fmt.Sprintf("posts.tableoid::regclass::text <> ALL(%s)", sb.Args.Add(pq.Array(skip))))
+	}
 
-	log.WithFields(log.Fields{
-		"sql":  sql,
-		"args": args,
-	}).Info("Tidying database")
+	if rule < 0 {
+		// The default retention applies to posts no rule matches
+		sb.Where(sb.LessThan("posts.created_at", now.Add(-opts.Retention)))
+		for _, other := range opts.Rules {
+			sb.Where(sb.NotIn("posts.id", other.Match))
+		}
+		return sb
+	}
 
-	_, err := db.Exec(sql, args...)
-	if err != nil {
-		return err
+	current := opts.Rules[rule]
+	sb.Where(
+		sb.LessThan("posts.created_at", now.Add(-current.Retention)),
+		sb.In("posts.id", current.Match),
+	)
+
+	// Posts also matched by a rule with longer retention are kept until that rule expires them
+	for i, other := range opts.Rules {
+		if i == rule || other.Retention <= current.Retention {
+			continue
+		}
+		sb.Where(sb.Or(
+			sb.NotIn("posts.id", other.Match),
+			sb.LessThan("posts.created_at", now.Add(-other.Retention)),
+		))
+	}
+
+	return sb
+}
+
+func (db *DB) countExpired(ctx context.Context, opts TidyOptions, rule int, now time.Time, skip []string) (int64, error) {
+	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
+	sb.Select("COUNT(*)").From(sb.BuilderAs(expiredPosts(opts, rule, now, skip), "expired"))
+
+	sql, args := sb.Build()
+
+	var count int64
+	if err := db.db.QueryRowContext(ctx, sql, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("count error: %w", err)
+	}
+	return count, nil
+}
+
+func (db *DB) deleteExpired(ctx context.Context, opts TidyOptions, rule int, now time.Time, skip []string) (int64, error) {
+	var total int64
+	for {
+		batch := expiredPosts(opts, rule, now, skip)
+		batch.Limit(opts.BatchSize)
+
+		del := sqlbuilder.PostgreSQL.NewDeleteBuilder()
+		del.DeleteFrom("posts").Where(del.In("id", batch))
+		sql, args := del.Build()
+
+		batchCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		result, err := db.db.ExecContext(batchCtx, sql, args...)
+		cancel()
+		if err != nil {
+			return total, fmt.Errorf("delete error: %w", err)
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+
+		if deleted < int64(opts.BatchSize) {
+			return total, nil
+		}
+
+		// Stop between batches if we are asked to shut down
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
 	}
+}
+
+// TidySeenPosts removes expired seen post records and returns how many were removed
+func (db *DB) TidySeenPosts(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
 
-	return nil
+	result, err := db.db.ExecContext(ctx, "DELETE FROM seen_posts WHERE expires_at < NOW()")
+	if err != nil {
+		return 0, fmt.Errorf("delete error: %w", err)
+	}
+	return result.RowsAffected()
 }
@@ -0,0 +1,53 @@
+package db_test
+
+import (
+	"norsky/db"
+	"testing"
+	"time"
+
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func languageRule(language string, retention time.Duration) db.RetentionRule {
+	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
+	sb.Select("posts.id").From("posts").Where(sb.Equal("language", language))
+	return db.RetentionRule{Name: "language:" + language, Retention: retention, Match: sb}
+}
+
+var (
+	tidyNow  = time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	tidyOpts = db.TidyOptions{
+		Retention: 24 * time.Hour,
+		Rules:     []db.RetentionRule{languageRule("nb", 48*time.Hour), languageRule("se", 72*time.Hour)},
+	}
+)
+
+func TestExpiredPostsDefaultRuleLeavesOutRulePosts(t *testing.T) {
+	sql, args := db.ExpiredPosts(tidyOpts, -1, tidyNow, nil).Build()
+	assert.Contains(t, sql, "posts.created_at < $1")
+	assert.Contains(t, sql, "posts.id NOT IN (SELECT posts.id FROM posts WHERE language = $2)")
+	assert.Contains(t, sql, "posts.id NOT IN (SELECT posts.id FROM posts WHERE language = $3)")
+	assert.Equal(t, []interface{}{tidyNow.Add(-24 * time.Hour), "nb", "se"}, args)
+}
+
+func TestExpiredPostsKeepsPostsOfLongerRules(t *testing.T) {
+	sql, args := db.ExpiredPosts(tidyOpts, 0, tidyNow, nil).Build()
+	assert.Contains(t, sql, "posts.created_at < $1")
+	assert.Contains(t, sql, "posts.id IN (SELECT posts.id FROM posts WHERE language = $2)")
+	assert.Contains(t, sql, "(posts.id NOT IN (SELECT posts.id FROM posts WHERE language = $3) OR posts.created_at < $4)")
+	assert.Equal(t, []interface{}{tidyNow.Add(-48 * time.Hour), "nb", "se", tidyNow.Add(-72 * time.Hour)}, args)
+
+	// Rules with shorter retention don't hold posts back
+	sql, args = db.ExpiredPosts(tidyOpts, 1, tidyNow, nil).Build()
+	assert.NotContains(t, sql, "NOT IN")
+	assert.Equal(t, []interface{}{tidyNow.Add(-72 * time.Hour), "se"}, args)
+}
+
+func TestExpiredPostsSkipsPartitions(t *testing.T) {
+	sql, args := db.ExpiredPosts(tidyOpts, 1, tidyNow, []string{"posts_2025_01"}).Build()
+	assert.Contains(t, sql, "posts.tableoid::regclass::text <> ALL($1)")
+	assert.Contains(t, sql, "posts.created_at < $2")
+	assert.Equal(t, []interface{}{pq.Array([]string{"posts_2025_01"}), tidyNow.Add(-72 * time.Hour), "se"}, args)
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"norsky/models"
+	"time"
+
+	sqlbuilder "github.com/huandu/go-sqlbuilder"
+	"github.com/lib/pq"
+)
+
+// TrackViewer records that a viewer used a personalized feed.
+// Returns true if the viewer's follows and blocks need to be backfilled, either because
+// the viewer is new or because the last backfill is older than maxAge.
+func (db *DB) TrackViewer(ctx context.Context, did string, maxAge time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var backfilledAt *time.Time
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO viewers (did) VALUES ($1)
+		ON CONFLICT (did) DO UPDATE SET last_seen_at = NOW()
+		RETURNING graph_backfilled_at`, did).Scan(&backfilledAt)
+	if err != nil {
+		return false, fmt.Errorf("upsert viewer error: %w", err)
+	}
+
+	return backfilledAt == nil || time.Since(*backfilledAt) > maxAge, nil
+}
+
+// GetViewers returns the DIDs of all viewers that have used a personalized feed
+func (db *DB) GetViewers(ctx context.Context) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT did FROM viewers")
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var dids []string
+	for rows.Next() {
+		var did string
+		if err := rows.Scan(&did); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		dids = append(dids, did)
+	}
+	return dids, rows.Err()
+}
+
+// CreateFollow stores a follow record ingested from the firehose
+func (db *DB) CreateFollow(ctx context.Context, follow models.Follow) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `
+		INSERT INTO follows (follower_did, subject_did, uri, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (follower_did, subject_did) DO UPDATE SET uri = $3`,
+		follow.Follower,
+		follow.Subject,
+		follow.Uri,
+		time.Unix(follow.CreatedAt, 0),
+	)
+	if err != nil {
+		return fmt.Errorf("insert error: %w", err)
+	}
+	return nil
+}
+
+// DeleteFollow removes a follow record by its URI
+func (db *DB) DeleteFollow(ctx context.Context, uri string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM follows WHERE uri = $1", uri); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	return nil
+}
+
+// ReplaceGraph replaces the follows and blocks of a viewer with their backfilled records
+func (db *DB) ReplaceGraph(ctx context.Context, did string, follows []models.Follow, blocks []models.Block) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	follows = uniqueFollows(follows)
+	subjects := make([]string, len(follows))
+	for i, follow := range follows {
+		subjects[i] = follow.Subject
+	}
+
+	// Insert in chunks to stay well below the PostgreSQL parameter limit
+	for start := 0; start < len(follows); start += 1000 {
+		end := min(start+1000, len(follows))
+
+		sql, args := replaceFollowsInsert(did, follows[start:end])
+		if _, err := tx.ExecContext(ctx, sql, args...); err != nil {
+			return fmt.Errorf("insert follows error: %w", err)
+		}
+	}
+
+	// Remove unfollows we missed while not tracking this viewer
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM follows WHERE follower_did = $1 AND NOT (subject_did = ANY($2))",
+		did, pq.Array(subjects),
+	); err != nil {
+		return fmt.Errorf("delete follows error: %w", err)
+	}
+
+	uris := make([]string, len(blocks))
+	for i, block := range blocks {
+		uris[i] = block.Uri
+	}
+
+	for start := 0; start < len(blocks); start += 1000 {
+		end := min(start+1000, len(blocks))
+
+		sql, args := replaceBlocksInsert(did, blocks[start:end])
+		if _, err := tx.ExecContext(ctx, sql, args...); err != nil {
+			return fmt.Errorf("insert blocks error: %w", err)
+		}
+	}
+
+	// Remove unblocks we missed. Blocks of the viewer by others live in their repos and only come from the firehose.
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM blocks WHERE author_did = $1 AND NOT (uri = ANY($2))",
+		did, pq.Array(uris),
+	); err != nil {
+		return fmt.Errorf("delete blocks error: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE viewers SET graph_backfilled_at = NOW() WHERE did = $1", did); err != nil {
+		return fmt.Errorf("update viewer error: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// replaceFollowsInsert upserts follow records, storing the uri unfollows on the firehose refer to
+func replaceFollowsInsert(did string, follows []models.Follow) (string, []interface{}) {
+	ib := sqlbuilder.PostgreSQL.NewInsertBuilder()
+	ib.InsertInto("follows").Cols("follower_did", "subject_did", "uri", "created_at")
+	for _, follow := range follows {
+		ib.Values(did, follow.Subject, follow.Uri, time.Unix(follow.CreatedAt, 0))
+	}
+	ib.SQL("ON CONFLICT (follower_did, subject_did) DO UPDATE SET uri = EXCLUDED.uri")
+	return ib.Build()
+}
+
+// replaceBlocksInsert inserts block records of the viewer, keeping those already ingested from the firehose
+func replaceBlocksInsert(did string, blocks []models.Block) (string, []interface{}) {
+	ib := sqlbuilder.PostgreSQL.NewInsertBuilder()
+	ib.InsertInto("blocks").Cols("uri", "author_did", "subject_did", "created_at")
+	for _, block := range blocks {
+		ib.Values(block.Uri, did, block.Subject, time.Unix(block.CreatedAt, 0))
+	}
+	ib.SQL("ON CONFLICT (uri) DO NOTHING")
+	return ib.Build()
+}
+
+// uniqueFollows keeps the first record per subject, an upsert can't change the same row twice
+func uniqueFollows(follows []models.Follow) []models.Follow {
+	seen := make(map[string]struct{}, len(follows))
+	unique := make([]models.Follow, 0, len(follows))
+	for _, follow := range follows {
+		if _, ok := seen[follow.Subject]; ok {
+			continue
+		}
+		seen[follow.Subject] = struct{}{}
+		unique = append(unique, follow)
+	}
+	return unique
+}
+
+// CreateBlock stores a block record ingested from the firehose
+func (db *DB) CreateBlock(ctx context.Context, block models.Block) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `
+		INSERT INTO blocks (uri, author_did, subject_did, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (uri) DO NOTHING`,
+		block.Uri,
+		block.Author,
+		block.Subject,
+		time.Unix(block.CreatedAt, 0),
+	)
+	if err != nil {
+		return fmt.Errorf("insert error: %w", err)
+	}
+	return nil
+}
+
+// GetBlockAuthors returns the DIDs of all accounts with stored blocks, the only ones whose block deletes matter
+func (db *DB) GetBlockAuthors(ctx context.Context) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT DISTINCT author_did FROM blocks")
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var dids []string
+	for rows.Next() {
+		var did string
+		if err := rows.Scan(&did); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		dids = append(dids, did)
+	}
+	return dids, rows.Err()
+}
+
+// DeleteBlock removes a block record by its URI
+func (db *DB) DeleteBlock(ctx context.Context, uri string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM blocks WHERE uri = $1", uri); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	return nil
+}
+
+// RecordSeenPosts remembers which posts were served to a viewer in a feed until expiresAt
+func (db *DB) RecordSeenPosts(ctx context.Context, viewer string, feed string, postIds []int64, expiresAt time.Time) error {
+	if len(postIds) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ib := sqlbuilder.PostgreSQL.NewInsertBuilder()
+	ib.InsertInto("seen_posts").Cols("viewer_did", "feed", "post_id", "expires_at")
+	for _, id := range postIds {
+		ib.Values(viewer, feed, id, expiresAt)
+	}
+	ib.SQL("ON CONFLICT (viewer_did, feed, post_id) DO UPDATE SET expires_at = EXCLUDED.expires_at")
+
+	sql, args := ib.Build()
+	if _, err := db.db.ExecContext(ctx, sql, args...); err != nil {
+		return fmt.Errorf("insert error: %w", err)
+	}
+	return nil
+}
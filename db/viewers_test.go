@@ -0,0 +1,49 @@
+package db_test
+
+import (
+	"norsky/db"
+	"norsky/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceFollowsInsertStoresUris(t *testing.T) {
+	follows := []models.Follow{
+		{Uri: "at://did:plc:viewer/app.bsky.graph.follow/1", Subject: "did:plc:author1", CreatedAt: 1738411200},
+		{Uri: "at://did:plc:viewer/app.bsky.graph.follow/2", Subject: "did:plc:author2", CreatedAt: 1738411201},
+	}
+
+	sql, args := db.ReplaceFollowsInsert("did:plc:viewer", follows)
+	assert.Contains(t, sql, "INSERT INTO follows (follower_did, subject_did, uri, created_at) VALUES ($1, $2, $3, $4), ($5, $6, $7, $8)")
+	// Follows kept from before the backfill get their uri
+	assert.Contains(t, sql, "ON CONFLICT (follower_did, subject_did) DO UPDATE SET uri = EXCLUDED.uri")
+	assert.Equal(t, []interface{}{
+		"did:plc:viewer", "did:plc:author1", "at://did:plc:viewer/app.bsky.graph.follow/1", time.Unix(1738411200, 0),
+		"did:plc:viewer", "did:plc:author2", "at://did:plc:viewer/app.bsky.graph.follow/2", time.Unix(1738411201, 0),
+	}, args)
+}
+
+func TestUniqueFollowsKeepsFirstRecordPerSubject(t *testing.T) {
+	follows := []models.Follow{
+		{Uri: "at://did:plc:viewer/app.bsky.graph.follow/1", Subject: "did:plc:author1"},
+		{Uri: "at://did:plc:viewer/app.bsky.graph.follow/2", Subject: "did:plc:author2"},
+		{Uri: "at://did:plc:viewer/app.bsky.graph.follow/3", Subject: "did:plc:author1"},
+	}
+
+	assert.Equal(t, follows[:2], db.UniqueFollows(follows))
+}
+
+func TestReplaceBlocksInsertKeepsIngestedBlocks(t *testing.T) {
+	blocks := []models.Block{
+		{Uri: "at://did:plc:viewer/app.bsky.graph.block/1", Subject: "did:plc:author1", CreatedAt: 1738411200},
+	}
+
+	sql, args := db.ReplaceBlocksInsert("did:plc:viewer", blocks)
+	assert.Contains(t, sql, "INSERT INTO blocks (uri, author_did, subject_did, created_at) VALUES ($1, $2, $3, $4)")
+	assert.Contains(t, sql, "ON CONFLICT (uri) DO NOTHING")
+	assert.Equal(t, []interface{}{
+		"at://did:plc:viewer/app.bsky.graph.block/1", "did:plc:viewer", "did:plc:author1", time.Unix(1738411200, 0),
+	}, args)
+}
@@ -2,6 +2,7 @@ package feeds
 
 import (
 	"fmt"
+	"norsky/models"
 	"norsky/query"
 	"strings"
 
@@ -12,6 +13,13 @@ import (
 type FeedQueryBuilder struct {
 	scoringLayers []scoringLayer
 	filters       []query.FilterStrategy
+	seen          *seenPenalty
+}
+
+// seenPenalty multiplies the score of posts the viewer has already been served
+type seenPenalty struct {
+	feed   string
+	factor float64
 }
 
 type scoringLayer struct {
@@ -37,13 +45,29 @@ func (b *FeedQueryBuilder) AddFilter(filter query.FilterStrategy) {
 	b.filters = append(b.filters, filter)
 }
 
-func (b *FeedQueryBuilder) Build(limit int, cursor int64) (string, []interface{}) {
+// SetSeenPenalty down-ranks posts already served to the viewer in this feed on the first page
+func (b *FeedQueryBuilder) SetSeenPenalty(feed string, factor float64) {
+	b.seen = &seenPenalty{feed: feed, factor: factor}
+}
+
+// MatchPost evaluates the filters that are PostMatchers against a post, other filters are ignored
+func (b *FeedQueryBuilder) MatchPost(post models.Post) bool {
+	for _, filter := range b.filters {
+		if matcher, ok := filter.(query.PostMatcher); ok && !matcher.MatchPost(post) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *FeedQueryBuilder) Build(params query.Params) (string, []interface{}) {
 	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
 
 	// Add base columns
 	sb.Select("posts.id", "posts.uri")
 
 	// Calculate final score if we have scoring layers, otherwise use default score of 1.0
+	score := "1.0"
 	if len(b.scoringLayers) > 0 {
 		var scoreTerms []string
 
@@ -51,35 +75,42 @@ func (b *FeedQueryBuilder) Build(limit int, cursor int64) (string, []interface{}
 		for _, layer := range b.scoringLayers {
 			// Get the scoring expression from the strategy without an alias
 			var scoreExpr strings.Builder
-			layer.strategy.ApplyScoring(&scoreExpr)
+			layer.strategy.ApplyScoring(&scoreExpr, sb.Args, params)
 
 			// Add the weighted score term
 			scoreTerms = append(scoreTerms, fmt.Sprintf("(%f * (%s))", layer.weight, scoreExpr.String()))
 		}
 
 		// Multiply all scores together for final score
-		sb.SelectMore(fmt.Sprintf("(%s) AS score", strings.Join(scoreTerms, " + ")))
-	} else {
-		// Add default score of 1.0 when no scoring layers are configured
-		sb.SelectMore("1.0 AS score")
+		score = fmt.Sprintf("(%s)", strings.Join(scoreTerms, " + "))
 	}
 
+	// Only the first page is down-ranked, later pages continue below the cursor as usual
+	if b.seen != nil && params.Viewer != "" && params.Cursor == 0 {
+		score = fmt.Sprintf(
+			"(%s * CASE WHEN EXISTS (SELECT 1 FROM seen_posts WHERE seen_posts.viewer_did = %s AND seen_posts.feed = %s AND seen_posts.post_id = posts.id AND seen_posts.expires_at > NOW()) THEN %f ELSE 1.0 END)",
+			score, sb.Args.Add(params.Viewer), sb.Args.Add(b.seen.feed), b.seen.factor,
+		)
+	}
+
+	sb.SelectMore(fmt.Sprintf("%s AS score", score))
+
 	sb.From("posts")
 
 	// Apply all filters
 	for _, filter := range b.filters {
-		filter.ApplyFilter(sb)
+		filter.ApplyFilter(sb, params)
 	}
 
 	// Add cursor condition
-	if cursor != 0 {
-		sb.Where(sb.LessThan("posts.id", cursor))
+	if params.Cursor != 0 {
+		sb.Where(sb.LessThan("posts.id", params.Cursor))
 	}
 
 	// Always order by score (which will be 1.0 for unscored feeds) and then by ID
 	sb.OrderBy("score DESC", "posts.id DESC")
 
-	sb.Limit(limit)
+	sb.Limit(params.Limit)
 
 	return sb.Build()
 }
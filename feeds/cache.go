@@ -0,0 +1,169 @@
+package feeds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"norsky/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+var skeletonCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "norsky_feed_skeleton_cache_requests_total",
+	Help: "Anonymous feed skeleton requests by feed and cache result (hit, miss, shared)",
+}, []string{"feed", "result"})
+
+// DefaultSkeletonCacheTTL is how long anonymous feed pages are served from the cache
+const DefaultSkeletonCacheTTL = 15 * time.Second
+
+// Upper bound on cached pages, expired pages are swept when it is reached
+const maxSkeletonEntries = 1000
+
+// Skeleton is a rendered feed page with the ETag of its body
+type Skeleton struct {
+	Body []byte
+	ETag string
+
+	generation uint64
+	expires    time.Time
+}
+
+type skeletonKey struct {
+	feed   string
+	cursor string
+	limit  int
+}
+
+// SkeletonCache caches the pages anonymous viewers get from feeds for a short TTL. A cached page is
+// dropped early when a new post matching the feed is written, and concurrent requests for a page
+// that isn't cached share one query. It is a post sink, so it sees the posts written to the database.
+type SkeletonCache struct {
+	ttl   time.Duration
+	feeds FeedMap
+	group singleflight.Group
+
+	mu          sync.Mutex
+	entries     map[skeletonKey]*Skeleton
+	generations map[string]uint64
+}
+
+// NewSkeletonCache caches the pages of the feeds, a zero TTL disables caching but still shares queries
+func NewSkeletonCache(feeds FeedMap, ttl time.Duration) *SkeletonCache {
+	return &SkeletonCache{
+		ttl:         ttl,
+		feeds:       feeds,
+		entries:     make(map[skeletonKey]*Skeleton),
+		generations: make(map[string]uint64),
+	}
+}
+
+// TTL is how long pages are cached
+func (c *SkeletonCache) TTL() time.Duration {
+	return c.ttl
+}
+
+// Get returns a page of the feed as seen by an anonymous viewer
+func (c *SkeletonCache) Get(ctx context.Context, feed *Feed, cursor string, limit int) (*Skeleton, error) {
+	key := skeletonKey{feed: feed.ID, cursor: cursor, limit: limit}
+
+	c.mu.Lock()
+	generation := c.generations[feed.ID]
+	if entry, ok := c.entries[key]; ok && entry.generation == generation && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		skeletonCacheRequests.WithLabelValues(feed.ID, "hit").Inc()
+		return entry, nil
+	}
+	c.mu.Unlock()
+
+	// Requests after an invalidation must not share a query started before it
+	flight := fmt.Sprintf("%s\x00%s\x00%d\x00%d", feed.ID, cursor, limit, generation)
+	result, err, shared := c.group.Do(flight, func() (interface{}, error) {
+		// The query is shared, so it must not fail because the first request went away
+		response, err := feed.GetFeedPosts(context.WithoutCancel(ctx), "", cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(body)
+		skeleton := &Skeleton{
+			Body:       body,
+			ETag:       `"` + hex.EncodeToString(sum[:12]) + `"`,
+			generation: generation,
+			expires:    time.Now().Add(c.ttl),
+		}
+		c.store(key, skeleton)
+		return skeleton, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if shared {
+		skeletonCacheRequests.WithLabelValues(feed.ID, "shared").Inc()
+	} else {
+		skeletonCacheRequests.WithLabelValues(feed.ID, "miss").Inc()
+	}
+	return result.(*Skeleton), nil
+}
+
+func (c *SkeletonCache) store(key skeletonKey, skeleton *Skeleton) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxSkeletonEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) || entry.generation != c.generations[k.feed] {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxSkeletonEntries {
+			return
+		}
+	}
+	c.entries[key] = skeleton
+}
+
+// Send invalidates the cached pages of the feeds a created or updated post matches. Send posts once they are
+// in the database, e.g. as the Flushed sink of a sink.DBSink, or a page cached in between misses the post until
+// its TTL runs out. Deleted posts don't invalidate anything, the TTL bounds how long they are served.
+func (c *SkeletonCache) Send(ctx context.Context, event models.PostEvent) error {
+	if _, ok := event.(models.DeletePostEvent); ok {
+		return nil
+	}
+
+	post := event.EventPost()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, feed := range c.feeds {
+		if !feed.MatchPost(post) {
+			continue
+		}
+		c.generations[id]++
+		for key := range c.entries {
+			if key.feed == id {
+				delete(c.entries, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *SkeletonCache) Close() error {
+	return nil
+}
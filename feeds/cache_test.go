@@ -0,0 +1,161 @@
+package feeds_test
+
+import (
+	"context"
+	"norsky/config"
+	"norsky/feeds"
+	"norsky/models"
+	"norsky/query"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore serves the same page to every query and counts the queries. Queries wait for release
+// when it is set, started is signalled when a query begins.
+type countingStore struct {
+	queries atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *countingStore) GetFeedPosts(builder query.Builder, params query.Params) ([]models.FeedPost, error) {
+	s.queries.Add(1)
+	if s.started != nil {
+		s.started <- struct{}{}
+	}
+	if s.release != nil {
+		<-s.release
+	}
+	return []models.FeedPost{{Id: 1, Uri: "at://did:plc:author/app.bsky.feed.post/1"}}, nil
+}
+
+func (s *countingStore) RecordSeenPosts(ctx context.Context, viewer string, feed string, postIds []int64, expiresAt time.Time) error {
+	return nil
+}
+
+// newCache caches a feed of norwegian posts
+func newCache(t *testing.T, store feeds.Store, ttl time.Duration) (*feeds.SkeletonCache, *feeds.Feed) {
+	t.Helper()
+
+	cfg := &config.TomlConfig{Feeds: []config.TomlFeed{{
+		Id:      "norwegian",
+		Filters: []config.TomlFilter{{Type: "language", Languages: []string{"nb"}}},
+	}}}
+	feedMap, err := feeds.InitializeFeeds(cfg, store, nil)
+	require.NoError(t, err)
+
+	return feeds.NewSkeletonCache(feedMap, ttl), feedMap["norwegian"]
+}
+
+func TestSkeletonCacheHitWithinTTL(t *testing.T) {
+	store := &countingStore{}
+	cache, feed := newCache(t, store, 50*time.Millisecond)
+	ctx := context.Background()
+
+	first, err := cache.Get(ctx, feed, "", 10)
+	require.NoError(t, err)
+	second, err := cache.Get(ctx, feed, "", 10)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Equal(t, int32(1), store.queries.Load())
+
+	// Other pages are cached separately
+	_, err = cache.Get(ctx, feed, "", 20)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), store.queries.Load())
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = cache.Get(ctx, feed, "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), store.queries.Load())
+}
+
+func TestSkeletonCacheInvalidatesOnMatchingPost(t *testing.T) {
+	store := &countingStore{}
+	cache, feed := newCache(t, store, time.Minute)
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, feed, "", 10)
+	require.NoError(t, err)
+
+	require.NoError(t, cache.Send(ctx, models.CreatePostEvent{Post: models.Post{Uri: "at://did:plc:author/app.bsky.feed.post/2", Languages: []string{"nb"}}}))
+	_, err = cache.Get(ctx, feed, "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), store.queries.Load())
+}
+
+func TestSkeletonCacheKeepsPagesForOtherPosts(t *testing.T) {
+	store := &countingStore{}
+	cache, feed := newCache(t, store, time.Minute)
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, feed, "", 10)
+	require.NoError(t, err)
+
+	require.NoError(t, cache.Send(ctx, models.CreatePostEvent{Post: models.Post{Uri: "at://did:plc:author/app.bsky.feed.post/2", Languages: []string{"sv"}}}))
+	require.NoError(t, cache.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://did:plc:author/app.bsky.feed.post/1"}}))
+	_, err = cache.Get(ctx, feed, "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), store.queries.Load())
+}
+
+func TestSkeletonCacheSharesConcurrentMisses(t *testing.T) {
+	store := &countingStore{started: make(chan struct{}, 10), release: make(chan struct{})}
+	cache, feed := newCache(t, store, time.Minute)
+
+	var wg sync.WaitGroup
+	results := make([]*feeds.Skeleton, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			skeleton, err := cache.Get(context.Background(), feed, "", 10)
+			assert.NoError(t, err)
+			results[i] = skeleton
+		}()
+	}
+
+	// Let the others join the query before it finishes
+	<-store.started
+	time.Sleep(20 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), store.queries.Load())
+	for _, skeleton := range results {
+		assert.Same(t, results[0], skeleton)
+	}
+}
+
+func TestSkeletonCacheCancelledCallerDoesNotFailOthers(t *testing.T) {
+	store := &countingStore{started: make(chan struct{}, 10), release: make(chan struct{})}
+	cache, feed := newCache(t, store, time.Minute)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(cancelled, feed, "", 10)
+		first <- err
+	}()
+	<-store.started
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(context.Background(), feed, "", 10)
+		second <- err
+	}()
+
+	// The first caller goes away while the shared query runs
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(store.release)
+
+	assert.NoError(t, <-second)
+	assert.NoError(t, <-first)
+	assert.Equal(t, int32(1), store.queries.Load())
+}
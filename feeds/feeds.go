@@ -1,22 +1,34 @@
 package feeds
 
 import (
-	"norsky/db"
+	"context"
 	"norsky/models"
 	"norsky/query"
 	"strconv"
+	"time"
 
 	"norsky/config"
 
 	"fmt"
 	"strings"
 
+	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 )
 
+// Collections that must be ingested from the firehose for viewer dependent features
+const (
+	followCollection = "app.bsky.graph.follow"
+	blockCollection  = "app.bsky.graph.block"
+)
+
+// Score multiplier for posts a viewer has already been served
+const defaultSeenPenalty = 0.1
+
 // InitializeFeeds creates feeds from configuration
-func InitializeFeeds(cfg *config.TomlConfig, db *db.DB) (map[string]*Feed, error) {
+func InitializeFeeds(cfg *config.TomlConfig, db Store, viewers *ViewerTracker) (map[string]*Feed, error) {
 	feeds := make(map[string]*Feed)
+	seen := newSeenWriter(db, seenQueueSize)
 
 	for _, feedConfig := range cfg.Feeds {
 		builder := NewFeedQueryBuilder()
@@ -30,28 +42,128 @@ func InitializeFeeds(cfg *config.TomlConfig, db *db.DB) (map[string]*Feed, error
 			builder.AddFilter(filter)
 		}
 
+		// Bound the query by created_at so only recent posts partitions are scanned
+		if feedConfig.Window != "" {
+			window, err := config.ParseDuration(feedConfig.Window)
+			if err != nil || window <= 0 {
+				return nil, fmt.Errorf("invalid window for feed %s: %s", feedConfig.Id, feedConfig.Window)
+			}
+			builder.AddFilter(&AgeFilter{MaxAge: window})
+		}
+
 		// Add scoring layers
 		for _, scoringConfig := range feedConfig.Scoring {
-			strategy, err := createScoringStrategy(scoringConfig, cfg.Keywords)
+			strategy, err := createScoringStrategy(feedConfig.Id, scoringConfig, cfg.Keywords)
 			if err != nil {
 				return nil, fmt.Errorf("error creating scoring for feed %s: %w", feedConfig.Id, err)
 			}
 			builder.AddScoringLayer(strategy, scoringConfig.Weight)
 		}
 
+		// Optionally down-rank posts the viewer has already been served
+		var seenTTL time.Duration
+		if feedConfig.SeenTTL != "" {
+			var err error
+			seenTTL, err = config.ParseDuration(feedConfig.SeenTTL)
+			if err != nil || seenTTL <= 0 {
+				return nil, fmt.Errorf("invalid seen_ttl for feed %s: %s", feedConfig.Id, feedConfig.SeenTTL)
+			}
+			// Zero is a valid penalty that ranks seen posts last, only an unset penalty gets the default
+			penalty := defaultSeenPenalty
+			if feedConfig.SeenPenalty != nil {
+				penalty = *feedConfig.SeenPenalty
+			}
+			if penalty < 0 {
+				return nil, fmt.Errorf("invalid seen_penalty for feed %s: %g", feedConfig.Id, penalty)
+			}
+			builder.SetSeenPenalty(feedConfig.Id, penalty)
+		}
+
 		feeds[feedConfig.Id] = &Feed{
-			ID:          feedConfig.Id,
-			DisplayName: feedConfig.DisplayName,
-			Description: feedConfig.Description,
-			AvatarPath:  feedConfig.AvatarPath,
-			DB:          db,
-			builder:     builder,
+			ID:           feedConfig.Id,
+			DisplayName:  feedConfig.DisplayName,
+			Description:  feedConfig.Description,
+			AvatarPath:   feedConfig.AvatarPath,
+			Personalized: len(requiredCollections(feedConfig)) > 0,
+			SeenTTL:      seenTTL,
+			DB:           db,
+			Viewers:      viewers,
+			builder:      builder,
+			seen:         seen,
 		}
 	}
 
 	return feeds, nil
 }
 
+// WantedCollections returns the extra firehose collections the configured feeds depend on
+func WantedCollections(cfg *config.TomlConfig) []string {
+	collections := []string{}
+	for _, feedConfig := range cfg.Feeds {
+		for _, collection := range requiredCollections(feedConfig) {
+			if !lo.Contains(collections, collection) {
+				collections = append(collections, collection)
+			}
+		}
+	}
+	return collections
+}
+
+// TargetLanguages returns the languages the configured feeds filter on, or an empty slice
+// when a feed accepts every language and all languages must be detected
+func TargetLanguages(cfg *config.TomlConfig) []string {
+	languages := []string{}
+	for _, feedConfig := range cfg.Feeds {
+		hasLanguageFilter := false
+		for _, filter := range feedConfig.Filters {
+			if filter.Type == "language" && len(filter.Languages) > 0 {
+				hasLanguageFilter = true
+				for _, lang := range filter.Languages {
+					if !lo.Contains(languages, lang) {
+						languages = append(languages, lang)
+					}
+				}
+			}
+		}
+		if !hasLanguageFilter {
+			return []string{}
+		}
+	}
+	return languages
+}
+
+// requiredCollections returns the graph collections a feed needs to personalize its output
+func requiredCollections(feedConfig config.TomlFeed) []string {
+	collections := []string{}
+	usesFollows := lo.SomeBy(feedConfig.Filters, func(f config.TomlFilter) bool { return f.Type == "following" }) ||
+		lo.SomeBy(feedConfig.Scoring, func(s config.TomlScoring) bool { return s.Type == "following" })
+	if usesFollows {
+		collections = append(collections, followCollection)
+	}
+	if lo.SomeBy(feedConfig.Filters, func(f config.TomlFilter) bool { return f.Type == "exclude_blocks" }) {
+		collections = append(collections, blockCollection)
+	}
+	return collections
+}
+
+// contentFilters creates the filters of a feed that depend only on the post. Age filters are relative to
+// NOW() and viewer filters to who is reading, neither holds for posts matched in bulk by retention or statistics.
+func contentFilters(feedConfig config.TomlFeed, keywords config.TomlKeywords) ([]query.FilterStrategy, error) {
+	filters := make([]query.FilterStrategy, 0, len(feedConfig.Filters))
+	for _, filterConfig := range feedConfig.Filters {
+		switch filterConfig.Type {
+		case "age", "following", "exclude_blocks":
+			continue
+		}
+		filter, err := createFilterStrategy(filterConfig, keywords)
+		if err != nil {
+			return nil, fmt.Errorf("error creating filter for feed %s: %w", feedConfig.Id, err)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
 // createFilterStrategy creates a Filter from config
 func createFilterStrategy(config config.TomlFilter, keywords config.TomlKeywords) (query.FilterStrategy, error) {
 	switch config.Type {
@@ -76,38 +188,126 @@ func createFilterStrategy(config config.TomlFilter, keywords config.TomlKeywords
 		}, nil
 	case "exclude_replies":
 		return &ExcludeRepliesFilter{}, nil
+	case "following":
+		return &FollowingFilter{}, nil
+	case "exclude_blocks":
+		return &ExcludeBlocksFilter{}, nil
+	case "age":
+		return createAgeFilter(config)
 	default:
 		return nil, fmt.Errorf("unknown filter type: %s", config.Type)
 	}
 }
 
+// createAgeFilter parses the age bounds of an age filter, at least one bound is required
+func createAgeFilter(filterConfig config.TomlFilter) (*AgeFilter, error) {
+	filter := &AgeFilter{}
+	bounds := []struct {
+		value  string
+		target *time.Duration
+	}{
+		{filterConfig.Max, &filter.MaxAge},
+		{filterConfig.Min, &filter.MinAge},
+	}
+	for _, bound := range bounds {
+		if bound.value == "" {
+			continue
+		}
+		age, err := config.ParseDuration(bound.value)
+		if err != nil || age <= 0 {
+			return nil, fmt.Errorf("invalid age: %s", bound.value)
+		}
+		*bound.target = age
+	}
+
+	if filter.MaxAge == 0 && filter.MinAge == 0 {
+		return nil, fmt.Errorf("age filter needs max or min")
+	}
+	if filter.MaxAge > 0 && filter.MinAge >= filter.MaxAge {
+		return nil, fmt.Errorf("age filter min %s must be less than max %s", filterConfig.Min, filterConfig.Max)
+	}
+	return filter, nil
+}
+
 // createScoringStrategy creates a ScoringStrategy from config
-func createScoringStrategy(config config.TomlScoring, keywords config.TomlKeywords) (query.ScoringStrategy, error) {
-	switch config.Type {
+func createScoringStrategy(feedId string, scoringConfig config.TomlScoring, keywords config.TomlKeywords) (query.ScoringStrategy, error) {
+	switch scoringConfig.Type {
 	case "time_decay":
 		return &TimeDecayScoring{}, nil
 	case "keyword":
-		if kw, ok := keywords[config.Keywords]; ok {
+		if kw, ok := keywords[scoringConfig.Keywords]; ok {
 			return &KeywordScoring{Keywords: strings.Join(kw, " OR ")}, nil
 		}
-		return nil, fmt.Errorf("keyword list not found: %s", config.Keywords)
+		return nil, fmt.Errorf("keyword list not found: %s", scoringConfig.Keywords)
 	case "author":
-		return &AuthorScoring{Authors: config.Authors}, nil
+		return &AuthorScoring{Authors: scoringConfig.Authors}, nil
+	case "interactions":
+		scoring := &InteractionScoring{Feed: feedId}
+		if scoringConfig.Window != "" {
+			window, err := config.ParseDuration(scoringConfig.Window)
+			if err != nil || window <= 0 {
+				return nil, fmt.Errorf("invalid interactions window: %s", scoringConfig.Window)
+			}
+			scoring.Window = window
+		}
+		return scoring, nil
+	case "following":
+		return &FollowingScoring{}, nil
 	default:
-		return nil, fmt.Errorf("unknown scoring type: %s", config.Type)
+		return nil, fmt.Errorf("unknown scoring type: %s", scoringConfig.Type)
 	}
 }
 
-// GetFeedPosts retrieves posts for a feed with pagination
-func (f *Feed) GetFeedPosts(cursor string, limit int) (*models.FeedResponse, error) {
-	postId := safeParseCursor(cursor)
-	posts, err := f.DB.GetFeedPosts(f.builder, limit+1, postId)
+// GetFeedPosts retrieves posts for a feed with pagination, viewer is empty for anonymous requests
+func (f *Feed) GetFeedPosts(ctx context.Context, viewer string, cursor string, limit int) (*models.FeedResponse, error) {
+	if f.Personalized && viewer != "" && f.Viewers != nil {
+		f.Viewers.Track(ctx, viewer)
+	}
+
+	posts, err := f.DB.GetFeedPosts(f.builder, query.Params{
+		Limit:  limit + 1,
+		Cursor: safeParseCursor(cursor),
+		Viewer: viewer,
+	})
 	if err != nil {
 		log.Error("Error getting feed posts", err)
 		return nil, err
 	}
 
-	return createPaginatedResponse(posts, limit)
+	// Echo the feed id back so interactions sent by clients can be attributed to this feed
+	for i := range posts {
+		posts[i].FeedContext = f.ID
+	}
+
+	response, err := createPaginatedResponse(posts, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.SeenTTL > 0 && viewer != "" {
+		f.recordSeen(viewer, response.Feed)
+	}
+
+	return response, nil
+}
+
+// MatchPost reports whether a new post passes the filters of the feed that don't depend on the viewer
+func (f *Feed) MatchPost(post models.Post) bool {
+	return f.builder.MatchPost(post)
+}
+
+// recordSeen stores the served posts in the background to keep them out of the request latency
+func (f *Feed) recordSeen(viewer string, posts []models.FeedPost) {
+	ids := make([]int64, len(posts))
+	for i, post := range posts {
+		ids[i] = post.Id
+	}
+	f.seen.enqueue(seenRecord{
+		viewer:    viewer,
+		feed:      f.ID,
+		postIds:   ids,
+		expiresAt: time.Now().Add(f.SeenTTL),
+	})
 }
 
 // Helper functions for pagination
@@ -2,7 +2,12 @@ package feeds
 
 import (
 	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
 
+	"norsky/models"
 	"norsky/query"
 
 	"github.com/huandu/go-sqlbuilder"
@@ -14,26 +19,42 @@ type LanguageFilter struct {
 	Languages []string
 }
 
-func (f *LanguageFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder) {
+func (f *LanguageFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder, params query.Params) {
 	if len(f.Languages) > 0 {
 		sb.Where(fmt.Sprintf("languages && %s", sb.Args.Add(pq.Array(f.Languages))))
 	}
 }
 
+func (f *LanguageFilter) MatchPost(post models.Post) bool {
+	if len(f.Languages) == 0 {
+		return true
+	}
+	for _, lang := range post.Languages {
+		if slices.Contains(f.Languages, lang) {
+			return true
+		}
+	}
+	return false
+}
+
 // ExcludeRepliesFilter filters out reply posts
 type ExcludeRepliesFilter struct{}
 
-func (f *ExcludeRepliesFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder) {
+func (f *ExcludeRepliesFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder, params query.Params) {
 	sb.Where(sb.IsNull("posts.parent_uri"))
 }
 
+func (f *ExcludeRepliesFilter) MatchPost(post models.Post) bool {
+	return post.ParentUri == nil
+}
+
 // KeywordFilter filters posts based on included and excluded keywords
 type KeywordFilter struct {
 	IncludeKeywords string
 	ExcludeKeywords string
 }
 
-func (f *KeywordFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder) {
+func (f *KeywordFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder, params query.Params) {
 	// Add include keywords condition if specified
 	if f.IncludeKeywords != "" {
 		sb.Where(fmt.Sprintf(
@@ -51,6 +72,123 @@ func (f *KeywordFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder) {
 	}
 }
 
+// MatchPost approximates the full text search of ApplyFilter: a keyword matches when all of its
+// words are words of the post, ignoring case
+func (f *KeywordFilter) MatchPost(post models.Post) bool {
+	words := postWords(post.Text)
+	if f.IncludeKeywords != "" && !matchesAnyKeyword(words, f.IncludeKeywords) {
+		return false
+	}
+	if f.ExcludeKeywords != "" && matchesAnyKeyword(words, f.ExcludeKeywords) {
+		return false
+	}
+	return true
+}
+
+// postWords splits text into lowercase words like the 'simple' text search configuration
+func postWords(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		words[word] = true
+	}
+	return words
+}
+
+// matchesAnyKeyword checks the keywords joined with " OR " against the words of a post
+func matchesAnyKeyword(words map[string]bool, keywords string) bool {
+	for _, keyword := range strings.Split(keywords, " OR ") {
+		keywordWords := postWords(keyword)
+		if len(keywordWords) == 0 {
+			continue
+		}
+		matched := true
+		for word := range keywordWords {
+			if !words[word] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// FollowingFilter keeps only posts by authors the viewer follows
+type FollowingFilter struct{}
+
+func (f *FollowingFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder, params query.Params) {
+	// Anonymous viewers don't follow anyone
+	if params.Viewer == "" {
+		sb.Where("FALSE")
+		return
+	}
+	sb.Where(fmt.Sprintf(
+		"posts.author_did IN (SELECT subject_did FROM follows WHERE follower_did = %s)",
+		sb.Args.Add(params.Viewer),
+	))
+}
+
+// ExcludeBlocksFilter removes posts by authors the viewer blocked or who blocked the viewer
+type ExcludeBlocksFilter struct{}
+
+func (f *ExcludeBlocksFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder, params query.Params) {
+	if params.Viewer == "" {
+		return
+	}
+	viewer := sb.Args.Add(params.Viewer)
+	sb.Where(fmt.Sprintf(
+		`NOT EXISTS (SELECT 1 FROM blocks WHERE
+			(blocks.author_did = %s AND blocks.subject_did = posts.author_did) OR
+			(blocks.author_did = posts.author_did AND blocks.subject_did = %s))`,
+		viewer, viewer,
+	))
+}
+
+// AgeFilter keeps only posts created between MinAge and MaxAge ago, zero disables a bound.
+// Bounding created_at lets Postgres use posts_created_at_idx and skip partitions outside the window.
+type AgeFilter struct {
+	MaxAge time.Duration
+	MinAge time.Duration
+}
+
+func (f *AgeFilter) ApplyFilter(sb *sqlbuilder.SelectBuilder, params query.Params) {
+	if f.MaxAge > 0 {
+		sb.Where(fmt.Sprintf("posts.created_at >= NOW() - %s::interval", sb.Args.Add(postgresInterval(f.MaxAge))))
+	}
+	if f.MinAge > 0 {
+		sb.Where(fmt.Sprintf("posts.created_at <= NOW() - %s::interval", sb.Args.Add(postgresInterval(f.MinAge))))
+	}
+}
+
+func (f *AgeFilter) MatchPost(post models.Post) bool {
+	age := time.Since(time.Unix(post.CreatedAt, 0))
+	if f.MaxAge > 0 && age > f.MaxAge {
+		return false
+	}
+	if f.MinAge > 0 && age < f.MinAge {
+		return false
+	}
+	return true
+}
+
+// postgresInterval formats a duration as a PostgreSQL interval literal
+func postgresInterval(d time.Duration) string {
+	return fmt.Sprintf("%d seconds", int64(d.Seconds()))
+}
+
 var _ query.FilterStrategy = (*LanguageFilter)(nil)
 var _ query.FilterStrategy = (*ExcludeRepliesFilter)(nil)
 var _ query.FilterStrategy = (*KeywordFilter)(nil)
+var _ query.FilterStrategy = (*FollowingFilter)(nil)
+var _ query.FilterStrategy = (*ExcludeBlocksFilter)(nil)
+var _ query.FilterStrategy = (*AgeFilter)(nil)
+
+// Viewer dependent filters can't be matched without a viewer and are not PostMatchers
+var _ query.PostMatcher = (*LanguageFilter)(nil)
+var _ query.PostMatcher = (*ExcludeRepliesFilter)(nil)
+var _ query.PostMatcher = (*KeywordFilter)(nil)
+var _ query.PostMatcher = (*AgeFilter)(nil)
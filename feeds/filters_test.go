@@ -0,0 +1,100 @@
+package feeds_test
+
+import (
+	"norsky/feeds"
+	"norsky/query"
+	"testing"
+	"time"
+
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/stretchr/testify/assert"
+)
+
+const viewer = "did:plc:viewer"
+
+// filterSQL applies a filter to a bare posts query and builds it
+func filterSQL(filter query.FilterStrategy, params query.Params) (string, []interface{}) {
+	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
+	sb.Select("posts.id").From("posts")
+	filter.ApplyFilter(sb, params)
+	return sb.Build()
+}
+
+func TestExcludeBlocksFilter(t *testing.T) {
+	sql, args := filterSQL(&feeds.ExcludeBlocksFilter{}, query.Params{Viewer: viewer})
+	assert.Contains(t, sql, "NOT EXISTS (SELECT 1 FROM blocks WHERE")
+	// Blocks hide posts both ways
+	assert.Contains(t, sql, "blocks.author_did = $1 AND blocks.subject_did = posts.author_did")
+	assert.Contains(t, sql, "blocks.author_did = posts.author_did AND blocks.subject_did = $2")
+	assert.Equal(t, []interface{}{viewer, viewer}, args)
+
+	// Anonymous viewers have no blocks
+	sql, args = filterSQL(&feeds.ExcludeBlocksFilter{}, query.Params{})
+	assert.NotContains(t, sql, "blocks")
+	assert.Empty(t, args)
+}
+
+func TestViewerFiltersNumberArgsInOrder(t *testing.T) {
+	builder := feeds.NewFeedQueryBuilder()
+	builder.AddFilter(&feeds.LanguageFilter{Languages: []string{"nb"}})
+	builder.AddFilter(&feeds.FollowingFilter{})
+	builder.AddFilter(&feeds.ExcludeBlocksFilter{})
+
+	sql, args := builder.Build(query.Params{Limit: 10, Cursor: 100, Viewer: viewer})
+	assert.Contains(t, sql, "languages && $1")
+	assert.Contains(t, sql, "follower_did = $2")
+	assert.Contains(t, sql, "blocks.author_did = $3")
+	assert.Contains(t, sql, "blocks.subject_did = $4")
+	assert.Contains(t, sql, "posts.id < $5")
+	assert.Equal(t, []interface{}{viewer, viewer, viewer, int64(100)}, args[1:])
+}
+
+func TestAgeFilter(t *testing.T) {
+	sql, args := filterSQL(&feeds.AgeFilter{MaxAge: 24 * time.Hour, MinAge: time.Hour}, query.Params{})
+	assert.Contains(t, sql, "posts.created_at >= NOW() - $1::interval")
+	assert.Contains(t, sql, "posts.created_at <= NOW() - $2::interval")
+	assert.Equal(t, []interface{}{"86400 seconds", "3600 seconds"}, args)
+
+	// Unset bounds leave the query open on that side
+	sql, args = filterSQL(&feeds.AgeFilter{MaxAge: 30 * time.Minute}, query.Params{})
+	assert.Contains(t, sql, "posts.created_at >= NOW() - $1::interval")
+	assert.NotContains(t, sql, "posts.created_at <=")
+	assert.Equal(t, []interface{}{"1800 seconds"}, args)
+}
+
+func TestFollowingFilter(t *testing.T) {
+	sql, args := filterSQL(&feeds.FollowingFilter{}, query.Params{Viewer: viewer})
+	assert.Contains(t, sql, "posts.author_did IN (SELECT subject_did FROM follows WHERE follower_did = $1)")
+	assert.Equal(t, []interface{}{viewer}, args)
+
+	// Anonymous viewers don't follow anyone
+	sql, args = filterSQL(&feeds.FollowingFilter{}, query.Params{})
+	assert.Contains(t, sql, "WHERE FALSE")
+	assert.Empty(t, args)
+}
+
+func TestFollowingScoring(t *testing.T) {
+	builder := feeds.NewFeedQueryBuilder()
+	builder.AddScoringLayer(&feeds.FollowingScoring{}, 2.0)
+
+	sql, args := builder.Build(query.Params{Limit: 10, Viewer: viewer})
+	assert.Contains(t, sql, "2.000000 * (CASE WHEN posts.author_did IN (SELECT subject_did FROM follows WHERE follower_did = $1)")
+	assert.Equal(t, []interface{}{viewer}, args)
+
+	// Anonymous viewers get no boost
+	sql, args = builder.Build(query.Params{Limit: 10})
+	assert.Contains(t, sql, "2.000000 * (0.0)")
+	assert.Empty(t, args)
+}
+
+func TestScoringArgsComeBeforeFilterArgs(t *testing.T) {
+	builder := feeds.NewFeedQueryBuilder()
+	builder.AddScoringLayer(&feeds.FollowingScoring{}, 2.0)
+	builder.AddFilter(&feeds.FollowingFilter{})
+
+	sql, args := builder.Build(query.Params{Limit: 10, Cursor: 100, Viewer: viewer})
+	assert.Contains(t, sql, "follower_did = $1) THEN 1.0")
+	assert.Contains(t, sql, "WHERE posts.author_did IN (SELECT subject_did FROM follows WHERE follower_did = $2)")
+	assert.Contains(t, sql, "posts.id < $3")
+	assert.Equal(t, []interface{}{viewer, viewer, int64(100)}, args)
+}
@@ -0,0 +1,69 @@
+package feeds
+
+import (
+	"fmt"
+	"norsky/config"
+	"norsky/db"
+	"norsky/query"
+	"sort"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// RetentionRules builds the per-language and per-feed retention overrides used by tidy
+func RetentionRules(cfg *config.TomlConfig) ([]db.RetentionRule, error) {
+	rules := []db.RetentionRule{}
+
+	// Sort languages so rules are applied and reported in a stable order
+	languages := make([]string, 0, len(cfg.Retention.Languages))
+	for lang := range cfg.Retention.Languages {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+
+	for _, lang := range languages {
+		retention, err := config.ParseDuration(cfg.Retention.Languages[lang])
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("invalid retention for language %s: %s", lang, cfg.Retention.Languages[lang])
+		}
+		rules = append(rules, db.RetentionRule{
+			Name:      "language:" + lang,
+			Retention: retention,
+			Match:     matchPosts(&LanguageFilter{Languages: []string{lang}}),
+		})
+	}
+
+	for _, feedConfig := range cfg.Feeds {
+		if feedConfig.Retention == "" {
+			continue
+		}
+		retention, err := config.ParseDuration(feedConfig.Retention)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("invalid retention for feed %s: %s", feedConfig.Id, feedConfig.Retention)
+		}
+
+		// A feed keeps every post it draws from, also those older than its age filter
+		filters, err := contentFilters(feedConfig, cfg.Keywords)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, db.RetentionRule{
+			Name:      "feed:" + feedConfig.Id,
+			Retention: retention,
+			Match:     matchPosts(filters...),
+		})
+	}
+
+	return rules, nil
+}
+
+// matchPosts selects the ids of posts matching all filters
+func matchPosts(filters ...query.FilterStrategy) *sqlbuilder.SelectBuilder {
+	sb := sqlbuilder.PostgreSQL.NewSelectBuilder()
+	sb.Select("posts.id").From("posts")
+	for _, filter := range filters {
+		filter.ApplyFilter(sb, query.Params{})
+	}
+	return sb
+}
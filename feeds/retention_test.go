@@ -0,0 +1,53 @@
+package feeds_test
+
+import (
+	"norsky/config"
+	"norsky/feeds"
+	"testing"
+	"time"
+
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionRulesLeaveOutAgeAndViewerFilters(t *testing.T) {
+	cfg := &config.TomlConfig{
+		Retention: config.TomlRetention{Languages: map[string]string{"nb": "365d"}},
+		Feeds: []config.TomlFeed{{
+			Id:        "swedish",
+			Retention: "180d",
+			Filters: []config.TomlFilter{
+				{Type: "language", Languages: []string{"se"}},
+				{Type: "age", Max: "1d"},
+				{Type: "following"},
+				{Type: "exclude_blocks"},
+			},
+		}},
+	}
+
+	rules, err := feeds.RetentionRules(cfg)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+
+	assert.Equal(t, "language:nb", rules[0].Name)
+	assert.Equal(t, 365*24*time.Hour, rules[0].Retention)
+	sql, args := rules[0].Match.BuildWithFlavor(sqlbuilder.PostgreSQL)
+	assert.Equal(t, "SELECT posts.id FROM posts WHERE languages && $1", sql)
+	assert.Equal(t, []interface{}{pq.Array([]string{"nb"})}, args)
+
+	// The feed keeps the posts it draws from for 180 days, not only those of the last day
+	assert.Equal(t, "feed:swedish", rules[1].Name)
+	assert.Equal(t, 180*24*time.Hour, rules[1].Retention)
+	sql, args = rules[1].Match.BuildWithFlavor(sqlbuilder.PostgreSQL)
+	assert.Equal(t, "SELECT posts.id FROM posts WHERE languages && $1", sql)
+	assert.Equal(t, []interface{}{pq.Array([]string{"se"})}, args)
+}
+
+func TestRetentionRulesInvalidRetention(t *testing.T) {
+	cfg := &config.TomlConfig{Feeds: []config.TomlFeed{{Id: "swedish", Retention: "forever"}}}
+
+	_, err := feeds.RetentionRules(cfg)
+	assert.ErrorContains(t, err, "invalid retention for feed swedish")
+}
@@ -3,16 +3,48 @@ package feeds
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"norsky/config"
 	"norsky/query"
+
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/lib/pq"
+)
+
+const (
+	// InteractionRequestLess is sent by clients when a user asks to see less of a post
+	InteractionRequestLess = "app.bsky.feed.defs#requestLess"
+	// InteractionRequestMore is sent by clients when a user asks to see more of a post
+	InteractionRequestMore = "app.bsky.feed.defs#requestMore"
 )
 
+// interactionEvents are the interaction events defined by app.bsky.feed.defs
+var interactionEvents = map[string]bool{
+	InteractionRequestLess:                    true,
+	InteractionRequestMore:                    true,
+	"app.bsky.feed.defs#clickthroughItem":     true,
+	"app.bsky.feed.defs#clickthroughAuthor":   true,
+	"app.bsky.feed.defs#clickthroughReposter": true,
+	"app.bsky.feed.defs#clickthroughEmbed":    true,
+	"app.bsky.feed.defs#interactionSeen":      true,
+	"app.bsky.feed.defs#interactionLike":      true,
+	"app.bsky.feed.defs#interactionRepost":    true,
+	"app.bsky.feed.defs#interactionReply":     true,
+	"app.bsky.feed.defs#interactionQuote":     true,
+	"app.bsky.feed.defs#interactionShare":     true,
+}
+
+// IsInteractionEvent reports whether clients may send the event with sendInteractions
+func IsInteractionEvent(event string) bool {
+	return interactionEvents[event]
+}
+
 // NoScoring simply orders by ID
 type NoScoring struct{}
 
 // ApplyScoring adds no scoring to the query, accepts, but ignores weight
-func (s *NoScoring) ApplyScoring(sb *strings.Builder) {
+func (s *NoScoring) ApplyScoring(sb *strings.Builder, args *sqlbuilder.Args, params query.Params) {
 	// We already have the post id and uri in the base query
 }
 
@@ -23,7 +55,7 @@ func (s *NoScoring) GetSort() []string {
 // TimeDecayScoring scores posts based on how recent they are
 type TimeDecayScoring struct{}
 
-func (s *TimeDecayScoring) ApplyScoring(sb *strings.Builder) {
+func (s *TimeDecayScoring) ApplyScoring(sb *strings.Builder, args *sqlbuilder.Args, params query.Params) {
 	sb.WriteString("(1.0 + (EXTRACT(EPOCH FROM (NOW() - created_at)) / 86400.0))^(-0.5)")
 }
 
@@ -36,7 +68,7 @@ type KeywordScoring struct {
 	Keywords string
 }
 
-func (s *KeywordScoring) ApplyScoring(sb *strings.Builder) {
+func (s *KeywordScoring) ApplyScoring(sb *strings.Builder, args *sqlbuilder.Args, params query.Params) {
 	sb.WriteString(fmt.Sprintf(
 		`ts_rank(ts_vector, websearch_to_tsquery('simple', '%s'))/(1 + ts_rank(ts_vector, websearch_to_tsquery('simple', '%s')))`,
 		s.Keywords, s.Keywords,
@@ -52,7 +84,7 @@ type AuthorScoring struct {
 	Authors []config.TomlAuthor
 }
 
-func (s *AuthorScoring) ApplyScoring(sb *strings.Builder) {
+func (s *AuthorScoring) ApplyScoring(sb *strings.Builder, args *sqlbuilder.Args, params query.Params) {
 	// Create CASE statement for author scoring where default score is 1.0
 	authorScores := make([]string, len(s.Authors))
 	for i, author := range s.Authors {
@@ -71,7 +103,54 @@ func (s *AuthorScoring) GetSort() []string {
 	return []string{"score DESC", "posts.id DESC"}
 }
 
+// DefaultInteractionWindow is how long "show less" requests count against a post
+const DefaultInteractionWindow = 7 * 24 * time.Hour
+
+// InteractionScoring demotes posts that users of the feed recently asked to see less of
+type InteractionScoring struct {
+	Feed string
+	// Window limits the requests counted to recent ones, DefaultInteractionWindow when zero
+	Window time.Duration
+}
+
+func (s *InteractionScoring) ApplyScoring(sb *strings.Builder, args *sqlbuilder.Args, params query.Params) {
+	window := s.Window
+	if window <= 0 {
+		window = DefaultInteractionWindow
+	}
+
+	// Score is 1.0 without feedback and drops to 1/(1+n) after n viewers requested "show less"
+	sb.WriteString(fmt.Sprintf(
+		`1.0 / (1.0 + (SELECT COUNT(DISTINCT interactions.user_did) FROM interactions WHERE interactions.post_uri = posts.uri AND interactions.feed = %s AND interactions.event = %s AND interactions.created_at >= NOW() - %s::interval))`,
+		pq.QuoteLiteral(s.Feed), pq.QuoteLiteral(InteractionRequestLess), pq.QuoteLiteral(postgresInterval(window)),
+	))
+}
+
+func (s *InteractionScoring) GetSort() []string {
+	return []string{"score DESC", "posts.id DESC"}
+}
+
+// FollowingScoring boosts posts by authors the viewer follows
+type FollowingScoring struct{}
+
+func (s *FollowingScoring) ApplyScoring(sb *strings.Builder, args *sqlbuilder.Args, params query.Params) {
+	if params.Viewer == "" {
+		sb.WriteString("0.0")
+		return
+	}
+	sb.WriteString(fmt.Sprintf(
+		"CASE WHEN posts.author_did IN (SELECT subject_did FROM follows WHERE follower_did = %s) THEN 1.0 ELSE 0.0 END",
+		args.Add(params.Viewer),
+	))
+}
+
+func (s *FollowingScoring) GetSort() []string {
+	return []string{"score DESC", "posts.id DESC"}
+}
+
 var _ query.ScoringStrategy = (*NoScoring)(nil)
 var _ query.ScoringStrategy = (*TimeDecayScoring)(nil)
 var _ query.ScoringStrategy = (*KeywordScoring)(nil)
 var _ query.ScoringStrategy = (*AuthorScoring)(nil)
+var _ query.ScoringStrategy = (*InteractionScoring)(nil)
+var _ query.ScoringStrategy = (*FollowingScoring)(nil)
@@ -0,0 +1,31 @@
+package feeds_test
+
+import (
+	"norsky/feeds"
+	"norsky/query"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInteractionScoringCountsRecentViewers(t *testing.T) {
+	builder := feeds.NewFeedQueryBuilder()
+	builder.AddScoringLayer(&feeds.InteractionScoring{Feed: "norwegian", Window: 48 * time.Hour}, 1.0)
+
+	sql, args := builder.Build(query.Params{Limit: 10})
+
+	assert.Equal(t, "SELECT posts.id, posts.uri, ((1.000000 * (1.0 / (1.0 + (SELECT COUNT(DISTINCT interactions.user_did) FROM interactions "+
+		"WHERE interactions.post_uri = posts.uri AND interactions.feed = 'norwegian' AND interactions.event = 'app.bsky.feed.defs#requestLess' "+
+		"AND interactions.created_at >= NOW() - '172800 seconds'::interval))))) AS score FROM posts ORDER BY score DESC, posts.id DESC LIMIT 10", sql)
+	assert.Empty(t, args)
+}
+
+func TestInteractionScoringDefaultWindow(t *testing.T) {
+	builder := feeds.NewFeedQueryBuilder()
+	builder.AddScoringLayer(&feeds.InteractionScoring{Feed: "norwegian"}, 1.0)
+
+	sql, _ := builder.Build(query.Params{Limit: 10})
+
+	assert.Contains(t, sql, "interactions.created_at >= NOW() - '604800 seconds'::interval")
+}
@@ -0,0 +1,61 @@
+package feeds
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var seenPostsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "norsky_seen_posts_dropped_total",
+	Help: "Pages of served posts not recorded as seen because the write queue was full",
+})
+
+// Pages of served posts that can wait to be recorded as seen
+const seenQueueSize = 1000
+
+// seenRecord is a page of posts served to a viewer
+type seenRecord struct {
+	viewer    string
+	feed      string
+	postIds   []int64
+	expiresAt time.Time
+}
+
+// seenWriter records served posts from a single goroutine, started with the first page, so a slow
+// database can't pile up goroutines. Pages are dropped when the queue is full, they only tune ranking.
+type seenWriter struct {
+	db    Store
+	queue chan seenRecord
+	start sync.Once
+}
+
+func newSeenWriter(db Store, size int) *seenWriter {
+	return &seenWriter{db: db, queue: make(chan seenRecord, size)}
+}
+
+// enqueue never blocks the request serving the page
+func (w *seenWriter) enqueue(record seenRecord) {
+	w.start.Do(func() { go w.run() })
+
+	select {
+	case w.queue <- record:
+	default:
+		seenPostsDropped.Inc()
+		log.WithField("feed", record.feed).Debug("Seen posts queue is full, dropping page")
+	}
+}
+
+func (w *seenWriter) run() {
+	for record := range w.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := w.db.RecordSeenPosts(ctx, record.viewer, record.feed, record.postIds, record.expiresAt); err != nil {
+			log.WithError(err).WithField("feed", record.feed).Error("Failed to record seen posts")
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,129 @@
+package feeds_test
+
+import (
+	"context"
+	"norsky/config"
+	"norsky/feeds"
+	"norsky/models"
+	"norsky/query"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seenStore builds the query of each request and blocks recording seen posts until release is closed
+type seenStore struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	sql     string
+	running int
+	maxRuns int
+	records int
+}
+
+func (s *seenStore) GetFeedPosts(builder query.Builder, params query.Params) ([]models.FeedPost, error) {
+	sql, _ := builder.Build(params)
+	s.mu.Lock()
+	s.sql = sql
+	s.mu.Unlock()
+	return []models.FeedPost{{Id: 1, Uri: "at://did:plc:author/app.bsky.feed.post/1"}}, nil
+}
+
+func (s *seenStore) RecordSeenPosts(ctx context.Context, viewer string, feed string, postIds []int64, expiresAt time.Time) error {
+	s.mu.Lock()
+	s.running++
+	s.maxRuns = max(s.maxRuns, s.running)
+	s.mu.Unlock()
+
+	<-s.release
+
+	s.mu.Lock()
+	s.running--
+	s.records++
+	s.mu.Unlock()
+	return nil
+}
+
+func seenFeed(t *testing.T, store feeds.Store, penalty *float64) *feeds.Feed {
+	t.Helper()
+
+	cfg := &config.TomlConfig{Feeds: []config.TomlFeed{{Id: "norwegian", SeenTTL: "12h", SeenPenalty: penalty}}}
+	feedMap, err := feeds.InitializeFeeds(cfg, store, nil)
+	require.NoError(t, err)
+	return feedMap["norwegian"]
+}
+
+func TestSeenPenaltyDefaultsOnlyWhenUnset(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		penalty *float64
+		factor  string
+	}{
+		{"unset", nil, "THEN 0.100000 ELSE 1.0 END"},
+		{"zero", new(float64), "THEN 0.000000 ELSE 1.0 END"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &seenStore{release: make(chan struct{})}
+			close(store.release)
+
+			_, err := seenFeed(t, store, tc.penalty).GetFeedPosts(context.Background(), "did:plc:viewer", "", 10)
+			require.NoError(t, err)
+			assert.Contains(t, store.sql, tc.factor)
+		})
+	}
+}
+
+func TestSeenPenaltyMustNotBeNegative(t *testing.T) {
+	penalty := -0.5
+	cfg := &config.TomlConfig{Feeds: []config.TomlFeed{{Id: "norwegian", SeenTTL: "12h", SeenPenalty: &penalty}}}
+
+	_, err := feeds.InitializeFeeds(cfg, &seenStore{}, nil)
+	assert.ErrorContains(t, err, "invalid seen_penalty for feed norwegian")
+}
+
+func TestSeenPostsAreRecordedOneAtATime(t *testing.T) {
+	store := &seenStore{release: make(chan struct{})}
+	feed := seenFeed(t, store, nil)
+
+	// Requests are served while the database is slow to record seen posts
+	for i := 0; i < 20; i++ {
+		_, err := feed.GetFeedPosts(context.Background(), "did:plc:viewer", "", 10)
+		require.NoError(t, err)
+	}
+
+	close(store.release)
+	require.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.records == 20
+	}, 5*time.Second, 10*time.Millisecond)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, 1, store.maxRuns)
+}
+
+func TestSeenPenaltyQuery(t *testing.T) {
+	builder := feeds.NewFeedQueryBuilder()
+	builder.SetSeenPenalty("norwegian", 0.25)
+
+	sql, args := builder.Build(query.Params{Limit: 10, Viewer: "did:plc:viewer"})
+	assert.Contains(t, sql, "CASE WHEN EXISTS (SELECT 1 FROM seen_posts WHERE seen_posts.viewer_did = $1 AND seen_posts.feed = $2")
+	assert.Contains(t, sql, "seen_posts.expires_at > NOW()")
+	assert.Contains(t, sql, "THEN 0.250000 ELSE 1.0 END")
+	assert.Equal(t, []interface{}{"did:plc:viewer", "norwegian"}, args)
+
+	// Later pages and anonymous viewers are not down-ranked
+	for _, params := range []query.Params{
+		{Limit: 10, Cursor: 100, Viewer: "did:plc:viewer"},
+		{Limit: 10},
+	} {
+		sql, _ := builder.Build(params)
+		assert.NotContains(t, sql, "seen_posts")
+		assert.Contains(t, sql, "1.0 AS score")
+	}
+}
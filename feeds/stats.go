@@ -0,0 +1,24 @@
+package feeds
+
+import (
+	"norsky/config"
+	"norsky/db"
+)
+
+// StatsFeeds returns the feeds the dashboard statistics are rolled up for, starting with all posts.
+// Statistics describe the posts a feed draws from: age filters and filters depending on the viewer
+// are left out, since they don't hold for a fixed hour in the past or for every viewer.
+func StatsFeeds(cfg *config.TomlConfig) ([]db.StatsFeed, error) {
+	statsFeeds := []db.StatsFeed{{ID: ""}}
+
+	for _, feedConfig := range cfg.Feeds {
+		filters, err := contentFilters(feedConfig, cfg.Keywords)
+		if err != nil {
+			return nil, err
+		}
+
+		statsFeeds = append(statsFeeds, db.StatsFeed{ID: feedConfig.Id, Filters: filters})
+	}
+
+	return statsFeeds, nil
+}
@@ -2,9 +2,21 @@
 package feeds
 
 import (
+	"context"
 	"norsky/db"
+	"norsky/models"
+	"norsky/query"
+	"time"
 )
 
+// Store is the part of the database feeds read their posts from
+type Store interface {
+	GetFeedPosts(builder query.Builder, params query.Params) ([]models.FeedPost, error)
+	RecordSeenPosts(ctx context.Context, viewer string, feed string, postIds []int64, expiresAt time.Time) error
+}
+
+var _ Store = (*db.DB)(nil)
+
 // FeedMap maps feed IDs to their Feed instances
 type FeedMap map[string]*Feed
 
@@ -16,7 +28,14 @@ type Feed struct {
 	Description string
 	AvatarPath  string
 
+	// Personalized feeds depend on the viewer, e.g. their follows
+	Personalized bool
+	// SeenTTL is how long served posts are down-ranked for a viewer, zero disables it
+	SeenTTL time.Duration
+
 	// Runtime dependencies
-	DB      *db.DB
+	DB      Store
+	Viewers *ViewerTracker
 	builder *FeedQueryBuilder
+	seen    *seenWriter
 }
@@ -0,0 +1,112 @@
+package feeds
+
+import (
+	"context"
+	"norsky/db"
+	"norsky/models"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often we touch the viewers table for the same viewer
+	viewerTrackInterval = 10 * time.Minute
+	// How old a follows and blocks backfill can be before we refresh it
+	graphBackfillMaxAge = 24 * time.Hour
+)
+
+// GraphSource fetches the follow and block records of a viewer, e.g. from their PDS
+type GraphSource interface {
+	GetFollows(ctx context.Context, did string) ([]models.Follow, error)
+	GetBlocks(ctx context.Context, did string) ([]models.Block, error)
+}
+
+// ViewerTracker registers viewers of personalized feeds and backfills their follows and blocks
+type ViewerTracker struct {
+	db    *db.DB
+	graph GraphSource
+
+	lastTracked sync.Map     // viewer did -> time.Time
+	backfilling sync.Map     // viewer did -> struct{}
+	evictedAt   atomic.Int64 // unix nanoseconds of the last eviction from lastTracked
+}
+
+// NewViewerTracker creates a tracker, a nil graph source disables backfilling
+func NewViewerTracker(db *db.DB, graph GraphSource) *ViewerTracker {
+	return &ViewerTracker{
+		db:    db,
+		graph: graph,
+	}
+}
+
+// Track records the viewer and starts a follows and blocks backfill in the background when needed
+func (t *ViewerTracker) Track(ctx context.Context, did string) {
+	if last, ok := t.lastTracked.Load(did); ok && time.Since(last.(time.Time)) < viewerTrackInterval {
+		return
+	}
+	now := time.Now()
+	t.lastTracked.Store(did, now)
+	t.evictStale(now)
+
+	needsBackfill, err := t.db.TrackViewer(ctx, did, graphBackfillMaxAge)
+	if err != nil {
+		log.WithError(err).WithField("viewer", did).Error("Failed to track viewer")
+		return
+	}
+
+	if needsBackfill && t.graph != nil {
+		if _, running := t.backfilling.LoadOrStore(did, struct{}{}); !running {
+			go t.backfill(did)
+		}
+	}
+}
+
+// evictStale forgets viewers tracked longer than viewerTrackInterval ago, at most once per interval,
+// so lastTracked only holds the viewers of the last couple of intervals
+func (t *ViewerTracker) evictStale(now time.Time) {
+	last := t.evictedAt.Load()
+	if now.UnixNano()-last < int64(viewerTrackInterval) || !t.evictedAt.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	t.lastTracked.Range(func(did, tracked any) bool {
+		if now.Sub(tracked.(time.Time)) >= viewerTrackInterval {
+			t.lastTracked.Delete(did)
+		}
+		return true
+	})
+}
+
+func (t *ViewerTracker) backfill(did string) {
+	defer t.backfilling.Delete(did)
+
+	// Detached from the request, which is long gone by the time we are done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	follows, err := t.graph.GetFollows(ctx, did)
+	if err != nil {
+		log.WithError(err).WithField("viewer", did).Error("Failed to fetch follows for backfill")
+		return
+	}
+
+	// Blocks from before the viewer was tracked never came through the firehose
+	blocks, err := t.graph.GetBlocks(ctx, did)
+	if err != nil {
+		log.WithError(err).WithField("viewer", did).Error("Failed to fetch blocks for backfill")
+		return
+	}
+
+	if err := t.db.ReplaceGraph(ctx, did, follows, blocks); err != nil {
+		log.WithError(err).WithField("viewer", did).Error("Failed to store backfilled follows and blocks")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"viewer":  did,
+		"follows": len(follows),
+		"blocks":  len(blocks),
+	}).Info("Backfilled viewer follows and blocks")
+}
@@ -0,0 +1,24 @@
+package firehose
+
+import (
+	"context"
+	"time"
+
+	jetstream_models "github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// SetBackOffWait replaces the pause between connection attempts for a test, call restore when done
+func SetBackOffWait(wait func(ctx context.Context, d time.Duration) error) (restore func()) {
+	previous := backOffWait
+	backOffWait = wait
+	return func() { backOffWait = previous }
+}
+
+// ProcessBlockWithoutDatabase runs a block event through a processor tracking the viewers but without
+// a database, so it panics when the event would have reached the database
+func ProcessBlockWithoutDatabase(viewers []string, event jetstream_models.Event) error {
+	set := newViewerSet()
+	set.viewers = toSet(viewers)
+	p := &PostProcessor{context: context.Background(), viewers: set}
+	return p.processBlock(&event)
+}
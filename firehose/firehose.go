@@ -3,6 +3,7 @@ package firehose
 import (
 	"context"
 	"norsky/db"
+	"norsky/sink"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,34 +18,62 @@ type FirehoseConfig struct {
 	JetstreamCompress    bool
 	UserAgent            string
 	WantedCollections    []string
+	// Cursor is the Jetstream time_us to start from, zero continues from the database or starts live
+	Cursor int64
+	// Session controls how dead Jetstream connections are detected
+	Session SupervisorConfig
 }
 
-// Subscribe to the firehose using the Firehose struct as a receiver
-func Subscribe(ctx context.Context, postChan chan interface{}, ticker *time.Ticker, db *db.DB, config FirehoseConfig) {
-	// Get latest post timestamp
-	latestTime, err := db.GetLatestPostTimestamp(ctx)
-	if err != nil {
-		log.Errorf("Failed to get latest post timestamp: %v", err)
-	}
+// Subscription is a running ingest of the firehose
+type Subscription struct {
+	*Supervisor
+	done chan struct{}
+}
+
+// Wait blocks until ingest has stopped and the workers are done
+func (s *Subscription) Wait() {
+	<-s.done
+}
 
-	// If we have a latest post, start 10 seconds before it
-	var cursor int64
-	if !latestTime.IsZero() {
-		cursor = latestTime.Add(-10 * time.Second).UnixMicro()
+// Subscribe to the firehose and send accepted post events to the sink, db may be nil to run without a database.
+// Ingest runs in the background until ctx is done.
+func Subscribe(ctx context.Context, sink sink.PostSink, db *db.DB, config FirehoseConfig) *Subscription {
+	// Without an explicit cursor continue shortly before the latest stored post
+	cursor := config.Cursor
+	if cursor == 0 && db != nil {
+		latestTime, err := db.GetLatestPostTimestamp(ctx)
+		if err != nil {
+			log.Errorf("Failed to get latest post timestamp: %v", err)
+		}
+		if !latestTime.IsZero() {
+			cursor = latestTime.Add(-10 * time.Second).UnixMicro()
+		}
 	}
 
 	// Create a new parallel processor
-	pp := NewParallelProcessor(ctx, 10, 1000, db, config)
+	pp := NewParallelProcessor(ctx, 10, 1000, db, sink, config)
 
-	// Subscribe to the jetstream firehose with cursor
-	SubscribeJetstreamWithMessages(ctx, JetstreamConfig{
+	// The supervisor keeps the Jetstream connection alive and resumes from the processed cursor
+	supervisor := newSupervisor(JetstreamConfig{
 		Hosts:             config.JetstreamHosts,
 		Compress:          config.JetstreamCompress,
 		UserAgent:         config.UserAgent,
 		WantedCollections: config.WantedCollections,
-		Cursor:            cursor, // Add the cursor
-	}, pp.workerQueue)
+		Cursor:            cursor,
+	}, config.Session, pp.workerQueue, pp.progress)
+
+	subscription := &Subscription{Supervisor: supervisor, done: make(chan struct{})}
 
 	// Start the parallel processor
 	pp.start()
+
+	go func() {
+		defer close(subscription.done)
+		if err := supervisor.Run(ctx); err != nil {
+			log.Errorf("Jetstream session stopped: %v", err)
+		}
+		pp.stop()
+	}()
+
+	return subscription
 }
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -77,18 +78,19 @@ type RawMessage struct {
 	Data        []byte // Raw message data
 }
 
-// SubscribeJetstream establishes and maintains a websocket connection to the Jetstream service
-func SubscribeJetstream(ctx context.Context, config JetstreamConfig) (*websocket.Conn, error) {
+// connectJetstream dials the hosts in turn starting at hostIdx, backing off after every round of failed
+// attempts, until a connection is made or ctx is done. It returns the index of the connected host.
+func connectJetstream(ctx context.Context, config JetstreamConfig, hostIdx int) (*websocket.Conn, int, error) {
 
 	log.WithFields(log.Fields{
 		"hosts": config.Hosts,
 	}).Info("Subscribing to Jetstream")
 
 	if len(config.Hosts) == 0 {
-		return nil, fmt.Errorf("no hosts provided in config")
+		return nil, 0, fmt.Errorf("no hosts provided in config")
 	}
 
-	currentHostIdx := 0
+	currentHostIdx := hostIdx % len(config.Hosts)
 
 	// Configure websocket dialer
 	dialer := websocket.Dialer{
@@ -102,49 +104,20 @@ func SubscribeJetstream(ctx context.Context, config JetstreamConfig) (*websocket
 	}
 
 	// Set up exponential backoff for reconnection attempts
-	backoff := backoff.NewExponentialBackOff()
-	backoff.InitialInterval = 100 * time.Millisecond
-	backoff.MaxInterval = 30 * time.Second
-	backoff.Multiplier = 1.5
-	backoff.MaxElapsedTime = 0 // Never stop retrying
-
-	var conn *websocket.Conn
+	backoff := newJetstreamBackOff()
 
 	// Connection loop with retry and failover logic
-	for {
+	for attempt := 1; ; attempt++ {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, 0, ctx.Err()
 		default:
 			currentHost := config.Hosts[currentHostIdx]
 
-			// Build URL with query parameters
-			u, err := url.Parse(fmt.Sprintf("%s/subscribe", currentHost))
+			u, err := subscribeURL(currentHost, config)
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse URL: %w", err)
-			}
-
-			q := u.Query()
-			if len(config.WantedCollections) > 0 {
-				for _, collection := range config.WantedCollections {
-					q.Add("wantedCollections", collection)
-				}
-			}
-			if len(config.WantedDids) > 0 {
-				for _, did := range config.WantedDids {
-					q.Add("wantedDids", did)
-				}
+				return nil, 0, err
 			}
-			if config.Cursor != 0 {
-				q.Set("cursor", fmt.Sprintf("%d", config.Cursor))
-			}
-			if config.Compress {
-				q.Set("compress", "true")
-			}
-			if config.RequireHello {
-				q.Set("requireHello", "true")
-			}
-			u.RawQuery = q.Encode()
 
 			// Set up headers
 			headers := http.Header{}
@@ -158,56 +131,86 @@ func SubscribeJetstream(ctx context.Context, config JetstreamConfig) (*websocket
 
 			wsConnectionAttempts.Inc()
 
-			var dialErr error
-			conn, _, dialErr = dialer.Dial(u.String(), headers)
+			conn, _, dialErr := dialer.DialContext(ctx, u, headers)
+			if dialErr == nil {
+				return conn, currentHostIdx, nil
+			}
 
-			if dialErr != nil {
-				wsConnectionErrors.Inc()
-				log.Errorf("Error connecting to Jetstream host %s: %s", currentHost, dialErr)
-
-				// Try next host
-				nextHostIdx := (currentHostIdx + 1) % len(config.Hosts)
-				if nextHostIdx != currentHostIdx {
-					wsHostSwitches.WithLabelValues(currentHost, config.Hosts[nextHostIdx]).Inc()
-					log.Infof("Switching from host %s to %s", currentHost, config.Hosts[nextHostIdx])
-					currentHostIdx = nextHostIdx
-					// Reset backoff when switching hosts
-					backoff.Reset()
-					continue
-				}
+			wsConnectionErrors.Inc()
+			log.Errorf("Error connecting to Jetstream host %s: %s", currentHost, dialErr)
 
-				// If we've tried all hosts, wait before retrying
-				time.Sleep(backoff.NextBackOff())
-				continue
+			// Try next host
+			nextHostIdx := (currentHostIdx + 1) % len(config.Hosts)
+			if nextHostIdx != currentHostIdx {
+				wsHostSwitches.WithLabelValues(currentHost, config.Hosts[nextHostIdx]).Inc()
+				log.Infof("Switching from host %s to %s", currentHost, config.Hosts[nextHostIdx])
+				currentHostIdx = nextHostIdx
 			}
 
-			// Reset backoff on successful connection
-			backoff.Reset()
-			wsCurrentConnections.Inc()
+			// If we've tried all hosts, wait before retrying
+			if attempt%len(config.Hosts) == 0 {
+				if err := backOffWait(ctx, backoff.NextBackOff()); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+}
 
-			// Start connection duration timer
-			connStart := time.Now()
-			go func() {
-				<-ctx.Done()
-				wsConnectionDuration.Observe(time.Since(connStart).Seconds())
-				wsCurrentConnections.Dec()
-			}()
+// newJetstreamBackOff backs off from 100ms up to 30s between rounds of connection attempts, forever
+func newJetstreamBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 100 * time.Millisecond
+	b.MaxInterval = 30 * time.Second
+	b.Multiplier = 1.5
+	b.MaxElapsedTime = 0 // Never stop retrying
+	b.Reset()            // Start from the initial interval set above
+	return b
+}
 
-			// Set up connection handlers
-			setupConnectionHandlers(conn)
+// backOffWait pauses between connection attempts until ctx is done, tests replace it to step through the backoff
+var backOffWait = func(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
 
-			// Start ping routine
-			go managePingPong(ctx, conn)
+// subscribeURL builds the subscribe URL of the host with the query parameters of the config
+func subscribeURL(host string, config JetstreamConfig) (string, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/subscribe", host))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse URL: %w", err)
+	}
 
-			return conn, nil
-		}
+	q := u.Query()
+	for _, collection := range config.WantedCollections {
+		q.Add("wantedCollections", collection)
+	}
+	for _, did := range config.WantedDids {
+		q.Add("wantedDids", did)
+	}
+	if config.Cursor != 0 {
+		q.Set("cursor", fmt.Sprintf("%d", config.Cursor))
 	}
+	if config.Compress {
+		q.Set("compress", "true")
+	}
+	if config.RequireHello {
+		q.Set("requireHello", "true")
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
 }
 
-// setupConnectionHandlers configures the websocket connection handlers
-func setupConnectionHandlers(conn *websocket.Conn) {
+// setupConnectionHandlers configures the websocket connection handlers, the connection times out
+// when no ping or pong arrives within readTimeout. pingSent is the unix nano time of the last ping
+// sent by managePingPong, for measuring the ping latency.
+func setupConnectionHandlers(conn *websocket.Conn, readTimeout time.Duration, pingSent *atomic.Int64) {
 	// Set initial deadlines
-	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
 	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
 
 	// Add connection close handler
@@ -219,19 +222,30 @@ func setupConnectionHandlers(conn *websocket.Conn) {
 	// Set ping handler
 	conn.SetPingHandler(func(appData string) error {
 		log.Debug("Received ping from server")
-		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+		// Answer like the default ping handler does
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(wsWriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
 	})
 
 	// Set pong handler
 	conn.SetPongHandler(func(appData string) error {
 		log.Debug("Received pong from server")
-		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		if sent := pingSent.Load(); sent > 0 {
+			wsPingLatency.Observe(time.Since(time.Unix(0, sent)).Seconds())
+		}
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
 	})
 }
 
 // managePingPong handles the ping/pong keepalive for the websocket connection
-func managePingPong(ctx context.Context, conn *websocket.Conn) {
-	ticker := time.NewTicker(wsPingInterval)
+func managePingPong(ctx context.Context, conn *websocket.Conn, pingInterval time.Duration, pingSent *atomic.Int64) {
+	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
 
 	for {
@@ -239,68 +253,16 @@ func managePingPong(ctx context.Context, conn *websocket.Conn) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			pingStart := time.Now()
 			log.Debug("Sending ping to check connection")
+			pingSent.Store(time.Now().UnixNano())
 
+			// Only the pong extends the read deadline, so a connection that stops answering times out
 			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(wsWriteTimeout)); err != nil {
 				log.Warn("Ping failed, closing connection for restart: ", err)
 				wsConnectionErrors.Inc()
 				conn.Close()
 				return
 			}
-
-			// Measure ping latency when we receive the pong
-			conn.SetPongHandler(func(appData string) error {
-				wsPingLatency.Observe(time.Since(pingStart).Seconds())
-				return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
-			})
-
-			// Reset read deadline after successful ping
-			if err := conn.SetReadDeadline(time.Now().Add(wsReadTimeout)); err != nil {
-				log.Warn("Failed to set read deadline, closing connection: ", err)
-				wsConnectionErrors.Inc()
-				conn.Close()
-				return
-			}
 		}
 	}
 }
-
-// SubscribeJetstreamWithMessages establishes a websocket connection and returns a channel of raw messages
-func SubscribeJetstreamWithMessages(ctx context.Context, config JetstreamConfig, workerQueue chan *RawMessage) error {
-	log.Infof("Subscribing to Jetstream with messages")
-	conn, err := SubscribeJetstream(ctx, config)
-	if err != nil {
-		return err
-	}
-
-	// Start message reading goroutine
-	go func() {
-		defer conn.Close()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				messageType, message, err := conn.ReadMessage()
-				if err != nil {
-					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						log.Errorf("Unexpected websocket close: %v", err)
-					}
-					wsConnectionErrors.Inc()
-					return
-				}
-
-				rawMsg := &RawMessage{
-					MessageType: messageType,
-					Data:        message,
-				}
-
-				workerQueue <- rawMsg
-			}
-		}
-	}()
-
-	return nil
-}
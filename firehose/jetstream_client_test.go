@@ -0,0 +1,208 @@
+package firehose_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"norsky/firehose"
+	"norsky/firehose/jetstreamtest"
+
+	jetstream_models "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDid = "did:plc:test"
+
+// cannedPosts are three posts one second apart
+func cannedPosts() []jetstream_models.Event {
+	return []jetstream_models.Event{
+		jetstreamtest.PostEvent(1738411200000000, testDid, "en", "Dette er den første posten i dag", "nb"),
+		jetstreamtest.PostEvent(1738411201000000, testDid, "to", "Dette er den andre posten i dag", "nb"),
+		jetstreamtest.PostEvent(1738411202000000, testDid, "tre", "Dette er den tredje posten i dag", "nb"),
+	}
+}
+
+// stop cancels the subscription and waits for it to finish
+func stop(t *testing.T, cancel context.CancelFunc, subscription *firehose.Subscription) {
+	t.Helper()
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		subscription.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not stop")
+	}
+}
+
+func TestSubscribeReceivesEvents(t *testing.T) {
+	server := jetstreamtest.NewServer(cannedPosts()...)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := subscribeConfig(firehose.SupervisorConfig{}, server.URL)
+	config.WantedCollections = []string{"app.bsky.feed.post"}
+	config.UserAgent = "norsky-test"
+	sink := &collectSink{}
+	subscription := firehose.Subscribe(ctx, sink, nil, config)
+	require.Eventually(t, func() bool { return hasPosts(sink, "en", "to", "tre") }, 5*time.Second, 10*time.Millisecond)
+
+	// Events published while connected are streamed too
+	server.Publish(jetstreamtest.PostEvent(1738411203000000, testDid, "fire", "Dette er den fjerde posten i dag", "nb"))
+	require.Eventually(t, func() bool { return hasPosts(sink, "fire") }, 5*time.Second, 10*time.Millisecond)
+
+	requests := server.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, []string{"app.bsky.feed.post"}, requests[0].WantedCollections)
+	assert.Equal(t, "norsky-test", requests[0].UserAgent)
+	assert.False(t, requests[0].Compress)
+
+	stop(t, cancel, subscription)
+}
+
+func TestSubscribeCompressed(t *testing.T) {
+	server := jetstreamtest.NewServer(cannedPosts()...)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := subscribeConfig(firehose.SupervisorConfig{}, server.URL)
+	config.JetstreamCompress = true
+	sink := &collectSink{}
+	subscription := firehose.Subscribe(ctx, sink, nil, config)
+	require.Eventually(t, func() bool { return hasPosts(sink, "en", "to", "tre") }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, server.Requests()[0].Compress)
+
+	stop(t, cancel, subscription)
+}
+
+func TestSubscribeStartsFromCursor(t *testing.T) {
+	events := cannedPosts()
+	server := jetstreamtest.NewServer(events...)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := subscribeConfig(firehose.SupervisorConfig{}, server.URL)
+	config.Cursor = events[1].TimeUS
+	sink := &collectSink{}
+	subscription := firehose.Subscribe(ctx, sink, nil, config)
+	require.Eventually(t, func() bool { return hasPosts(sink, "to", "tre") }, 5*time.Second, 10*time.Millisecond)
+
+	assert.False(t, hasPosts(sink, "en"))
+	requests := server.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, events[1].TimeUS, requests[0].Cursor)
+
+	stop(t, cancel, subscription)
+}
+
+func TestSubscribeFailsOver(t *testing.T) {
+	down := jetstreamtest.NewServer()
+	defer down.Close()
+	down.SetDown(true)
+
+	up := jetstreamtest.NewServer(cannedPosts()...)
+	defer up.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &collectSink{}
+	subscription := firehose.Subscribe(ctx, sink, nil, subscribeConfig(firehose.SupervisorConfig{}, down.URL, up.URL))
+	require.Eventually(t, func() bool { return hasPosts(sink, "en", "to", "tre") }, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 1, down.Attempts())
+	assert.Len(t, up.Requests(), 1)
+	assert.Equal(t, up.URL, subscription.Status().Host)
+
+	stop(t, cancel, subscription)
+}
+
+func TestSubscribeBacksOffAfterEveryRoundOfHosts(t *testing.T) {
+	first := jetstreamtest.NewServer()
+	defer first.Close()
+	first.SetDown(true)
+
+	second := jetstreamtest.NewServer(cannedPosts()...)
+	defer second.Close()
+	second.SetDown(true)
+
+	// Hold every backoff until the test has checked the attempts made before it
+	waits := make(chan time.Duration)
+	release := make(chan struct{})
+	restore := firehose.SetBackOffWait(func(ctx context.Context, d time.Duration) error {
+		select {
+		case waits <- d:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &collectSink{}
+	subscription := firehose.Subscribe(ctx, sink, nil, subscribeConfig(firehose.SupervisorConfig{}, first.URL, second.URL))
+
+	for round := 1; round <= 3; round++ {
+		var wait time.Duration
+		select {
+		case wait = <-waits:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no backoff after round %d", round)
+		}
+
+		// Every host is tried once per round, then the session waits
+		assert.Equal(t, round, first.Attempts())
+		assert.Equal(t, round, second.Attempts())
+		assert.Positive(t, wait)
+		if round == 1 {
+			// The first wait starts from the initial interval of 100ms, randomized by half
+			assert.LessOrEqual(t, wait, 150*time.Millisecond)
+		}
+
+		if round == 3 {
+			second.SetDown(false)
+		}
+		release <- struct{}{}
+	}
+
+	require.Eventually(t, func() bool { return hasPosts(sink, "en", "to", "tre") }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 4, first.Attempts())
+	assert.Len(t, second.Requests(), 1)
+
+	stop(t, cancel, subscription)
+}
+
+func TestSubscribeStopsRetryingWhenCancelled(t *testing.T) {
+	server := jetstreamtest.NewServer()
+	defer server.Close()
+	server.SetDown(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	subscription := firehose.Subscribe(ctx, &collectSink{}, nil, subscribeConfig(firehose.SupervisorConfig{}, server.URL))
+	require.Eventually(t, func() bool { return server.Attempts() > 0 }, 5*time.Second, 10*time.Millisecond)
+
+	stop(t, cancel, subscription)
+	assert.Equal(t, firehose.SessionStopped, subscription.Status().State)
+}
@@ -0,0 +1,291 @@
+// Package jetstreamtest provides an in-process Jetstream stand-in for tests of the firehose client
+package jetstreamtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Request is a subscription accepted by the server
+type Request struct {
+	Cursor            int64
+	Compress          bool
+	WantedCollections []string
+	UserAgent         string
+}
+
+// Server serves canned events on /subscribe like Jetstream does. Events are sent in order from the
+// first event at or after the requested cursor, or all of them without a cursor. Connections stay
+// open after the canned events and receive events added with Publish.
+type Server struct {
+	// URL is the websocket base URL of the server, e.g. ws://127.0.0.1:1234
+	URL string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+	encoder  *zstd.Encoder
+
+	mu              sync.Mutex
+	events          []models.Event
+	published       chan struct{}
+	conns           map[*websocket.Conn]struct{}
+	requests        []Request
+	attempts        int
+	down            bool
+	disconnectAfter int
+	pongDelay       time.Duration
+}
+
+// NewServer starts a server with the canned events, call Close when done
+func NewServer(events ...models.Event) *Server {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(models.ZSTDDictionary))
+	if err != nil {
+		panic(fmt.Sprintf("jetstreamtest: failed to create zstd encoder: %v", err))
+	}
+
+	s := &Server{
+		encoder:   encoder,
+		events:    events,
+		published: make(chan struct{}),
+		conns:     make(map[*websocket.Conn]struct{}),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = "ws" + strings.TrimPrefix(s.server.URL, "http")
+	return s
+}
+
+// Close disconnects all clients and stops the server
+func (s *Server) Close() {
+	s.Disconnect()
+	s.server.Close()
+	s.encoder.Close()
+}
+
+// Publish sends an event to all connected clients and to clients connecting later
+func (s *Server) Publish(event models.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	close(s.published)
+	s.published = make(chan struct{})
+}
+
+// Disconnect drops all current connections without a close frame, like a network failure
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.NetConn().Close()
+	}
+}
+
+// SetDown makes the server refuse new connections with 503 Service Unavailable
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// DisconnectAfter drops every new connection after it has been sent n events, zero disables it
+func (s *Server) DisconnectAfter(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnectAfter = n
+}
+
+// SetPongDelay delays the answer to every ping, e.g. to make the client time out
+func (s *Server) SetPongDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pongDelay = delay
+}
+
+// Attempts is the number of subscribe requests, including refused ones
+func (s *Server) Attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+// Requests returns the accepted subscriptions in the order they were made
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// Connections is the number of currently connected clients
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/subscribe" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.attempts++
+	down := s.down
+	s.mu.Unlock()
+	if down {
+		http.Error(w, "jetstream is down", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	request := Request{
+		Compress:          query.Get("compress") == "true",
+		WantedCollections: query["wantedCollections"],
+		UserAgent:         r.UserAgent(),
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		var err error
+		request.Cursor, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	s.conns[conn] = struct{}{}
+	limit := s.disconnectAfter
+	pongDelay := s.pongDelay
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	// Read in the background to answer pings and notice when the client goes away
+	closed := make(chan struct{})
+	conn.SetPingHandler(func(data string) error {
+		go func() {
+			time.Sleep(pongDelay)
+			conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		}()
+		return nil
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	next := s.firstEvent(request.Cursor)
+	sent := 0
+	for {
+		s.mu.Lock()
+		pending := slices.Clone(s.events[next:])
+		published := s.published
+		s.mu.Unlock()
+
+		for _, event := range pending {
+			next++
+			if !wanted(event, request.WantedCollections) {
+				continue
+			}
+			if err := s.send(conn, event, request.Compress); err != nil {
+				return
+			}
+			sent++
+			if limit > 0 && sent >= limit {
+				conn.NetConn().Close()
+				return
+			}
+		}
+
+		select {
+		case <-closed:
+			return
+		case <-published:
+		}
+	}
+}
+
+// firstEvent is the index of the first event at or after the cursor
+func (s *Server) firstEvent(cursor int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, event := range s.events {
+		if event.TimeUS >= cursor {
+			return i
+		}
+	}
+	return len(s.events)
+}
+
+func (s *Server) send(conn *websocket.Conn, event models.Event, compress bool) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if compress {
+		return conn.WriteMessage(websocket.BinaryMessage, s.encoder.EncodeAll(data, nil))
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// wanted filters commits by collection, account and identity events are always sent
+func wanted(event models.Event, collections []string) bool {
+	if len(collections) == 0 || event.Commit == nil {
+		return true
+	}
+	return slices.Contains(collections, event.Commit.Collection)
+}
+
+// CommitEvent creates a commit event creating the record
+func CommitEvent(timeUS int64, did, collection, rkey string, record any) models.Event {
+	data, err := json.Marshal(record)
+	if err != nil {
+		panic(fmt.Sprintf("jetstreamtest: failed to marshal record: %v", err))
+	}
+	return models.Event{
+		Did:    did,
+		TimeUS: timeUS,
+		Kind:   models.EventKindCommit,
+		Commit: &models.Commit{
+			Operation:  models.CommitOperationCreate,
+			Collection: collection,
+			RKey:       rkey,
+			Record:     data,
+		},
+	}
+}
+
+// PostEvent creates a post created at the time of the event
+func PostEvent(timeUS int64, did, rkey, text string, langs ...string) models.Event {
+	return CommitEvent(timeUS, did, "app.bsky.feed.post", rkey, bsky.FeedPost{
+		Text:      text,
+		Langs:     langs,
+		CreatedAt: time.UnixMicro(timeUS).UTC().Format(time.RFC3339),
+	})
+}
@@ -3,8 +3,11 @@ package firehose
 import (
 	"context"
 	"norsky/db"
+	"norsky/sink"
 	"sync"
 
+	"github.com/samber/lo"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -12,13 +15,13 @@ type ParallelProcessor struct {
 	maxWorkers  int
 	workerQueue chan *RawMessage
 	processors  []*PostProcessor
-	postChan    chan interface{} // Channel to send processed posts
+	progress    *progress
 	wg          sync.WaitGroup
 	ctx         context.Context
 	cancel      context.CancelFunc
 }
 
-func NewParallelProcessor(ctx context.Context, maxWorkers int, maxQueueSize int, db *db.DB, config FirehoseConfig) *ParallelProcessor {
+func NewParallelProcessor(ctx context.Context, maxWorkers int, maxQueueSize int, db *db.DB, sink sink.PostSink, config FirehoseConfig) *ParallelProcessor {
 	ctx, cancel := context.WithCancel(ctx)
 
 	// Setup new parallel processor with maxWorkers go routines
@@ -26,26 +29,41 @@ func NewParallelProcessor(ctx context.Context, maxWorkers int, maxQueueSize int,
 		maxWorkers:  maxWorkers,
 		workerQueue: make(chan *RawMessage, maxQueueSize),
 		processors:  make([]*PostProcessor, maxWorkers),
+		progress:    &progress{},
 		ctx:         ctx,
 		cancel:      cancel,
 	}
 
+	// Keep track of viewers when we ingest their graph records
+	viewers := newViewerSet()
+	if db != nil && (lo.Contains(config.WantedCollections, followCollection) || lo.Contains(config.WantedCollections, blockCollection)) {
+		go viewers.refresh(ctx, db)
+	}
+
 	// Create workers
 	for i := 0; i < maxWorkers; i++ {
-		pp.processors[i] = NewPostProcessor(ctx, config, db)
+		pp.processors[i] = NewPostProcessor(ctx, config, db, viewers, sink, pp.progress)
 	}
 
 	return pp
 }
 
 func (pp *ParallelProcessor) start() {
+	pp.wg.Add(len(pp.processors))
 	for i, processor := range pp.processors {
 		go pp.startWorker(i, processor)
 	}
 }
 
+// stop lets the workers finish the queued messages, then waits for them to exit.
+// Nothing may be sent to the worker queue afterwards.
+func (pp *ParallelProcessor) stop() {
+	close(pp.workerQueue)
+	pp.wg.Wait()
+	pp.cancel()
+}
+
 func (pp *ParallelProcessor) startWorker(id int, processor *PostProcessor) {
-	pp.wg.Add(1)
 	defer pp.wg.Done() // Ensure we mark the worker as done when we exit
 
 	for {
@@ -53,7 +71,11 @@ func (pp *ParallelProcessor) startWorker(id int, processor *PostProcessor) {
 		case <-pp.ctx.Done():
 			log.Infof("Worker %d: Shutting down", id)
 			return
-		case msg := <-pp.workerQueue:
+		case msg, ok := <-pp.workerQueue:
+			if !ok {
+				return
+			}
+			ingestQueueLength.Set(float64(len(pp.workerQueue)))
 			if err := processor.processPost(msg); err != nil {
 				log.Errorf("Worker %d: Error processing message: %v", id, err)
 			}
@@ -13,15 +13,55 @@ import (
 	jetstream_models "github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/klauspost/compress/zstd"
 	lingua "github.com/pemistahl/lingua-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 
 	"norsky/db"
 	norsky_models "norsky/models"
+	"norsky/sink"
+)
+
+var (
+	ingestEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_ingest_events_total",
+		Help: "Jetstream events processed by collection and operation, non-commit events are counted by kind",
+	}, []string{"collection", "operation"})
+
+	ingestPostsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "norsky_ingest_posts_accepted_total",
+		Help: "Created posts that passed all filters and were sent to the sink",
+	})
+
+	postsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_posts_processed_total",
+		Help: "Total number of posts processed by language",
+	}, []string{"language"})
+
+	languageDetectionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "norsky_language_detection_duration_seconds",
+		Help:    "Time spent detecting the language of a post",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14), // 0.1ms to 0.8s
+	})
+
+	ingestPostsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_ingest_posts_rejected_total",
+		Help: "Created posts that were dropped by reason",
+	}, []string{"reason"})
+
+	ingestLastEvent = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "norsky_ingest_last_event_timestamp_seconds",
+		Help: "Jetstream time of the newest processed event",
+	})
+
+	ingestQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "norsky_ingest_queue_length",
+		Help: "Jetstream messages waiting in the worker queue",
+	})
 )
 
 type PostProcessor struct {
-	postChan           chan interface{}
 	context            context.Context
 	config             FirehoseConfig
 	decoder            *zstd.Decoder
@@ -29,9 +69,18 @@ type PostProcessor struct {
 	supportedLanguages map[lingua.Language]string
 	languageDetector   lingua.LanguageDetector
 	db                 *db.DB
+	viewers            *viewerSet
+	sink               sink.PostSink
+	progress           *progress
 }
 
-func NewPostProcessor(ctx context.Context, config FirehoseConfig, db *db.DB) *PostProcessor {
+const (
+	postCollection   = "app.bsky.feed.post"
+	followCollection = "app.bsky.graph.follow"
+	blockCollection  = "app.bsky.graph.block"
+)
+
+func NewPostProcessor(ctx context.Context, config FirehoseConfig, db *db.DB, viewers *viewerSet, sink sink.PostSink, progress *progress) *PostProcessor {
 	pp := &PostProcessor{
 		context:            ctx,
 		config:             config,
@@ -39,6 +88,9 @@ func NewPostProcessor(ctx context.Context, config FirehoseConfig, db *db.DB) *Po
 		supportedLanguages: getSupportedLanguages(),
 		languageDetector:   NewLanguageDetector(targetLanguagesToLingua(config.Languages)),
 		db:                 db,
+		viewers:            viewers,
+		sink:               sink,
+		progress:           progress,
 	}
 
 	if config.JetstreamCompress {
@@ -74,16 +126,41 @@ func (p *PostProcessor) processPost(msg *RawMessage) error {
 		return fmt.Errorf("failed to unmarshal event: %w", err)
 	}
 
+	// Skipped and failed events count as processed too, the supervisor resumes after them
+	defer p.progress.processed(event.TimeUS)
+
+	if event.Commit != nil {
+		ingestEvents.WithLabelValues(event.Commit.Collection, event.Commit.Operation).Inc()
+	} else {
+		ingestEvents.WithLabelValues(event.Kind, "").Inc()
+	}
+
+	// Graph records are only stored when running with a database
+	if event.Commit != nil && event.Commit.Collection == followCollection && p.db != nil {
+		return p.processFollow(&event)
+	}
+
+	if event.Commit != nil && event.Commit.Collection == blockCollection && p.db != nil {
+		return p.processBlock(&event)
+	}
+
+	if event.Commit == nil || event.Commit.Collection != postCollection {
+		return nil
+	}
+
+	if event.Commit.Operation == jetstream_models.CommitOperationDelete {
+		return p.processPostDelete(&event)
+	}
+
 	// If it is not a create post commit operation we skip it
-	if event.Commit == nil ||
-		event.Commit.Operation != jetstream_models.CommitOperationCreate ||
-		event.Commit.Collection != "app.bsky.feed.post" {
+	if event.Commit.Operation != jetstream_models.CommitOperationCreate {
 		return nil
 	}
 
 	// Get the post record unmarshalled
 	var record bsky.FeedPost
 	if err := json.Unmarshal(event.Commit.Record, &record); err != nil {
+		ingestPostsRejected.WithLabelValues("invalid").Inc()
 		return fmt.Errorf("failed to unmarshal post: %w", err)
 	}
 
@@ -92,27 +169,36 @@ func (p *PostProcessor) processPost(msg *RawMessage) error {
 
 	words := strings.Fields(record.Text)
 	if len(words) < 4 {
+		ingestPostsRejected.WithLabelValues("word_count").Inc()
 		return nil
 	}
 
 	if !HasEnoughLetters(record.Text) {
+		ingestPostsRejected.WithLabelValues("letters").Inc()
 		return nil
 	}
 
 	if ContainsRepetitivePattern(record.Text) {
+		ingestPostsRejected.WithLabelValues("repetitive").Inc()
 		return nil
 	}
 
 	if ContainsSpamContent(record.Text) {
+		ingestPostsRejected.WithLabelValues("spam").Inc()
 		return nil
 	}
 
 	// 6. Language detection (most expensive operation)
 	shouldProcess := false
 	langs := record.Langs
+	var detection *norsky_models.LanguageDetection
 
+	rejectReason := "language"
 	if p.config.RunLanguageDetection {
-		shouldProcess, langs = p.DetectLanguage(record.Text, record.Langs, p.targetLanguages)
+		detectStart := time.Now()
+		shouldProcess, langs, detection = p.DetectLanguage(record.Text, record.Langs, p.targetLanguages)
+		languageDetectionDuration.Observe(time.Since(detectStart).Seconds())
+		rejectReason = "confidence"
 	} else {
 		// When not running language detection, check if:
 		// 1. Post has no language tags (accept all) OR
@@ -122,12 +208,14 @@ func (p *PostProcessor) processPost(msg *RawMessage) error {
 	}
 
 	if !shouldProcess {
+		ingestPostsRejected.WithLabelValues(rejectReason).Inc()
 		return nil
 	}
 
 	// Parse and send create post event
 	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
 	if err != nil {
+		ingestPostsRejected.WithLabelValues("invalid").Inc()
 		return fmt.Errorf("failed to parse creation time: %w", err)
 	}
 
@@ -141,10 +229,9 @@ func (p *PostProcessor) processPost(msg *RawMessage) error {
 	log.WithFields(log.Fields{
 		"uri":       uri,
 		"createdAt": createdAt.Unix(),
-		"text":      record.Text,
 		"languages": langs,
 		"parentUri": parentUri,
-	}).Info("Adding post to database")
+	}).Debug("Adding post to database")
 
 	// Create post object
 	post := norsky_models.Post{
@@ -156,22 +243,125 @@ func (p *PostProcessor) processPost(msg *RawMessage) error {
 		Author:    event.Did,
 	}
 
-	// Add more detailed logging before database write
-	log.WithFields(log.Fields{
-		"uri":       post.Uri,
-		"createdAt": post.CreatedAt,
-		"languages": post.Languages,
-		"authorDid": post.Author,
-	}).Info("Writing post to database")
+	// Blocks while the sink is behind, which slows down the workers and the websocket reader
+	if err := p.sink.Send(p.context, norsky_models.CreatePostEvent{Post: post, Detection: detection}); err != nil {
+		return fmt.Errorf("failed to send post to sink: %w", err)
+	}
+	ingestPostsAccepted.Inc()
+	postsProcessed.WithLabelValues(p.acceptedLanguage(langs, detection)).Inc()
+
+	return nil
+}
+
+// processPostDelete sends deletes of posts. Jetstream doesn't say which posts a delete was for, so they are
+// sent for every post on the network: the database sink only deletes stored posts, and the output sinks of
+// subscribe and replay are wrapped in a sink.KnownPostsFilter that drops deletes of posts they never wrote.
+func (p *PostProcessor) processPostDelete(event *jetstream_models.Event) error {
+	uri := fmt.Sprintf("at://%s/%s/%s", event.Did, postCollection, event.Commit.RKey)
+	if err := p.sink.Send(p.context, norsky_models.DeletePostEvent{Post: norsky_models.Post{
+		Uri:    uri,
+		Author: event.Did,
+	}}); err != nil {
+		return fmt.Errorf("failed to send post delete to sink: %w", err)
+	}
+	return nil
+}
+
+// processFollow stores follows created or deleted by viewers of personalized feeds
+func (p *PostProcessor) processFollow(event *jetstream_models.Event) error {
+	if p.viewers == nil || !p.viewers.contains(event.Did) {
+		return nil
+	}
+
+	uri := fmt.Sprintf("at://%s/%s/%s", event.Did, followCollection, event.Commit.RKey)
 
-	if err := p.db.CreatePost(p.context, post); err != nil {
-		log.WithError(err).Error("Failed to write post to database")
-		return fmt.Errorf("failed to create post in database: %w", err)
+	switch event.Commit.Operation {
+	case jetstream_models.CommitOperationCreate:
+		var record bsky.GraphFollow
+		if err := json.Unmarshal(event.Commit.Record, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal follow: %w", err)
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
+		if err != nil {
+			createdAt = time.Now()
+		}
+
+		if err := p.db.CreateFollow(p.context, norsky_models.Follow{
+			Uri:       uri,
+			Follower:  event.Did,
+			Subject:   record.Subject,
+			CreatedAt: createdAt.Unix(),
+		}); err != nil {
+			return fmt.Errorf("failed to create follow in database: %w", err)
+		}
+	case jetstream_models.CommitOperationDelete:
+		if err := p.db.DeleteFollow(p.context, uri); err != nil {
+			return fmt.Errorf("failed to delete follow in database: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// processBlock stores blocks created by or targeting viewers of personalized feeds
+func (p *PostProcessor) processBlock(event *jetstream_models.Event) error {
+	if p.viewers == nil {
+		return nil
+	}
+
+	uri := fmt.Sprintf("at://%s/%s/%s", event.Did, blockCollection, event.Commit.RKey)
+
+	switch event.Commit.Operation {
+	case jetstream_models.CommitOperationCreate:
+		var record bsky.GraphBlock
+		if err := json.Unmarshal(event.Commit.Record, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal block: %w", err)
+		}
+
+		// Blocks go both ways, keep those where either side is a viewer
+		if !p.viewers.contains(event.Did) && !p.viewers.contains(record.Subject) {
+			return nil
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
+		if err != nil {
+			createdAt = time.Now()
+		}
+
+		if err := p.db.CreateBlock(p.context, norsky_models.Block{
+			Uri:       uri,
+			Author:    event.Did,
+			Subject:   record.Subject,
+			CreatedAt: createdAt.Unix(),
+		}); err != nil {
+			return fmt.Errorf("failed to create block in database: %w", err)
+		}
+		p.viewers.addBlockAuthor(event.Did)
+	case jetstream_models.CommitOperationDelete:
+		// Deletes don't carry the record, so only go to the database for authors that may have blocks stored
+		if !p.viewers.hasBlocksBy(event.Did) {
+			return nil
+		}
+		if err := p.db.DeleteBlock(p.context, uri); err != nil {
+			return fmt.Errorf("failed to delete block in database: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// acceptedLanguage is the detected language of an accepted post, or its first tag in the target languages
+func (p *PostProcessor) acceptedLanguage(langs []string, detection *norsky_models.LanguageDetection) string {
+	if detection != nil && detection.Language != "" {
+		return detection.Language
+	}
+	if lang, ok := lo.Find(langs, func(lang string) bool { return lo.Contains(p.getTargetIsoCodes(), lang) }); ok {
+		return lang
+	}
+	return "unknown"
+}
+
 // Helper method to get ISO codes from target languages
 func (p *PostProcessor) getTargetIsoCodes() []string {
 	codes := make([]string, 0, len(p.targetLanguages))
@@ -183,14 +373,15 @@ func (p *PostProcessor) getTargetIsoCodes() []string {
 	return codes
 }
 
-// Rename to DetectLanguage since it's no longer Norwegian-specific
-func (p *PostProcessor) DetectLanguage(text string, currentLangs []string, targetLangs []lingua.Language) (bool, []string) {
+// DetectLanguage reports whether the text is written in one of the target languages, the languages
+// with the detected language added and the detection itself
+func (p *PostProcessor) DetectLanguage(text string, currentLangs []string, targetLangs []lingua.Language) (bool, []string, *norsky_models.LanguageDetection) {
 	// First check English confidence separately
 	englishConf := p.languageDetector.ComputeLanguageConfidence(text, lingua.English)
 
 	// If text is primarily English (high confidence), skip it unless English is a target language
 	if englishConf > 0.8 && !lo.Contains(targetLangs, lingua.English) {
-		return false, currentLangs
+		return false, currentLangs, nil
 	}
 
 	var highestConf float64
@@ -207,10 +398,10 @@ func (p *PostProcessor) DetectLanguage(text string, currentLangs []string, targe
 
 	// If confidence is too low, skip
 	if highestConf < p.config.ConfidenceThreshold {
-		return false, currentLangs
+		return false, currentLangs, nil
 	}
 
-	log.Infof("%s confidence: %.2f (threshold: %.2f)",
+	log.Debugf("%s confidence: %.2f (threshold: %.2f)",
 		detectedLang.String(), highestConf, p.config.ConfidenceThreshold)
 
 	// Create new slice to avoid modifying the input
@@ -223,7 +414,7 @@ func (p *PostProcessor) DetectLanguage(text string, currentLangs []string, targe
 		updatedLangs = append(updatedLangs, langCode)
 	}
 
-	return true, updatedLangs
+	return true, updatedLangs, &norsky_models.LanguageDetection{Language: langCode, Confidence: highestConf}
 }
 
 // Add this helper function at package level
@@ -0,0 +1,282 @@
+package firehose
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"norsky/db"
+	"norsky/sink"
+
+	jetstream_models "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recordings store raw Jetstream frames with the time they were received, so ingest can be replayed
+// offline. A recording starts with recordingMagic and a flags byte, followed by frames of
+// [received unix microseconds int64][message type uint8][length uint32][data], all big endian.
+const recordingMagic = "NORSKYREC1"
+
+// recordingCompressed flags recordings of zstd compressed Jetstream frames
+const recordingCompressed byte = 1
+
+// Frame is a raw Jetstream message and the time it was received
+type Frame struct {
+	Received time.Time
+	Message  *RawMessage
+}
+
+// RecordingWriter appends frames to a recording
+type RecordingWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// NewRecordingWriter writes the recording header, compressed tells whether frames are zstd compressed
+func NewRecordingWriter(w io.Writer, compressed bool) (*RecordingWriter, error) {
+	bw := bufio.NewWriter(w)
+
+	var flags byte
+	if compressed {
+		flags |= recordingCompressed
+	}
+	if _, err := bw.WriteString(recordingMagic); err != nil {
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+	if err := bw.WriteByte(flags); err != nil {
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	return &RecordingWriter{w: bw}, nil
+}
+
+func (r *RecordingWriter) WriteFrame(frame Frame) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var header [13]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(frame.Received.UnixMicro()))
+	header[8] = byte(frame.Message.MessageType)
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(frame.Message.Data)))
+
+	if _, err := r.w.Write(header[:]); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	if _, err := r.w.Write(frame.Message.Data); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// Flush writes buffered frames to the underlying writer
+func (r *RecordingWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// RecordingReader reads the frames of a recording in order
+type RecordingReader struct {
+	r          *bufio.Reader
+	compressed bool
+}
+
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(recordingMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read recording header: %w", err)
+	}
+	if string(header[:len(recordingMagic)]) != recordingMagic {
+		return nil, errors.New("not a norsky recording")
+	}
+
+	return &RecordingReader{
+		r:          br,
+		compressed: header[len(recordingMagic)]&recordingCompressed != 0,
+	}, nil
+}
+
+// Compressed reports whether the frames are zstd compressed
+func (r *RecordingReader) Compressed() bool {
+	return r.compressed
+}
+
+// Next returns the next frame, or io.EOF at the end of the recording
+func (r *RecordingReader) Next() (Frame, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Frame{}, fmt.Errorf("truncated frame header: %w", err)
+		}
+		return Frame{}, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[9:13]))
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Frame{}, fmt.Errorf("truncated frame: %w", err)
+	}
+
+	return Frame{
+		Received: time.UnixMicro(int64(binary.BigEndian.Uint64(header[0:8]))),
+		Message: &RawMessage{
+			MessageType: int(header[8]),
+			Data:        data,
+		},
+	}, nil
+}
+
+// Record writes raw frames from Jetstream to the recording until ctx is done. A Supervisor keeps the
+// connection alive like during ingest, frames repeated after resuming a connection are left out.
+func Record(ctx context.Context, config JetstreamConfig, w *RecordingWriter) (int, error) {
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(jetstream_models.ZSTDDictionary))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	defer decoder.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan *RawMessage, 1000)
+	progress := &progress{}
+	supervisor := newSupervisor(config, SupervisorConfig{}, queue, progress)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- supervisor.Run(ctx)
+	}()
+
+	frames := 0
+	write := func(msg *RawMessage) error {
+		timeUS, err := frameTimeUS(decoder, msg)
+		if err != nil {
+			log.Warnf("Recording frame without a time: %v", err)
+		} else if timeUS <= progress.cursor.Load() {
+			return nil
+		}
+		if err := w.WriteFrame(Frame{Received: time.Now(), Message: msg}); err != nil {
+			return err
+		}
+		progress.processed(timeUS)
+		frames++
+		return nil
+	}
+
+	for {
+		select {
+		case msg := <-queue:
+			if err := write(msg); err != nil {
+				cancel()
+				<-runErr
+				return frames, err
+			}
+		case err := <-runErr:
+			// Run returns nil once ctx is done, or an error when it can't connect at all.
+			// Nothing is sent to the queue after it returns.
+			for len(queue) > 0 {
+				if writeErr := write(<-queue); writeErr != nil {
+					return frames, writeErr
+				}
+			}
+			if flushErr := w.Flush(); err == nil {
+				err = flushErr
+			}
+			return frames, err
+		}
+	}
+}
+
+// frameTimeUS reads the time_us of the Jetstream event in a frame
+func frameTimeUS(decoder *zstd.Decoder, msg *RawMessage) (int64, error) {
+	data := msg.Data
+	if msg.MessageType == websocket.BinaryMessage {
+		var err error
+		if data, err = decoder.DecodeAll(msg.Data, nil); err != nil {
+			return 0, fmt.Errorf("failed to decompress frame: %w", err)
+		}
+	}
+
+	var event struct {
+		TimeUS int64 `json:"time_us"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal frame: %w", err)
+	}
+	return event.TimeUS, nil
+}
+
+// ReplayOptions controls the pace of a replay
+type ReplayOptions struct {
+	// Speed multiplies the recorded pace, 1 replays in real time and 10 ten times as fast.
+	// Zero replays as fast as the workers can process the frames.
+	Speed float64
+}
+
+// ReplayStats summarizes a replay, e.g. to benchmark ingest throughput
+type ReplayStats struct {
+	Frames   int
+	Duration time.Duration
+}
+
+// Replay feeds a recording through a ParallelProcessor into the sink, db may be nil.
+// It returns when every frame has been processed.
+func Replay(ctx context.Context, reader *RecordingReader, sink sink.PostSink, db *db.DB, config FirehoseConfig, opts ReplayOptions) (ReplayStats, error) {
+	config.JetstreamCompress = reader.Compressed()
+
+	pp := NewParallelProcessor(ctx, 10, 1000, db, sink, config)
+	pp.start()
+
+	start := time.Now()
+	var first time.Time
+	stats := ReplayStats{}
+
+	var err error
+	for {
+		var frame Frame
+		frame, err = reader.Next()
+		if err != nil {
+			break
+		}
+
+		if opts.Speed > 0 {
+			if first.IsZero() {
+				first = frame.Received
+			}
+			// Keep the recorded gaps between frames, scaled by the speed
+			due := start.Add(time.Duration(float64(frame.Received.Sub(first)) / opts.Speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case pp.workerQueue <- frame.Message:
+			stats.Frames++
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	pp.stop()
+	stats.Duration = time.Since(start)
+
+	if errors.Is(err, io.EOF) {
+		return stats, nil
+	}
+	return stats, err
+}
@@ -0,0 +1,342 @@
+package firehose_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"norsky/firehose"
+	"norsky/firehose/jetstreamtest"
+	"norsky/models"
+	"norsky/sink"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	jetstream_models "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectSink keeps every event it receives
+type collectSink struct {
+	mu     sync.Mutex
+	events []models.PostEvent
+}
+
+func (s *collectSink) Send(ctx context.Context, event models.PostEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *collectSink) Close() error {
+	return nil
+}
+
+func (s *collectSink) uris() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uris := make([]string, 0, len(s.events))
+	for _, event := range s.events {
+		uris = append(uris, event.EventPost().Uri)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+func postFrame(t testing.TB, rkey, text string, langs ...string) []byte {
+	t.Helper()
+	record, err := json.Marshal(bsky.FeedPost{
+		Text:      text,
+		Langs:     langs,
+		CreatedAt: "2025-02-01T12:00:00Z",
+	})
+	require.NoError(t, err)
+	data, err := json.Marshal(jetstream_models.Event{
+		Did:    "did:plc:test",
+		TimeUS: 1738411200000000,
+		Kind:   jetstream_models.EventKindCommit,
+		Commit: &jetstream_models.Commit{
+			Operation:  jetstream_models.CommitOperationCreate,
+			Collection: "app.bsky.feed.post",
+			RKey:       rkey,
+			Record:     record,
+		},
+	})
+	require.NoError(t, err)
+	return data
+}
+
+func deleteFrame(t testing.TB, rkey string) []byte {
+	t.Helper()
+	data, err := json.Marshal(jetstream_models.Event{
+		Did:    "did:plc:test",
+		TimeUS: 1738411200000000,
+		Kind:   jetstream_models.EventKindCommit,
+		Commit: &jetstream_models.Commit{
+			Operation:  jetstream_models.CommitOperationDelete,
+			Collection: "app.bsky.feed.post",
+			RKey:       rkey,
+		},
+	})
+	require.NoError(t, err)
+	return data
+}
+
+// testFrames is a small recording of Norwegian, English, spam and deleted posts
+func testFrames(t testing.TB) [][]byte {
+	return [][]byte{
+		postFrame(t, "norsk", "Dette er en helt vanlig norsk tekst om været", "nb"),
+		postFrame(t, "english", "This is a perfectly normal English text about the weather", "en"),
+		postFrame(t, "spam", "Dette er en helt vanlig norsk tekst, sjekk link in bio", "nb"),
+		postFrame(t, "short", "For kort", "nb"),
+		deleteFrame(t, "gammel"),
+	}
+}
+
+func writeRecording(t testing.TB, frames [][]byte, compressed bool, gap time.Duration) *bytes.Buffer {
+	t.Helper()
+	var encoder *zstd.Encoder
+	if compressed {
+		var err error
+		encoder, err = zstd.NewWriter(nil, zstd.WithEncoderDict(jetstream_models.ZSTDDictionary))
+		require.NoError(t, err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := firehose.NewRecordingWriter(buf, compressed)
+	require.NoError(t, err)
+
+	received := time.Date(2025, 2, 1, 12, 0, 0, 0, time.UTC)
+	for _, data := range frames {
+		messageType := websocket.TextMessage
+		if encoder != nil {
+			data = encoder.EncodeAll(data, nil)
+			messageType = websocket.BinaryMessage
+		}
+		require.NoError(t, w.WriteFrame(firehose.Frame{
+			Received: received,
+			Message:  &firehose.RawMessage{MessageType: messageType, Data: data},
+		}))
+		received = received.Add(gap)
+	}
+	require.NoError(t, w.Flush())
+	return buf
+}
+
+func replayConfig() firehose.FirehoseConfig {
+	return firehose.FirehoseConfig{
+		RunLanguageDetection: false,
+		Languages:            []string{"nb", "nn", "no"},
+	}
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	frames := testFrames(t)
+	buf := writeRecording(t, frames, false, time.Second)
+
+	reader, err := firehose.NewRecordingReader(buf)
+	require.NoError(t, err)
+	assert.False(t, reader.Compressed())
+
+	for i, data := range frames {
+		frame, err := reader.Next()
+		require.NoError(t, err)
+		assert.Equal(t, data, frame.Message.Data)
+		assert.Equal(t, websocket.TextMessage, frame.Message.MessageType)
+		assert.Equal(t, time.Date(2025, 2, 1, 12, 0, i, 0, time.UTC), frame.Received.UTC())
+	}
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRecordingRejectsOtherFiles(t *testing.T) {
+	_, err := firehose.NewRecordingReader(bytes.NewBufferString("{\"did\":\"did:plc:test\"}\n"))
+	assert.Error(t, err)
+}
+
+func TestRecordingTruncatedFrame(t *testing.T) {
+	buf := writeRecording(t, testFrames(t)[:1], false, 0)
+	truncated := bytes.NewBuffer(buf.Bytes()[:buf.Len()-5])
+
+	reader, err := firehose.NewRecordingReader(truncated)
+	require.NoError(t, err)
+	_, err = reader.Next()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestRecordReconnects(t *testing.T) {
+	events := cannedPosts()
+	server := jetstreamtest.NewServer(events[:2]...)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	buf := &bytes.Buffer{}
+	w, err := firehose.NewRecordingWriter(buf, false)
+	require.NoError(t, err)
+
+	recorded := make(chan int, 1)
+	go func() {
+		frames, err := firehose.Record(ctx, firehose.JetstreamConfig{Hosts: []string{server.URL}}, w)
+		assert.NoError(t, err)
+		recorded <- frames
+	}()
+
+	// The second connection resumes before the first two events, they are only recorded once
+	require.Eventually(t, func() bool { return server.Connections() == 1 }, 5*time.Second, 10*time.Millisecond)
+	server.Disconnect()
+	server.Publish(events[2])
+	require.Eventually(t, func() bool { return len(server.Requests()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 3, <-recorded)
+	reader, err := firehose.NewRecordingReader(buf)
+	require.NoError(t, err)
+	keys := []string{}
+	for {
+		frame, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		var event jetstream_models.Event
+		require.NoError(t, json.Unmarshal(frame.Message.Data, &event))
+		keys = append(keys, event.Commit.RKey)
+	}
+	assert.Equal(t, []string{"en", "to", "tre"}, keys)
+}
+
+func TestRecordFailsWithoutHosts(t *testing.T) {
+	w, err := firehose.NewRecordingWriter(&bytes.Buffer{}, false)
+	require.NoError(t, err)
+
+	_, err = firehose.Record(context.Background(), firehose.JetstreamConfig{}, w)
+	assert.ErrorContains(t, err, "no hosts")
+}
+
+func TestReplay(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed=%v", compressed), func(t *testing.T) {
+			reader, err := firehose.NewRecordingReader(writeRecording(t, testFrames(t), compressed, time.Second))
+			require.NoError(t, err)
+
+			sink := &collectSink{}
+			stats, err := firehose.Replay(context.Background(), reader, sink, nil, replayConfig(), firehose.ReplayOptions{})
+			require.NoError(t, err)
+
+			assert.Equal(t, 5, stats.Frames)
+			assert.Equal(t, []string{
+				"at://did:plc:test/app.bsky.feed.post/gammel",
+				"at://did:plc:test/app.bsky.feed.post/norsk",
+			}, sink.uris())
+		})
+	}
+}
+
+func TestReplayDropsDeletesOfUnknownPosts(t *testing.T) {
+	frames := append(testFrames(t), deleteFrame(t, "norsk"))
+	reader, err := firehose.NewRecordingReader(writeRecording(t, frames, false, time.Second))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	output := sink.NewKnownPostsFilter(sink.NewJSONSink(&out), sink.DefaultKnownPosts)
+	_, err = firehose.Replay(context.Background(), reader, output, nil, replayConfig(), firehose.ReplayOptions{})
+	require.NoError(t, err)
+
+	// The delete of "gammel", a post never written, produces no output
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"event":"create"`)
+	assert.Contains(t, lines[1], `"event":"delete"`)
+	assert.Contains(t, lines[1], "app.bsky.feed.post/norsk")
+	assert.NotContains(t, out.String(), "gammel")
+}
+
+// metricValue sums the samples of a counter or gauge with the given labels
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	total := 0.0
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metrics
+				}
+			}
+			total += metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+		}
+	}
+	return total
+}
+
+func TestReplayCountsIngestMetrics(t *testing.T) {
+	reader, err := firehose.NewRecordingReader(writeRecording(t, testFrames(t), false, time.Second))
+	require.NoError(t, err)
+
+	rejected := func(reason string) float64 {
+		return metricValue(t, "norsky_ingest_posts_rejected_total", map[string]string{"reason": reason})
+	}
+	accepted := metricValue(t, "norsky_ingest_posts_accepted_total", nil)
+	norwegian := metricValue(t, "norsky_posts_processed_total", map[string]string{"language": "nb"})
+	spam, short, language := rejected("spam"), rejected("word_count"), rejected("language")
+	deletes := metricValue(t, "norsky_ingest_events_total", map[string]string{"collection": "app.bsky.feed.post", "operation": "delete"})
+
+	_, err = firehose.Replay(context.Background(), reader, &collectSink{}, nil, replayConfig(), firehose.ReplayOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, accepted+1, metricValue(t, "norsky_ingest_posts_accepted_total", nil))
+	assert.Equal(t, norwegian+1, metricValue(t, "norsky_posts_processed_total", map[string]string{"language": "nb"}))
+	assert.Equal(t, spam+1, rejected("spam"))
+	assert.Equal(t, short+1, rejected("word_count"))
+	assert.Equal(t, language+1, rejected("language"))
+	assert.Equal(t, deletes+1, metricValue(t, "norsky_ingest_events_total", map[string]string{"collection": "app.bsky.feed.post", "operation": "delete"}))
+}
+
+func TestReplayKeepsRecordedPace(t *testing.T) {
+	// Four gaps of 100ms replayed twice as fast take at least 200ms
+	reader, err := firehose.NewRecordingReader(writeRecording(t, testFrames(t), false, 100*time.Millisecond))
+	require.NoError(t, err)
+
+	stats, err := firehose.Replay(context.Background(), reader, &collectSink{}, nil, replayConfig(), firehose.ReplayOptions{Speed: 2})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, stats.Duration, 200*time.Millisecond)
+	assert.Less(t, stats.Duration, 400*time.Millisecond)
+}
+
+func BenchmarkReplay(b *testing.B) {
+	frames := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		frames = append(frames, postFrame(b, fmt.Sprintf("post%d", i), "Dette er en helt vanlig norsk tekst om været i dag", "nb"))
+	}
+	recording := writeRecording(b, frames, false, 0).Bytes()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader, err := firehose.NewRecordingReader(bytes.NewReader(recording))
+		require.NoError(b, err)
+		if _, err := firehose.Replay(context.Background(), reader, &collectSink{}, nil, replayConfig(), firehose.ReplayOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(frames))/b.Elapsed().Seconds(), "frames/s")
+}
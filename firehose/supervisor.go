@@ -0,0 +1,316 @@
+package firehose
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	jetstreamReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_jetstream_reconnects_total",
+		Help: "The total number of Jetstream reconnects by reason",
+	}, []string{"reason"})
+
+	jetstreamConnectedHost = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "norsky_jetstream_connected_host",
+		Help: "1 for the Jetstream host the session is connected to",
+	}, []string{"host"})
+
+	jetstreamLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "norsky_jetstream_lag_seconds",
+		Help: "Time between now and the newest processed Jetstream event",
+	})
+)
+
+const (
+	// DefaultStallTimeout reconnects when Jetstream sends nothing for this long
+	DefaultStallTimeout = time.Minute
+
+	// resumeOverlap moves the resume cursor back to cover events still in the worker queue
+	resumeOverlap = 10 * time.Second
+
+	// How often the session checks for stalls and updates the lag metric
+	sessionCheckInterval = time.Second
+)
+
+// errStalled ends a session that received nothing within the stall timeout
+var errStalled = errors.New("jetstream session stalled")
+
+// SessionState is the connection state of a Supervisor
+type SessionState string
+
+const (
+	SessionConnecting SessionState = "connecting"
+	SessionConnected  SessionState = "connected"
+	SessionStopped    SessionState = "stopped"
+)
+
+// SessionStatus is a snapshot of the Jetstream session
+type SessionStatus struct {
+	State SessionState
+	// Host is the connected Jetstream host, empty while connecting
+	Host string
+	// Cursor is the time_us of the newest processed event, zero before the first one
+	Cursor int64
+	// Lag is the time between now and the newest processed event
+	Lag        time.Duration
+	Reconnects int
+	// ConnectedAt is when the current connection was made
+	ConnectedAt time.Time
+	// LastMessageAt is when the last message was received on any connection
+	LastMessageAt time.Time
+}
+
+// SupervisorConfig controls how a Supervisor detects dead connections
+type SupervisorConfig struct {
+	// StallTimeout reconnects to the next host when no message arrives for this long, defaults to DefaultStallTimeout
+	StallTimeout time.Duration
+	// PingInterval is the time between keepalive pings
+	PingInterval time.Duration
+	// ReadTimeout closes the connection when no pong or ping arrives for this long
+	ReadTimeout time.Duration
+}
+
+// progress tracks the newest Jetstream event processed by the workers
+type progress struct {
+	cursor atomic.Int64
+}
+
+func (p *progress) processed(timeUS int64) {
+	for {
+		current := p.cursor.Load()
+		if timeUS <= current {
+			return
+		}
+		if p.cursor.CompareAndSwap(current, timeUS) {
+			ingestLastEvent.Set(float64(timeUS) / 1e6)
+			return
+		}
+	}
+}
+
+// Supervisor owns the Jetstream connection. It reconnects on read errors and stalls with backoff and
+// host failover, and resumes from the newest event processed by the workers.
+type Supervisor struct {
+	config   JetstreamConfig
+	settings SupervisorConfig
+	queue    chan<- *RawMessage
+	progress *progress
+
+	// lastMessage is the unix nano time of the last message, or of the last time the queue accepted one
+	lastMessage atomic.Int64
+	// waiting is set while the reader is blocked on a full worker queue, which is not a stall
+	waiting atomic.Bool
+
+	mu          sync.Mutex
+	state       SessionState
+	host        string
+	reconnects  int
+	connectedAt time.Time
+}
+
+func newSupervisor(config JetstreamConfig, settings SupervisorConfig, queue chan<- *RawMessage, progress *progress) *Supervisor {
+	if settings.StallTimeout <= 0 {
+		settings.StallTimeout = DefaultStallTimeout
+	}
+	if settings.PingInterval <= 0 {
+		settings.PingInterval = wsPingInterval
+	}
+	if settings.ReadTimeout <= 0 {
+		settings.ReadTimeout = wsReadTimeout
+	}
+	return &Supervisor{
+		config:   config,
+		settings: settings,
+		queue:    queue,
+		progress: progress,
+		state:    SessionConnecting,
+	}
+}
+
+// Status returns the current state of the session
+func (s *Supervisor) Status() SessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SessionStatus{
+		State:       s.state,
+		Host:        s.host,
+		Cursor:      s.progress.cursor.Load(),
+		Reconnects:  s.reconnects,
+		ConnectedAt: s.connectedAt,
+	}
+	if status.Cursor > 0 {
+		status.Lag = time.Since(time.UnixMicro(status.Cursor))
+	}
+	if last := s.lastMessage.Load(); last > 0 {
+		status.LastMessageAt = time.Unix(0, last)
+	}
+	return status
+}
+
+// Run connects and keeps reconnecting until ctx is done. Nothing is sent to the queue after it returns.
+func (s *Supervisor) Run(ctx context.Context) error {
+	defer s.setState(SessionStopped, "")
+
+	backoff := newJetstreamBackOff()
+	hostIdx := 0
+	for {
+		config := s.config
+		if cursor := s.resumeCursor(); cursor != 0 {
+			config.Cursor = cursor
+		}
+
+		s.setState(SessionConnecting, "")
+		conn, connectedIdx, err := connectJetstream(ctx, config, hostIdx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		hostIdx = connectedIdx
+		host := config.Hosts[hostIdx]
+		s.setState(SessionConnected, host)
+
+		log.WithFields(log.Fields{
+			"host":   host,
+			"cursor": config.Cursor,
+		}).Info("Connected to Jetstream")
+
+		received, err := s.session(ctx, conn)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		reason := "error"
+		if errors.Is(err, errStalled) {
+			// The host accepts connections but sends nothing, try another one
+			reason = "stall"
+			hostIdx = (hostIdx + 1) % len(config.Hosts)
+		}
+		jetstreamReconnects.WithLabelValues(reason).Inc()
+		s.mu.Lock()
+		s.reconnects++
+		s.mu.Unlock()
+
+		log.WithFields(log.Fields{
+			"host":   host,
+			"reason": reason,
+		}).Warnf("Jetstream session ended, reconnecting: %v", err)
+
+		// Back off when connections keep dying before delivering anything
+		if received {
+			backoff.Reset()
+			continue
+		}
+		if err := backOffWait(ctx, backoff.NextBackOff()); err != nil {
+			return nil
+		}
+	}
+}
+
+// resumeCursor continues a little before the newest processed event, or from the configured cursor
+func (s *Supervisor) resumeCursor() int64 {
+	if cursor := s.progress.cursor.Load(); cursor > 0 {
+		return cursor - resumeOverlap.Microseconds()
+	}
+	return s.config.Cursor
+}
+
+func (s *Supervisor) setState(state SessionState, host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.host != "" {
+		jetstreamConnectedHost.WithLabelValues(s.host).Set(0)
+	}
+	s.connectedAt = time.Time{}
+	if host != "" {
+		jetstreamConnectedHost.WithLabelValues(host).Set(1)
+		s.connectedAt = time.Now()
+	}
+	s.state = state
+	s.host = host
+}
+
+// session reads messages into the queue until the connection fails, stalls or ctx is done.
+// It reports whether any message was received.
+func (s *Supervisor) session(ctx context.Context, conn *websocket.Conn) (bool, error) {
+	sessionCtx, cancel := context.WithCancel(ctx)
+
+	wsCurrentConnections.Inc()
+	connStart := time.Now()
+	defer func() {
+		wsConnectionDuration.Observe(time.Since(connStart).Seconds())
+		wsCurrentConnections.Dec()
+	}()
+
+	pingSent := &atomic.Int64{}
+	setupConnectionHandlers(conn, s.settings.ReadTimeout, pingSent)
+	go managePingPong(sessionCtx, conn, s.settings.PingInterval, pingSent)
+
+	s.lastMessage.Store(time.Now().UnixNano())
+	var received atomic.Bool
+	readErr := make(chan error, 1)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					log.Errorf("Unexpected websocket close: %v", err)
+				}
+				wsConnectionErrors.Inc()
+				readErr <- err
+				return
+			}
+			received.Store(true)
+			s.lastMessage.Store(time.Now().UnixNano())
+
+			s.waiting.Store(true)
+			select {
+			case s.queue <- &RawMessage{MessageType: messageType, Data: message}:
+				s.waiting.Store(false)
+				s.lastMessage.Store(time.Now().UnixNano())
+			case <-sessionCtx.Done():
+				s.waiting.Store(false)
+				return
+			}
+		}
+	}()
+
+	// Stop the reader and wait for it, so nothing is sent to the queue after the session
+	stop := func(err error) (bool, error) {
+		cancel()
+		conn.Close()
+		<-readerDone
+		return received.Load(), err
+	}
+
+	ticker := time.NewTicker(min(sessionCheckInterval, s.settings.StallTimeout/2))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return stop(ctx.Err())
+		case err := <-readErr:
+			return stop(err)
+		case <-ticker.C:
+			jetstreamLag.Set(s.Status().Lag.Seconds())
+			idle := time.Since(time.Unix(0, s.lastMessage.Load()))
+			if !s.waiting.Load() && idle > s.settings.StallTimeout {
+				return stop(errStalled)
+			}
+		}
+	}
+}
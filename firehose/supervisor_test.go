@@ -0,0 +1,116 @@
+package firehose_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"norsky/firehose"
+	"norsky/firehose/jetstreamtest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func subscribeConfig(session firehose.SupervisorConfig, hosts ...string) firehose.FirehoseConfig {
+	config := replayConfig()
+	config.JetstreamHosts = hosts
+	config.Session = session
+	return config
+}
+
+// hasPosts reports whether the sink received all the posts, duplicates from resuming are fine
+func hasPosts(sink *collectSink, rkeys ...string) bool {
+	received := map[string]bool{}
+	for _, uri := range sink.uris() {
+		received[uri] = true
+	}
+	for _, rkey := range rkeys {
+		if !received["at://"+testDid+"/app.bsky.feed.post/"+rkey] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSupervisorResumesFromProcessedCursor(t *testing.T) {
+	events := cannedPosts()
+	server := jetstreamtest.NewServer(events[:2]...)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &collectSink{}
+	subscription := firehose.Subscribe(ctx, sink, nil, subscribeConfig(firehose.SupervisorConfig{}, server.URL))
+	require.Eventually(t, func() bool { return hasPosts(sink, "en", "to") }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, events[1].TimeUS, subscription.Status().Cursor)
+
+	// Drop the connection, the supervisor reconnects a little before the newest processed event
+	server.Disconnect()
+	server.Publish(events[2])
+
+	require.Eventually(t, func() bool { return hasPosts(sink, "tre") }, 5*time.Second, 10*time.Millisecond)
+	requests := server.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, int64(0), requests[0].Cursor)
+	assert.Equal(t, events[1].TimeUS-(10*time.Second).Microseconds(), requests[1].Cursor)
+
+	status := subscription.Status()
+	assert.Equal(t, firehose.SessionConnected, status.State)
+	assert.Equal(t, server.URL, status.Host)
+	assert.Equal(t, 1, status.Reconnects)
+	assert.Equal(t, events[2].TimeUS, status.Cursor)
+
+	cancel()
+	subscription.Wait()
+	assert.Equal(t, firehose.SessionStopped, subscription.Status().State)
+}
+
+func TestSupervisorFailsOverWhenHostStalls(t *testing.T) {
+	silent := jetstreamtest.NewServer()
+	defer silent.Close()
+
+	live := jetstreamtest.NewServer(cannedPosts()...)
+	defer live.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &collectSink{}
+	subscription := firehose.Subscribe(ctx, sink, nil, subscribeConfig(firehose.SupervisorConfig{
+		StallTimeout: 200 * time.Millisecond,
+	}, silent.URL, live.URL))
+
+	require.Eventually(t, func() bool { return hasPosts(sink, "en", "to", "tre") }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, silent.Requests(), 1)
+	assert.GreaterOrEqual(t, subscription.Status().Reconnects, 1)
+
+	cancel()
+	subscription.Wait()
+}
+
+func TestSupervisorReconnectsWhenPongsAreLate(t *testing.T) {
+	server := jetstreamtest.NewServer(cannedPosts()...)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session := firehose.SupervisorConfig{
+		PingInterval: 50 * time.Millisecond,
+		ReadTimeout:  200 * time.Millisecond,
+	}
+	subscription := firehose.Subscribe(ctx, &collectSink{}, nil, subscribeConfig(session, server.URL))
+
+	// Timely pongs keep the connection alive
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, 0, subscription.Status().Reconnects)
+
+	server.SetPongDelay(time.Second)
+	server.Disconnect()
+	require.Eventually(t, func() bool { return subscription.Status().Reconnects >= 2 }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	subscription.Wait()
+}
@@ -0,0 +1,90 @@
+package firehose
+
+import (
+	"context"
+	"norsky/db"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const viewerRefreshInterval = time.Minute
+
+// viewerSet is an in-memory copy of the viewers table and the authors of stored blocks,
+// so graph events from accounts that never used our feeds can be dropped without a database round trip
+type viewerSet struct {
+	mu           sync.RWMutex
+	viewers      map[string]struct{}
+	blockAuthors map[string]struct{}
+}
+
+func newViewerSet() *viewerSet {
+	return &viewerSet{
+		viewers:      make(map[string]struct{}),
+		blockAuthors: make(map[string]struct{}),
+	}
+}
+
+func (s *viewerSet) contains(did string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.viewers[did]
+	return ok
+}
+
+// hasBlocksBy reports whether blocks created by the account may be stored, only their deletes need the database
+func (s *viewerSet) hasBlocksBy(did string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, viewer := s.viewers[did]
+	_, author := s.blockAuthors[did]
+	return viewer || author
+}
+
+// addBlockAuthor remembers a stored block until the next refresh loads it from the database
+func (s *viewerSet) addBlockAuthor(did string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blockAuthors[did] = struct{}{}
+}
+
+// refresh reloads the viewers and block authors from the database until the context is cancelled
+func (s *viewerSet) refresh(ctx context.Context, db *db.DB) {
+	ticker := time.NewTicker(viewerRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if dids, err := db.GetViewers(ctx); err != nil {
+			log.WithError(err).Error("Failed to refresh viewers")
+		} else {
+			viewers := toSet(dids)
+			s.mu.Lock()
+			s.viewers = viewers
+			s.mu.Unlock()
+		}
+
+		if dids, err := db.GetBlockAuthors(ctx); err != nil {
+			log.WithError(err).Error("Failed to refresh block authors")
+		} else {
+			blockAuthors := toSet(dids)
+			s.mu.Lock()
+			s.blockAuthors = blockAuthors
+			s.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func toSet(dids []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(dids))
+	for _, did := range dids {
+		set[did] = struct{}{}
+	}
+	return set
+}
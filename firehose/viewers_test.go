@@ -0,0 +1,37 @@
+package firehose_test
+
+import (
+	"norsky/firehose"
+	"testing"
+
+	jetstream_models "github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+const viewerDid = "did:plc:viewer"
+
+func blockDelete(did string) jetstream_models.Event {
+	return jetstream_models.Event{
+		Did:    did,
+		TimeUS: 1738411200000000,
+		Kind:   jetstream_models.EventKindCommit,
+		Commit: &jetstream_models.Commit{
+			Operation:  jetstream_models.CommitOperationDelete,
+			Collection: "app.bsky.graph.block",
+			RKey:       "3kblock",
+		},
+	}
+}
+
+func TestBlockDeletesOfOtherAccountsSkipTheDatabase(t *testing.T) {
+	assert.NotPanics(t, func() {
+		assert.NoError(t, firehose.ProcessBlockWithoutDatabase([]string{viewerDid}, blockDelete(testDid)))
+	})
+}
+
+func TestBlockDeletesOfViewersReachTheDatabase(t *testing.T) {
+	// The processor has no database, reaching for it is the delete being stored
+	assert.Panics(t, func() {
+		firehose.ProcessBlockWithoutDatabase([]string{viewerDid}, blockDelete(viewerDid))
+	})
+}
@@ -0,0 +1,220 @@
+// Package maintenance runs periodic database maintenance jobs inside the serve process
+package maintenance
+
+import (
+	"context"
+	"norsky/db"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_maintenance_runs_total",
+		Help: "Number of maintenance job runs by job and result (success, error, skipped)",
+	}, []string{"job", "result"})
+
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "norsky_maintenance_duration_seconds",
+		Help:    "Duration of maintenance job runs",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 8), // 100ms up to ~30 minutes
+	}, []string{"job"})
+
+	jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "norsky_maintenance_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful run of a maintenance job",
+	}, []string{"job"})
+
+	jobRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "norsky_maintenance_running",
+		Help: "Whether this process is currently running a maintenance job",
+	}, []string{"job"})
+
+	postsDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_maintenance_posts_deleted_total",
+		Help: "Number of posts deleted by retention, by retention rule",
+	}, []string{"rule"})
+
+	seenPostsDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "norsky_maintenance_seen_posts_deleted_total",
+		Help: "Number of expired seen post records deleted",
+	})
+)
+
+// Job is a maintenance task run on a fixed interval
+type Job struct {
+	Name     string
+	Interval time.Duration
+	// Exclusive jobs only run on the replica holding the job's advisory lock
+	Exclusive bool
+	Run       func(ctx context.Context) error
+}
+
+// Scheduler runs maintenance jobs until its context is cancelled
+type Scheduler struct {
+	db   *db.DB
+	jobs []Job
+}
+
+func NewScheduler(db *db.DB) *Scheduler {
+	return &Scheduler{db: db}
+}
+
+// Add registers a job, jobs with a zero interval are disabled and ignored
+func (s *Scheduler) Add(job Job) {
+	if job.Interval <= 0 {
+		log.WithField("job", job.Name).Info("Maintenance job disabled")
+		return
+	}
+	s.jobs = append(s.jobs, job)
+}
+
+// Start runs each job in its own goroutine, the first run happens after one interval
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, job := range s.jobs {
+		log.WithFields(log.Fields{
+			"job":      job.Name,
+			"interval": job.Interval,
+		}).Info("Scheduling maintenance job")
+		go s.loop(ctx, job)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.run(ctx, job)
+		}
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, job Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic in maintenance job %s: %v", job.Name, r)
+			jobRuns.WithLabelValues(job.Name, "error").Inc()
+		}
+	}()
+
+	timed := func(ctx context.Context) error {
+		jobRunning.WithLabelValues(job.Name).Set(1)
+		defer jobRunning.WithLabelValues(job.Name).Set(0)
+
+		start := time.Now()
+		err := job.Run(ctx)
+		jobDuration.WithLabelValues(job.Name).Observe(time.Since(start).Seconds())
+		return err
+	}
+
+	var err error
+	ran := true
+	if job.Exclusive {
+		ran, err = s.db.WithAdvisoryLock(ctx, "norsky:maintenance:"+job.Name, timed)
+	} else {
+		err = timed(ctx)
+	}
+
+	switch {
+	case err != nil:
+		log.WithError(err).WithField("job", job.Name).Error("Maintenance job failed")
+		jobRuns.WithLabelValues(job.Name, "error").Inc()
+	case !ran:
+		log.WithField("job", job.Name).Debug("Maintenance job running on another replica, skipping")
+		jobRuns.WithLabelValues(job.Name, "skipped").Inc()
+	default:
+		log.WithField("job", job.Name).Info("Maintenance job completed")
+		jobRuns.WithLabelValues(job.Name, "success").Inc()
+		jobLastSuccess.WithLabelValues(job.Name).SetToCurrentTime()
+	}
+}
+
+// RetentionJob removes posts older than their retention
+func RetentionJob(database *db.DB, opts db.TidyOptions, interval time.Duration) Job {
+	return Job{
+		Name:      "retention",
+		Interval:  interval,
+		Exclusive: true,
+		Run: func(ctx context.Context) error {
+			results, err := database.Tidy(ctx, opts)
+			for _, result := range results {
+				postsDeleted.WithLabelValues(result.Rule).Add(float64(result.Posts))
+			}
+			return err
+		},
+	}
+}
+
+// VacuumJob reclaims space and refreshes planner statistics for tables with a lot of churn
+func VacuumJob(database *db.DB, interval time.Duration) Job {
+	return Job{
+		Name:      "vacuum",
+		Interval:  interval,
+		Exclusive: true,
+		Run: func(ctx context.Context) error {
+			return database.VacuumAnalyze(ctx, "posts", "interactions", "seen_posts")
+		},
+	}
+}
+
+// RefreshViewsJob refreshes materialized views used by the dashboard
+func RefreshViewsJob(database *db.DB, interval time.Duration) Job {
+	return Job{
+		Name:      "refresh_views",
+		Interval:  interval,
+		Exclusive: true,
+		Run: func(ctx context.Context) error {
+			views, err := database.RefreshMaterializedViews(ctx)
+			log.WithField("views", views).Debug("Refreshed materialized views")
+			return err
+		},
+	}
+}
+
+// SeenPostsJob expires seen post records of personalized feeds
+func SeenPostsJob(database *db.DB, interval time.Duration) Job {
+	return Job{
+		Name:      "seen_posts",
+		Interval:  interval,
+		Exclusive: true,
+		Run: func(ctx context.Context) error {
+			removed, err := database.TidySeenPosts(ctx)
+			seenPostsDeleted.Add(float64(removed))
+			return err
+		},
+	}
+}
+
+// PartitionsJob creates upcoming posts partitions so new posts never land in the default partition
+func PartitionsJob(database *db.DB, partitionInterval db.PartitionInterval, ahead int, interval time.Duration) Job {
+	return Job{
+		Name:      "partitions",
+		Interval:  interval,
+		Exclusive: true,
+		Run: func(ctx context.Context) error {
+			created, err := database.EnsurePostPartitions(ctx, partitionInterval, ahead)
+			log.WithField("partitions", created).Debug("Ensured posts partitions")
+			return err
+		},
+	}
+}
+
+// StatsRollupJob updates the hourly dashboard statistics of all posts and each feed
+func StatsRollupJob(database *db.DB, feeds []db.StatsFeed, lookback time.Duration, interval time.Duration) Job {
+	return Job{
+		Name:      "stats_rollup",
+		Interval:  interval,
+		Exclusive: true,
+		Run: func(ctx context.Context) error {
+			return database.RollupFeedStats(ctx, feeds, lookback)
+		},
+	}
+}
@@ -13,28 +13,72 @@ type Post struct {
 	Author    string   `json:"author"`
 }
 
-// Omit all but the Uri field
+// Omit all but the Uri and FeedContext fields
 type FeedPost struct {
-	Id    int64   `json:"-"`
-	Uri   string  `json:"post"`
-	Score float64 `json:"-"`
+	Id          int64   `json:"-"`
+	Uri         string  `json:"post"`
+	Score       float64 `json:"-"`
+	FeedContext string  `json:"feedContext,omitempty"`
+}
+
+// Interaction is a piece of feedback sent by a client via sendInteractions
+type Interaction struct {
+	Feed    string `json:"feed"`
+	PostUri string `json:"item"`
+	UserDid string `json:"userDid"`
+	Event   string `json:"event"`
+}
+
+// Follow is an app.bsky.graph.follow record of a viewer
+type Follow struct {
+	Uri       string `json:"uri,omitempty"`
+	Follower  string `json:"follower"`
+	Subject   string `json:"subject"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// Block is an app.bsky.graph.block record created by or targeting a viewer
+type Block struct {
+	Uri       string `json:"uri"`
+	Author    string `json:"author"`
+	Subject   string `json:"subject"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// PostEvent is a CreatePostEvent, UpdatePostEvent or DeletePostEvent
+type PostEvent interface {
+	EventPost() Post
+}
+
+// LanguageDetection is the language detected in a post's text and the detector's confidence
+type LanguageDetection struct {
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
 }
 
 // CreateEvent fired when a new post is created
 type CreatePostEvent struct {
 	Post Post
+	// Detection is set when the post was accepted by language detection
+	Detection *LanguageDetection
 }
 
+func (e CreatePostEvent) EventPost() Post { return e.Post }
+
 // UpdateEvent fired when a post is updated
 type UpdatePostEvent struct {
 	Post Post
 }
 
-// DeleteEvent fired when a post is deleted
+func (e UpdatePostEvent) EventPost() Post { return e.Post }
+
+// DeleteEvent fired when a post is deleted, only the Uri and Author are known
 type DeletePostEvent struct {
 	Post Post
 }
 
+func (e DeletePostEvent) EventPost() Post { return e.Post }
+
 type FeedResponse struct {
 	Feed   []FeedPost `json:"feed"`
 	Cursor *string    `json:"cursor,omitempty"`
@@ -44,3 +88,35 @@ type PostsAggregatedByTime struct {
 	Time  time.Time `json:"time"`
 	Count int64     `json:"count"`
 }
+
+// FeedVolume is the number of posts and replies in a feed in a time bucket
+type FeedVolume struct {
+	Time    time.Time `json:"time"`
+	Posts   int64     `json:"posts"`
+	Replies int64     `json:"replies"`
+}
+
+// AuthorCount is the number of posts by an author
+type AuthorCount struct {
+	Author string `json:"author"`
+	Posts  int64  `json:"posts"`
+}
+
+// HashtagCount is the number of posts with a hashtag, the tag is lowercase and without the #
+type HashtagCount struct {
+	Tag   string `json:"tag"`
+	Posts int64  `json:"posts"`
+}
+
+// LanguageCount is the number of posts in a language
+type LanguageCount struct {
+	Language string `json:"language"`
+	Posts    int64  `json:"posts"`
+}
+
+// ReplyRatio is the share of posts that are replies
+type ReplyRatio struct {
+	Posts   int64   `json:"posts"`
+	Replies int64   `json:"replies"`
+	Ratio   float64 `json:"ratio"`
+}
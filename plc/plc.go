@@ -0,0 +1,304 @@
+// Package plc creates and updates did:plc identities of the feed generator in a PLC directory
+package plc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	atdata "github.com/bluesky-social/indigo/atproto/data"
+)
+
+// DefaultDirectory is the public PLC directory
+const DefaultDirectory = "https://plc.directory"
+
+// The service entry Bluesky looks up to find the feed generator of a DID
+const (
+	FeedGeneratorService     = "bsky_fg"
+	FeedGeneratorServiceType = "BskyFeedGenerator"
+)
+
+// ErrNotFound is returned for DIDs the directory doesn't know
+var ErrNotFound = errors.New("DID not found in PLC directory")
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Service is an endpoint in a DID document
+type Service struct {
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+}
+
+// Operation is a signed change to a did:plc document, the first operation of a DID has no Prev
+type Operation struct {
+	Type                string             `json:"type"`
+	RotationKeys        []string           `json:"rotationKeys"`
+	VerificationMethods map[string]string  `json:"verificationMethods"`
+	AlsoKnownAs         []string           `json:"alsoKnownAs"`
+	Services            map[string]Service `json:"services"`
+	Prev                *string            `json:"prev"`
+	Sig                 string             `json:"sig,omitempty"`
+}
+
+// Client reads and submits the operations of did:plc identities. DirectoryClient talks to a PLC
+// directory over HTTP, tests can point it at plctest.Server.
+type Client interface {
+	// LastOperation returns the current operation of a DID, or ErrNotFound
+	LastOperation(ctx context.Context, did string) (*Operation, error)
+	// Submit appends a signed operation to the log of a DID, creating the DID on its first operation
+	Submit(ctx context.Context, did string, op *Operation) error
+}
+
+// cbor encodes the operation as DAG-CBOR, without the signature when unsigned is set
+func (op *Operation) cbor(unsigned bool) ([]byte, error) {
+	strs := func(values []string) []any {
+		out := make([]any, len(values))
+		for i, v := range values {
+			out[i] = v
+		}
+		return out
+	}
+
+	verificationMethods := make(map[string]any, len(op.VerificationMethods))
+	for id, key := range op.VerificationMethods {
+		verificationMethods[id] = key
+	}
+	services := make(map[string]any, len(op.Services))
+	for id, service := range op.Services {
+		services[id] = map[string]any{"type": service.Type, "endpoint": service.Endpoint}
+	}
+
+	obj := map[string]any{
+		"type":                op.Type,
+		"rotationKeys":        strs(op.RotationKeys),
+		"verificationMethods": verificationMethods,
+		"alsoKnownAs":         strs(op.AlsoKnownAs),
+		"services":            services,
+		"prev":                nil,
+	}
+	if op.Prev != nil {
+		obj["prev"] = *op.Prev
+	}
+	if !unsigned {
+		obj["sig"] = op.Sig
+	}
+	return atdata.MarshalCBOR(obj)
+}
+
+// Sign sets the signature of the operation, the key must be one of the rotation keys of the DID
+func (op *Operation) Sign(key crypto.PrivateKey) error {
+	data, err := op.cbor(true)
+	if err != nil {
+		return fmt.Errorf("failed to encode operation: %w", err)
+	}
+	sig, err := key.HashAndSign(data)
+	if err != nil {
+		return fmt.Errorf("failed to sign operation: %w", err)
+	}
+	op.Sig = base64.RawURLEncoding.EncodeToString(sig)
+	return nil
+}
+
+// Verify checks that the operation is signed by one of the rotation keys
+func (op *Operation) Verify(rotationKeys []string) error {
+	sig, err := base64.RawURLEncoding.DecodeString(op.Sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	data, err := op.cbor(true)
+	if err != nil {
+		return fmt.Errorf("failed to encode operation: %w", err)
+	}
+
+	for _, didKey := range rotationKeys {
+		pub, err := crypto.ParsePublicDIDKey(didKey)
+		if err != nil {
+			continue
+		}
+		if pub.HashAndVerify(data, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("operation is not signed by a rotation key")
+}
+
+// CID is the content identifier of the signed operation, the Prev of the operation after it
+func (op *Operation) CID() (string, error) {
+	data, err := op.cbor(false)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode operation: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	// CIDv1, dag-cbor codec, sha2-256 multihash, as base32 multibase
+	raw := append([]byte{0x01, 0x71, 0x12, 0x20}, sum[:]...)
+	return "b" + base32Lower.EncodeToString(raw), nil
+}
+
+// DID is the did:plc created by the signed operation when it is the first of the DID
+func (op *Operation) DID() (string, error) {
+	data, err := op.cbor(false)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode operation: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return "did:plc:" + base32Lower.EncodeToString(sum[:])[:24], nil
+}
+
+// CreateFeedGenerator registers a new did:plc whose #bsky_fg service is the endpoint, e.g.
+// https://<hostname>. The rotation key is the only key able to update the DID later.
+func CreateFeedGenerator(ctx context.Context, client Client, key crypto.PrivateKey, endpoint string) (string, error) {
+	pub, err := key.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("invalid rotation key: %w", err)
+	}
+
+	op := &Operation{
+		Type:                "plc_operation",
+		RotationKeys:        []string{pub.DIDKey()},
+		VerificationMethods: map[string]string{},
+		AlsoKnownAs:         []string{},
+		Services: map[string]Service{
+			FeedGeneratorService: {Type: FeedGeneratorServiceType, Endpoint: endpoint},
+		},
+	}
+	if err := op.Sign(key); err != nil {
+		return "", err
+	}
+	did, err := op.DID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := client.Submit(ctx, did, op); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", did, err)
+	}
+	return did, nil
+}
+
+// SetFeedGeneratorEndpoint points the #bsky_fg service of an existing did:plc at the endpoint, keeping
+// the rest of the document. It reports false without submitting when the endpoint is already set.
+func SetFeedGeneratorEndpoint(ctx context.Context, client Client, key crypto.PrivateKey, did string, endpoint string) (bool, error) {
+	pub, err := key.PublicKey()
+	if err != nil {
+		return false, fmt.Errorf("invalid rotation key: %w", err)
+	}
+
+	last, err := client.LastOperation(ctx, did)
+	if err != nil {
+		return false, fmt.Errorf("failed to get %s: %w", did, err)
+	}
+	if last.Type != "plc_operation" {
+		return false, fmt.Errorf("unsupported %s operation of %s, only plc_operation can be updated", last.Type, did)
+	}
+	if !slices.Contains(last.RotationKeys, pub.DIDKey()) {
+		return false, fmt.Errorf("%s is not a rotation key of %s", pub.DIDKey(), did)
+	}
+
+	want := Service{Type: FeedGeneratorServiceType, Endpoint: endpoint}
+	if last.Services[FeedGeneratorService] == want {
+		return false, nil
+	}
+
+	prev, err := last.CID()
+	if err != nil {
+		return false, err
+	}
+	op := *last
+	op.Services = make(map[string]Service, len(last.Services)+1)
+	for id, service := range last.Services {
+		op.Services[id] = service
+	}
+	op.Services[FeedGeneratorService] = want
+	op.Prev = &prev
+	if err := op.Sign(key); err != nil {
+		return false, err
+	}
+
+	if err := client.Submit(ctx, did, &op); err != nil {
+		return false, fmt.Errorf("failed to update %s: %w", did, err)
+	}
+	return true, nil
+}
+
+// DirectoryClient is a Client for a PLC directory such as DefaultDirectory
+type DirectoryClient struct {
+	host string
+	http *http.Client
+}
+
+func NewDirectoryClient(host string) *DirectoryClient {
+	return &DirectoryClient{
+		host: strings.TrimSuffix(host, "/"),
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *DirectoryClient) LastOperation(ctx context.Context, did string) (*Operation, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+"/"+did+"/log/last", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var op Operation
+	if err := json.NewDecoder(resp.Body).Decode(&op); err != nil {
+		return nil, fmt.Errorf("failed to decode operation: %w", err)
+	}
+	return &op, nil
+}
+
+func (c *DirectoryClient) Submit(ctx context.Context, did string, op *Operation) error {
+	body, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host+"/"+did, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// responseError includes the message of a failed directory request, which explains rejected operations
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &msg) == nil && msg.Message != "" {
+		return fmt.Errorf("PLC directory returned %s: %s", resp.Status, msg.Message)
+	}
+	return fmt.Errorf("PLC directory returned %s", resp.Status)
+}
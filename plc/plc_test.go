@@ -0,0 +1,114 @@
+package plc_test
+
+import (
+	"context"
+	"norsky/plc"
+	"norsky/plc/plctest"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(t *testing.T) crypto.PrivateKey {
+	t.Helper()
+
+	key, err := crypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	return key
+}
+
+func TestCreateFeedGenerator(t *testing.T) {
+	directory := plctest.NewServer()
+	defer directory.Close()
+	client := plc.NewDirectoryClient(directory.URL)
+	key := newKey(t)
+
+	did, err := plc.CreateFeedGenerator(context.Background(), client, key, "https://norsky.example.com")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(did, "did:plc:"))
+	assert.Len(t, strings.TrimPrefix(did, "did:plc:"), 24)
+
+	op, err := client.LastOperation(context.Background(), did)
+	require.NoError(t, err)
+	pub, err := key.PublicKey()
+	require.NoError(t, err)
+	assert.Equal(t, []string{pub.DIDKey()}, op.RotationKeys)
+	assert.Equal(t, plc.Service{Type: "BskyFeedGenerator", Endpoint: "https://norsky.example.com"}, op.Services["bsky_fg"])
+	assert.Nil(t, op.Prev)
+}
+
+func TestSetFeedGeneratorEndpoint(t *testing.T) {
+	directory := plctest.NewServer()
+	defer directory.Close()
+	client := plc.NewDirectoryClient(directory.URL)
+	key := newKey(t)
+	ctx := context.Background()
+
+	did, err := plc.CreateFeedGenerator(ctx, client, key, "https://old.example.com")
+	require.NoError(t, err)
+
+	changed, err := plc.SetFeedGeneratorEndpoint(ctx, client, key, did, "https://new.example.com")
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	// Setting the same endpoint again doesn't submit an operation
+	changed, err = plc.SetFeedGeneratorEndpoint(ctx, client, key, did, "https://new.example.com")
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	ops := directory.Operations(did)
+	require.Len(t, ops, 2)
+	prev, err := ops[0].CID()
+	require.NoError(t, err)
+	require.NotNil(t, ops[1].Prev)
+	assert.Equal(t, prev, *ops[1].Prev)
+	assert.Equal(t, "https://new.example.com", ops[1].Services["bsky_fg"].Endpoint)
+	assert.Equal(t, ops[0].RotationKeys, ops[1].RotationKeys)
+}
+
+func TestSetFeedGeneratorEndpointErrors(t *testing.T) {
+	directory := plctest.NewServer()
+	defer directory.Close()
+	client := plc.NewDirectoryClient(directory.URL)
+	ctx := context.Background()
+
+	_, err := plc.SetFeedGeneratorEndpoint(ctx, client, newKey(t), "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa", "https://norsky.example.com")
+	assert.ErrorIs(t, err, plc.ErrNotFound)
+
+	did, err := plc.CreateFeedGenerator(ctx, client, newKey(t), "https://norsky.example.com")
+	require.NoError(t, err)
+
+	// Only a rotation key of the DID can update it
+	_, err = plc.SetFeedGeneratorEndpoint(ctx, client, newKey(t), did, "https://other.example.com")
+	assert.ErrorContains(t, err, "not a rotation key")
+	assert.Len(t, directory.Operations(did), 1)
+}
+
+func TestDirectoryRejectsInvalidOperations(t *testing.T) {
+	directory := plctest.NewServer()
+	defer directory.Close()
+	client := plc.NewDirectoryClient(directory.URL)
+	key := newKey(t)
+	ctx := context.Background()
+
+	did, err := plc.CreateFeedGenerator(ctx, client, key, "https://norsky.example.com")
+	require.NoError(t, err)
+	op, err := client.LastOperation(ctx, did)
+	require.NoError(t, err)
+
+	// A changed operation must be signed again
+	prev, err := op.CID()
+	require.NoError(t, err)
+	op.Prev = &prev
+	op.Services["bsky_fg"] = plc.Service{Type: "BskyFeedGenerator", Endpoint: "https://evil.example.com"}
+	assert.ErrorContains(t, client.Submit(ctx, did, op), "not signed by a rotation key")
+
+	require.NoError(t, op.Sign(key))
+	require.NoError(t, client.Submit(ctx, did, op))
+
+	// Submitting it twice no longer references the last operation
+	assert.ErrorContains(t, client.Submit(ctx, did, op), "prev does not match")
+}
@@ -0,0 +1,112 @@
+// Package plctest provides an in-process PLC directory stand-in for tests of did:plc updates
+package plctest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"norsky/plc"
+)
+
+// Server keeps the operation log of each DID in memory and serves the PLC directory endpoints the
+// plc package uses. Submitted operations are checked like the directory does: they must be signed
+// by a rotation key of the previous operation, reference it as prev, and the first operation must
+// hash to the DID.
+type Server struct {
+	// URL is the base URL of the server, e.g. http://127.0.0.1:1234
+	URL string
+
+	server *httptest.Server
+
+	mu   sync.Mutex
+	logs map[string][]plc.Operation
+}
+
+// NewServer starts an empty directory, call Close when done
+func NewServer() *Server {
+	s := &Server{logs: make(map[string][]plc.Operation)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// Operations returns the log of a DID, oldest first
+func (s *Server) Operations(did string) []plc.Operation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]plc.Operation(nil), s.logs[did]...)
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/log/last"):
+		s.mu.Lock()
+		ops := s.logs[strings.TrimSuffix(path, "/log/last")]
+		s.mu.Unlock()
+		if len(ops) == 0 {
+			writeMessage(w, http.StatusNotFound, "DID not registered")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ops[len(ops)-1])
+	case r.Method == http.MethodPost && !strings.Contains(path, "/"):
+		var op plc.Operation
+		if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+			writeMessage(w, http.StatusBadRequest, "invalid operation: "+err.Error())
+			return
+		}
+		if msg := s.submit(path, op); msg != "" {
+			writeMessage(w, http.StatusBadRequest, msg)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMessage(w, http.StatusNotFound, "not found")
+	}
+}
+
+// submit appends the operation to the log, returning why it was rejected otherwise
+func (s *Server) submit(did string, op plc.Operation) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ops := s.logs[did]
+	if len(ops) == 0 {
+		if op.Prev != nil {
+			return "unknown DID, the first operation must not have prev"
+		}
+		if genesis, err := op.DID(); err != nil || genesis != did {
+			return "operation does not hash to " + did
+		}
+		if err := op.Verify(op.RotationKeys); err != nil {
+			return err.Error()
+		}
+	} else {
+		last := ops[len(ops)-1]
+		prev, err := last.CID()
+		if err != nil || op.Prev == nil || *op.Prev != prev {
+			return "prev does not match the last operation"
+		}
+		if err := op.Verify(last.RotationKeys); err != nil {
+			return err.Error()
+		}
+	}
+
+	s.logs[did] = append(ops, op)
+	return ""
+}
+
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -3,18 +3,28 @@ package query
 import (
 	"strings"
 
+	"norsky/models"
+
 	"github.com/huandu/go-sqlbuilder"
 )
 
+// Params holds the per-request parameters of a feed query
+type Params struct {
+	Limit  int
+	Cursor int64
+	// Viewer is the DID of the authenticated viewer, empty for anonymous requests
+	Viewer string
+}
+
 // Builder builds SQL queries for feed filtering and scoring
 type Builder interface {
-	Build(limit int, cursor int64) (string, []interface{})
+	Build(params Params) (string, []interface{})
 }
 
 // ScoringStrategy defines how posts should be scored/ranked
 type ScoringStrategy interface {
-	// ApplyScoring writes the scoring expression to the builder
-	ApplyScoring(sb *strings.Builder)
+	// ApplyScoring writes the scoring expression to the builder, values are bound with args
+	ApplyScoring(sb *strings.Builder, args *sqlbuilder.Args, params Params)
 	// GetSort returns the ORDER BY clause
 	GetSort() []string
 }
@@ -22,7 +32,13 @@ type ScoringStrategy interface {
 // FilterStrategy adds WHERE conditions to the query
 type FilterStrategy interface {
 	// ApplyFilter adds filter conditions to the query builder
-	ApplyFilter(sb *sqlbuilder.SelectBuilder)
+	ApplyFilter(sb *sqlbuilder.SelectBuilder, params Params)
+}
+
+// PostMatcher is implemented by filters that can also be evaluated in memory, e.g. for live streams of posts
+type PostMatcher interface {
+	// MatchPost reports whether the post passes the filter
+	MatchPost(post models.Post) bool
 }
 
 // KeywordConfig holds a named set of keywords
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"norsky/auth"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "norsky_rate_limited_requests_total",
+	Help: "Requests rejected with 429 Too Many Requests by limiter (ip, viewer)",
+}, []string{"limiter"})
+
+// DefaultRateLimitWindow is the sliding window request limits are counted in
+const DefaultRateLimitWindow = time.Minute
+
+// ipRateLimiter limits the XRPC and dashboard requests of each client IP, nil when disabled
+func ipRateLimiter(max int, window time.Duration) fiber.Handler {
+	if max <= 0 {
+		return nil
+	}
+	return limiter.New(limiter.Config{
+		Max:        max,
+		Expiration: window,
+		Next: func(c *fiber.Ctx) bool {
+			return !strings.HasPrefix(c.Path(), "/xrpc/") && !strings.HasPrefix(c.Path(), "/dashboard/")
+		},
+		LimiterMiddleware: limiter.SlidingWindow{},
+		LimitReached:      rateLimitReached("ip"),
+	})
+}
+
+// viewerRateLimiter limits the XRPC requests of each authenticated viewer, nil when disabled.
+// It must run after the viewer is resolved from the service token.
+func viewerRateLimiter(max int, window time.Duration) fiber.Handler {
+	if max <= 0 {
+		return nil
+	}
+	return limiter.New(limiter.Config{
+		Max:        max,
+		Expiration: window,
+		Next: func(c *fiber.Ctx) bool {
+			return auth.ViewerFromContext(c.UserContext()) == ""
+		},
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return auth.ViewerFromContext(c.UserContext())
+		},
+		LimiterMiddleware: limiter.SlidingWindow{},
+		LimitReached:      rateLimitReached("viewer"),
+	})
+}
+
+// rateLimitReached fails with an XRPC error, the limiter has already set Retry-After
+func rateLimitReached(name string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rateLimitedRequests.WithLabelValues(name).Inc()
+		message := "Too many requests"
+		if retryAfter := string(c.Response().Header.Peek(fiber.HeaderRetryAfter)); retryAfter != "" {
+			message = fmt.Sprintf("Too many requests, retry in %s seconds", retryAfter)
+		}
+		return newXRPCError(fiber.StatusTooManyRequests, xrpcRateLimitExceeded, message)
+	}
+}
@@ -1,16 +1,24 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"norsky/auth"
 	"norsky/db"
 	"norsky/feeds"
+	"norsky/firehose"
+	"norsky/models"
+	"norsky/sink"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
-	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/cache"
@@ -19,6 +27,7 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
@@ -30,32 +39,81 @@ type ServerConfig struct {
 	// The hostname to use for the server
 	Hostname string
 
+	// The DID of the feed generator, did:plc or did:web, defaults to did:web:<Hostname>
+	ServiceDID string
+
 	// The database connection
 	DB *db.DB
 
 	// Add feeds to config
 	Feeds feeds.FeedMap
+
+	// Verifies the viewer JWT on XRPC requests, nil treats all requests as anonymous
+	Auth *auth.Verifier
+
+	// Reports the state of the firehose session, nil when not ingesting
+	Firehose FirehoseStatus
+
+	// Readiness fails when ingest is further behind than this, zero disables the lag check
+	MaxLag time.Duration
+
+	// Streams accepted posts to the dashboard, nil disables the live stream
+	Live *sink.Broadcaster
+
+	// Caches the feed pages of anonymous viewers, nil queries the database on every request
+	Skeletons *feeds.SkeletonCache
+
+	// Requests allowed per client IP and per authenticated viewer within RateLimitWindow, zero disables a limit
+	RateLimitIP     int
+	RateLimitViewer int
+	RateLimitWindow time.Duration
+
+	// Header with the client IP when running behind a reverse proxy, e.g. X-Forwarded-For
+	ProxyHeader string
 }
 
-var (
-	// Define custom metrics
-	customPostsProcessed = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "norsky_posts_processed_total",
-			Help: "Total number of posts processed by language",
-		},
-		[]string{"language"},
-	)
-)
+// Range of the statistics endpoints without from and to
+const defaultStatsRange = 24 * time.Hour
 
-func init() {
-	// Register custom metrics
-	prometheus.MustRegister(customPostsProcessed)
+// Time between comments sent to keep idle live streams from being closed by proxies
+const sseKeepAliveInterval = 15 * time.Second
+
+// FirehoseStatus reports the state of the firehose session, implemented by firehose.Subscription
+type FirehoseStatus interface {
+	Status() firehose.SessionStatus
 }
 
+var (
+	feedSkeletonRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_feed_skeleton_requests_total",
+		Help: "getFeedSkeleton requests by feed and response status",
+	}, []string{"feed", "status"})
+
+	feedSkeletonDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "norsky_feed_skeleton_duration_seconds",
+		Help:    "Time to generate a feed skeleton by feed",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to 10s
+	}, []string{"feed"})
+)
+
 // Returns a fiber.App instance to be used as an HTTP server for the norsky feed
 func Server(config *ServerConfig) *fiber.App {
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		ProxyHeader: config.ProxyHeader,
+		// Take the first valid IP from proxy headers holding a list
+		EnableIPValidation: config.ProxyHeader != "",
+		ErrorHandler:       errorHandler,
+	})
+
+	serviceDID := config.ServiceDID
+	if serviceDID == "" {
+		serviceDID = "did:web:" + config.Hostname
+	}
+
+	window := config.RateLimitWindow
+	if window <= 0 {
+		window = DefaultRateLimitWindow
+	}
 
 	// Middleware to track the latency of each request
 	app.Use(func(c *fiber.Ctx) error {
@@ -78,7 +136,12 @@ func Server(config *ServerConfig) *fiber.App {
 	})
 
 	app.Use(requestid.New(requestid.ConfigDefault))
-	app.Use(compress.New())
+	app.Use(compress.New(compress.Config{
+		// Compressing would buffer the event stream
+		Next: func(c *fiber.Ctx) bool {
+			return strings.HasSuffix(c.Path(), "/sse")
+		},
+	}))
 
 	// Setup CORS for localhost:3001
 	app.Use(func(c *fiber.Ctx) error {
@@ -90,6 +153,10 @@ func Server(config *ServerConfig) *fiber.App {
 		return cors.New(corsConfig)(c)
 	})
 
+	if limit := ipRateLimiter(config.RateLimitIP, window); limit != nil {
+		app.Use(limit)
+	}
+
 	// Serve the assets
 
 	// Setup cache
@@ -122,92 +189,407 @@ func Server(config *ServerConfig) *fiber.App {
 		},
 	}))
 
-	// Well known
-	app.Get("/.well-known/did.json", func(c *fiber.Ctx) error {
-		// Return the DID document, using regular map[string]interface{} for now
-
-		return c.JSON(map[string]interface{}{
-			"@context": []string{"https://www.w3.org/ns/did/v1"},
-			"id":       "did:web:" + config.Hostname,
-			"service": []map[string]interface{}{
-				{
-					"id":              "#bsky_fg",
-					"type":            "BskyFeedGenerator",
-					"serviceEndpoint": "https://" + config.Hostname,
+	// Well known, the document of a did:plc is served by the PLC directory instead
+	if serviceDID == "did:web:"+config.Hostname {
+		app.Get("/.well-known/did.json", func(c *fiber.Ctx) error {
+			// Return the DID document, using regular map[string]interface{} for now
+
+			return c.JSON(map[string]interface{}{
+				"@context": []string{"https://www.w3.org/ns/did/v1"},
+				"id":       serviceDID,
+				"service": []map[string]interface{}{
+					{
+						"id":              "#bsky_fg",
+						"type":            "BskyFeedGenerator",
+						"serviceEndpoint": "https://" + config.Hostname,
+					},
 				},
-			},
+			})
 		})
-	})
+	}
 
 	// Endpoint to describe the feed
 	app.Get("/xrpc/app.bsky.feed.describeFeedGenerator", func(c *fiber.Ctx) error {
 		generatorFeeds := []*bsky.FeedDescribeFeedGenerator_Feed{}
 		for feedId := range config.Feeds {
 			generatorFeeds = append(generatorFeeds, &bsky.FeedDescribeFeedGenerator_Feed{
-				Uri: "at://did:web:" + config.Hostname + "/app.bsky.feed.generator/" + feedId,
+				Uri: "at://" + serviceDID + "/" + feedGeneratorCollection + "/" + feedId,
 			})
 		}
 
 		return c.JSON(bsky.FeedDescribeFeedGenerator_Output{
-			Did:   "did:web:" + config.Hostname,
+			Did:   serviceDID,
 			Feeds: generatorFeeds,
 		})
 	})
 
-	app.Get("/xrpc/app.bsky.feed.getFeedSkeleton", func(c *fiber.Ctx) error {
-		feed := c.Query("feed", "at://did:web:"+config.Hostname+"/app.bsky.feed.generator/all")
-		cursor := c.Query("cursor", "")
-		limit, err := strconv.ParseInt(c.Query("limit", "20"), 0, 32)
-		if err != nil || limit < 1 || limit > 100 {
-			limit = 20
+	// Resolve the viewer from the service JWT, invalid or missing tokens are treated as anonymous
+	app.Use("/xrpc", func(c *fiber.Ctx) error {
+		authorization := c.Get(fiber.HeaderAuthorization)
+		if config.Auth == nil || authorization == "" {
+			return c.Next()
 		}
 
-		uri, err := syntax.ParseATURI(feed)
+		token, err := auth.BearerToken(authorization)
 		if err != nil {
-			log.Error("Error parsing URI", err)
-			return c.Status(400).SendString("Invalid feed URI")
+			log.WithError(err).Debug("Ignoring authorization header")
+			return c.Next()
 		}
 
-		feedName := uri.RecordKey().String()
+		method := strings.TrimPrefix(c.Path(), "/xrpc/")
+		viewer, err := config.Auth.Verify(c.UserContext(), token, method)
+		if err != nil {
+			log.WithError(err).Warn("Invalid service token, continuing as anonymous")
+			return c.Next()
+		}
+
+		c.SetUserContext(auth.WithViewer(c.UserContext(), viewer))
+		return c.Next()
+	})
+
+	if limit := viewerRateLimiter(config.RateLimitViewer, window); limit != nil {
+		app.Use("/xrpc", limit)
+	}
+
+	app.Get("/xrpc/app.bsky.feed.getFeedSkeleton", func(c *fiber.Ctx) (err error) {
+		// Only configured feeds get their own label, to keep the number of series bounded
+		feedLabel := "unknown"
+		start := time.Now()
+		defer func() {
+			// Render errors here so the status they respond with is counted
+			if err != nil {
+				err = errorHandler(c, err)
+			}
+			feedSkeletonRequests.WithLabelValues(feedLabel, strconv.Itoa(c.Response().StatusCode())).Inc()
+			feedSkeletonDuration.WithLabelValues(feedLabel).Observe(time.Since(start).Seconds())
+		}()
+
+		feedName, err := feedRecordKey(c.Query("feed", ""), serviceDID)
+		if err != nil {
+			return err
+		}
+		cursor := c.Query("cursor", "")
+		if cursor != "" {
+			if id, err := strconv.ParseInt(cursor, 10, 64); err != nil || id < 0 {
+				return newXRPCError(fiber.StatusBadRequest, xrpcInvalidRequest, "Invalid cursor: "+cursor)
+			}
+		}
+		limit, err := strconv.ParseInt(c.Query("limit", "20"), 10, 32)
+		if err != nil || limit < 1 || limit > 100 {
+			return newXRPCError(fiber.StatusBadRequest, xrpcInvalidRequest, "limit must be an integer between 1 and 100")
+		}
 
 		log.WithFields(log.Fields{
 			"feed":   feedName,
 			"cursor": cursor,
 			"limit":  limit,
+			"viewer": auth.ViewerFromContext(c.UserContext()),
 		}).Info("Generate feed skeleton with parameters")
 
-		if feed, ok := config.Feeds[feedName]; ok {
-			posts, err := feed.GetFeedPosts(cursor, int(limit))
+		feed, ok := config.Feeds[feedName]
+		if !ok {
+			return newXRPCError(fiber.StatusBadRequest, xrpcUnknownFeed, "Unknown feed: "+feedName)
+		}
+		feedLabel = feedName
+		viewer := auth.ViewerFromContext(c.UserContext())
+
+		// Anonymous viewers all get the same pages, which can be cached
+		if viewer == "" && config.Skeletons != nil {
+			skeleton, err := config.Skeletons.Get(c.UserContext(), feed, cursor, int(limit))
 			if err != nil {
-				log.Error("Error getting feed posts", err)
-				return c.Status(500).SendString("Error getting feed posts")
+				return fmt.Errorf("error getting feed posts: %w", err)
+			}
+
+			c.Set(fiber.HeaderETag, skeleton.ETag)
+			if ttl := config.Skeletons.TTL(); ttl > 0 {
+				c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+			} else {
+				c.Set(fiber.HeaderCacheControl, "no-cache")
+			}
+			if c.Get(fiber.HeaderIfNoneMatch) == skeleton.ETag {
+				return c.SendStatus(fiber.StatusNotModified)
+			}
+			c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			return c.Send(skeleton.Body)
+		}
+
+		posts, err := feed.GetFeedPosts(c.UserContext(), viewer, cursor, int(limit))
+		if err != nil {
+			return fmt.Errorf("error getting feed posts: %w", err)
+		}
+		// Pages for a viewer are personal and record what they have seen
+		c.Set(fiber.HeaderCacheControl, "private, no-store")
+		return c.JSON(posts)
+	})
+
+	app.Post("/xrpc/app.bsky.feed.sendInteractions", func(c *fiber.Ctx) error {
+		// Interactions down-rank posts for everyone, so they are only taken from verified viewers
+		viewer := auth.ViewerFromContext(c.UserContext())
+		if viewer == "" {
+			return newXRPCError(fiber.StatusUnauthorized, xrpcAuthRequired, "A valid service token is required to send interactions")
+		}
+
+		var input bsky.FeedSendInteractions_Input
+		if err := c.BodyParser(&input); err != nil {
+			return newXRPCError(fiber.StatusBadRequest, xrpcInvalidRequest, "Invalid interactions: "+err.Error())
+		}
+
+		interactions := make([]models.Interaction, 0, len(input.Interactions))
+		for _, interaction := range input.Interactions {
+			if interaction == nil || interaction.Item == nil || interaction.Event == nil {
+				continue
+			}
+			// Only events of the lexicon are stored, the interactions table is not for arbitrary values
+			if !feeds.IsInteractionEvent(*interaction.Event) {
+				return newXRPCError(fiber.StatusBadRequest, xrpcInvalidRequest, "Unknown interaction event: "+*interaction.Event)
+			}
+
+			// The feed context is the feed id we handed out in getFeedSkeleton
+			if interaction.FeedContext == nil {
+				continue
+			}
+			if _, ok := config.Feeds[*interaction.FeedContext]; !ok {
+				continue
 			}
-			return c.JSON(posts)
+
+			interactions = append(interactions, models.Interaction{
+				Feed:    *interaction.FeedContext,
+				PostUri: *interaction.Item,
+				UserDid: viewer,
+				Event:   *interaction.Event,
+			})
+		}
+
+		log.WithFields(log.Fields{
+			"received": len(input.Interactions),
+			"stored":   len(interactions),
+		}).Info("Send interactions")
+
+		if err := config.DB.CreateInteractions(c.Context(), interactions); err != nil {
+			return fmt.Errorf("error storing interactions: %w", err)
 		}
 
-		return c.Status(400).SendString("Invalid feed")
+		return c.JSON(bsky.FeedSendInteractions_Output{})
+	})
+
+	// Methods this generator doesn't implement
+	app.Use("/xrpc", func(c *fiber.Ctx) error {
+		return newXRPCError(fiber.StatusNotImplemented, xrpcMethodNotImplemented, "Method not implemented: "+strings.TrimPrefix(c.Path(), "/xrpc/"))
 	})
 
 	app.Get("/dashboard/posts-per-time", func(c *fiber.Ctx) error {
-		// Get the feed query parameters and parse the limit
-		lang := c.Query("lang", "")
-		time := c.Query("time", "")
+		// Without from and to all rolled up hours are counted
+		q := db.PostCountQuery{Language: c.Query("lang", "")}
+		var err error
+		if q.StatsRange, err = parseStatsRange(c, config.Feeds); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if q.Bucket, err = db.ParseTimeBucket(c.Query("time", string(db.BucketHour))); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
 
-		postsPerTime, err := config.DB.GetPostCountPerTime(lang, time)
+		postsPerTime, err := config.DB.GetPostCounts(c.UserContext(), q)
 		if err != nil {
-			log.Error("Error getting posts per time", err)
+			log.WithError(err).Error("Error getting posts per time")
 			return c.Status(500).SendString("Error getting posts per time")
 		}
 
 		log.WithFields(log.Fields{
-			"time":  time,
-			"lang":  lang,
+			"time":  q.Bucket,
+			"lang":  q.Language,
+			"feed":  q.Feed,
 			"count": len(postsPerTime),
 		}).Info("Get posts per time")
 
 		return c.Status(200).JSON(postsPerTime)
 	})
 
+	// Statistics of a feed, or all posts without a feed, from the hourly rollups
+	app.Get("/dashboard/stats/volume", func(c *fiber.Ctx) error {
+		r, err := statsRange(c, config.Feeds)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		bucket, err := db.ParseTimeBucket(c.Query("time", string(db.BucketHour)))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		volume, err := config.DB.GetFeedVolume(c.UserContext(), r, bucket)
+		if err != nil {
+			log.WithError(err).Error("Error getting feed volume")
+			return c.Status(500).SendString("Error getting feed volume")
+		}
+		return c.JSON(volume)
+	})
+
+	app.Get("/dashboard/stats/authors", func(c *fiber.Ctx) error {
+		r, err := statsRange(c, config.Feeds)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		authors, err := config.DB.GetTopAuthors(c.UserContext(), r, statsLimit(c))
+		if err != nil {
+			log.WithError(err).Error("Error getting top authors")
+			return c.Status(500).SendString("Error getting top authors")
+		}
+		return c.JSON(authors)
+	})
+
+	app.Get("/dashboard/stats/hashtags", func(c *fiber.Ctx) error {
+		r, err := statsRange(c, config.Feeds)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		hashtags, err := config.DB.GetTopHashtags(c.UserContext(), r, statsLimit(c))
+		if err != nil {
+			log.WithError(err).Error("Error getting top hashtags")
+			return c.Status(500).SendString("Error getting top hashtags")
+		}
+		return c.JSON(hashtags)
+	})
+
+	app.Get("/dashboard/stats/languages", func(c *fiber.Ctx) error {
+		r, err := statsRange(c, config.Feeds)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		languages, err := config.DB.GetLanguageMix(c.UserContext(), r)
+		if err != nil {
+			log.WithError(err).Error("Error getting language mix")
+			return c.Status(500).SendString("Error getting language mix")
+		}
+		return c.JSON(languages)
+	})
+
+	app.Get("/dashboard/stats/replies", func(c *fiber.Ctx) error {
+		r, err := statsRange(c, config.Feeds)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		ratio, err := config.DB.GetReplyRatio(c.UserContext(), r)
+		if err != nil {
+			log.WithError(err).Error("Error getting reply ratio")
+			return c.Status(500).SendString("Error getting reply ratio")
+		}
+		return c.JSON(ratio)
+	})
+
+	// Live stream of accepted posts, optionally filtered by languages (comma separated) or a feed
+	app.Get("/dashboard/feed/sse", func(c *fiber.Ctx) error {
+		if config.Live == nil {
+			return c.Status(404).SendString("Live stream is disabled")
+		}
+
+		languages := &feeds.LanguageFilter{}
+		if lang := c.Query("lang", ""); lang != "" {
+			languages.Languages = strings.Split(lang, ",")
+		}
+		var feed *feeds.Feed
+		if feedName := c.Query("feed", ""); feedName != "" {
+			var ok bool
+			if feed, ok = config.Feeds[feedName]; !ok {
+				return c.Status(400).SendString("Unknown feed: " + feedName)
+			}
+		}
+
+		subscription := config.Live.Subscribe(func(post models.Post) bool {
+			return languages.MatchPost(post) && (feed == nil || feed.MatchPost(post))
+		})
+
+		log.WithFields(log.Fields{
+			"key":  subscription.Key,
+			"lang": languages.Languages,
+			"feed": c.Query("feed", ""),
+		}).Info("Live stream client connected")
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer config.Live.Unsubscribe(subscription.Key)
+			streamPosts(w, subscription)
+			log.WithField("key", subscription.Key).Info("Live stream client disconnected")
+		})
+		return nil
+	})
+
+	// Ends a live stream by the key sent in its init event
+	app.Delete("/dashboard/feed/sse", func(c *fiber.Ctx) error {
+		if config.Live == nil || !config.Live.Unsubscribe(c.Query("key", "")) {
+			return c.Status(404).SendString("Unknown live stream key")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Liveness probe, the process is able to serve requests
+	app.Get("/healthz", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+
+	// Readiness probe, the database is reachable and the firehose is connected and caught up
+	app.Get("/readyz", func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), 2*time.Second)
+		defer cancel()
+
+		ready := true
+		checks := fiber.Map{"database": "ok"}
+		if err := config.DB.Ping(ctx); err != nil {
+			ready = false
+			checks["database"] = err.Error()
+		}
+
+		if config.Firehose != nil {
+			status := config.Firehose.Status()
+			checks["firehose"] = status.State
+			if status.State != firehose.SessionConnected {
+				ready = false
+			}
+
+			switch {
+			case status.Cursor == 0:
+				ready = false
+				checks["lag"] = "no events processed yet"
+			case config.MaxLag > 0 && status.Lag > config.MaxLag:
+				ready = false
+				checks["lag"] = fmt.Sprintf("%s behind, more than %s", status.Lag.Round(time.Second), config.MaxLag)
+			default:
+				checks["lag"] = status.Lag.Round(time.Millisecond).String()
+			}
+		}
+
+		if !ready {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "unavailable", "checks": checks})
+		}
+		return c.JSON(fiber.Map{"status": "ready", "checks": checks})
+	})
+
+	app.Get("/firehose/status", func(c *fiber.Ctx) error {
+		if config.Firehose == nil {
+			return c.Status(404).SendString("Not ingesting the firehose")
+		}
+
+		status := config.Firehose.Status()
+		response := fiber.Map{
+			"state":       status.State,
+			"host":        status.Host,
+			"cursor":      status.Cursor,
+			"lag_seconds": status.Lag.Seconds(),
+			"reconnects":  status.Reconnects,
+		}
+		if !status.ConnectedAt.IsZero() {
+			response["connected_at"] = status.ConnectedAt.UTC().Format(time.RFC3339)
+		}
+		if !status.LastMessageAt.IsZero() {
+			response["last_message_at"] = status.LastMessageAt.UTC().Format(time.RFC3339)
+		}
+		return c.JSON(response)
+	})
+
 	// Serve the Solid dashboard
 	app.Use("/", filesystem.New(filesystem.Config{
 		Browse:     false,
@@ -221,3 +603,89 @@ func Server(config *ServerConfig) *fiber.App {
 
 	return app
 }
+
+// statsRange parses the feed, from and to query parameters of the statistics endpoints. The range
+// defaults to the last defaultStatsRange, and the feed to all posts.
+func statsRange(c *fiber.Ctx, feedMap feeds.FeedMap) (db.StatsRange, error) {
+	r, err := parseStatsRange(c, feedMap)
+	if err != nil {
+		return r, err
+	}
+	if r.To.IsZero() {
+		r.To = time.Now()
+	}
+	if r.From.IsZero() {
+		r.From = r.To.Add(-defaultStatsRange)
+	}
+	if !r.From.Before(r.To) {
+		return r, errors.New("invalid range, from must be before to")
+	}
+	return r, nil
+}
+
+// parseStatsRange parses the feed, from and to query parameters, leaving missing times zero
+func parseStatsRange(c *fiber.Ctx, feedMap feeds.FeedMap) (db.StatsRange, error) {
+	r := db.StatsRange{Feed: c.Query("feed", "")}
+	if _, ok := feedMap[r.Feed]; r.Feed != "" && !ok {
+		return r, fmt.Errorf("unknown feed: %s", r.Feed)
+	}
+
+	for _, param := range []struct {
+		name   string
+		target *time.Time
+	}{
+		{"from", &r.From},
+		{"to", &r.To},
+	} {
+		value := c.Query(param.name, "")
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return r, fmt.Errorf("invalid %s, expected an RFC 3339 time: %s", param.name, value)
+		}
+		*param.target = parsed
+	}
+	return r, nil
+}
+
+// statsLimit parses the limit query parameter of the top lists
+func statsLimit(c *fiber.Ctx) int {
+	limit, err := strconv.Atoi(c.Query("limit", ""))
+	if err != nil || limit <= 0 || limit > 100 {
+		return 10
+	}
+	return limit
+}
+
+// streamPosts writes the subscription as server-sent events until the subscription ends or the client goes away
+func streamPosts(w *bufio.Writer, subscription *sink.Subscription) {
+	fmt.Fprintf(w, "event: init\ndata: %s\n\n", subscription.Key)
+	if err := w.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case post, ok := <-subscription.Posts:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(post)
+			if err != nil {
+				log.WithError(err).Error("Failed to marshal live post")
+				continue
+			}
+			fmt.Fprintf(w, "event: create-post\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		// Writes to a client that went away fail on flush
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package server_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"norsky/auth"
+	"norsky/config"
+	"norsky/feeds"
+	"norsky/models"
+	"norsky/query"
+	"norsky/server"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	atdata "github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/lexicon"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	hostname   = "norsky.example.com"
+	serviceDID = "did:web:" + hostname
+	feedURI    = "at://" + serviceDID + "/app.bsky.feed.generator/norwegian"
+)
+
+// store serves a fixed list of posts to every feed
+type store struct {
+	posts []models.FeedPost
+}
+
+func (s *store) GetFeedPosts(builder query.Builder, params query.Params) ([]models.FeedPost, error) {
+	posts := []models.FeedPost{}
+	for _, post := range s.posts {
+		if params.Cursor == 0 || post.Id < params.Cursor {
+			posts = append(posts, post)
+		}
+	}
+	if len(posts) > params.Limit {
+		posts = posts[:params.Limit]
+	}
+	return posts, nil
+}
+
+func (s *store) RecordSeenPosts(ctx context.Context, viewer string, feed string, postIds []int64, expiresAt time.Time) error {
+	return nil
+}
+
+// newApp serves a norwegian feed, as did:web:<hostname> without a DID
+func newApp(t *testing.T, did string) *fiber.App {
+	t.Helper()
+
+	cfg := &config.TomlConfig{Feeds: []config.TomlFeed{{Id: "norwegian", DisplayName: "Norwegian"}}}
+	db := &store{posts: []models.FeedPost{
+		{Id: 3, Uri: "at://did:plc:author1/app.bsky.feed.post/3kznmn7xqxl22"},
+		{Id: 2, Uri: "at://did:plc:author2/app.bsky.feed.post/3kznmn7xqxl23"},
+		{Id: 1, Uri: "at://did:plc:author1/app.bsky.feed.post/3kznmn7xqxl24"},
+	}}
+	feedMap, err := feeds.InitializeFeeds(cfg, db, nil)
+	require.NoError(t, err)
+
+	return server.Server(&server.ServerConfig{Hostname: hostname, ServiceDID: did, Feeds: feedMap})
+}
+
+// newCatalog loads the lexicons in testdata, turning the output of each query into a record schema
+// under the query NSID so responses can be checked with lexicon.ValidateRecord
+func newCatalog(t *testing.T) *lexicon.BaseCatalog {
+	t.Helper()
+
+	paths, err := filepath.Glob("testdata/lexicons/*.json")
+	require.NoError(t, err)
+
+	cat := lexicon.NewBaseCatalog()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		var file map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &file))
+		defs := file["defs"].(map[string]interface{})
+		if main, ok := defs["main"].(map[string]interface{}); ok && main["type"] == "query" {
+			output := main["output"].(map[string]interface{})
+			defs["main"] = map[string]interface{}{"type": "record", "key": "any", "record": output["schema"]}
+		}
+
+		data, err = json.Marshal(file)
+		require.NoError(t, err)
+		var schema lexicon.SchemaFile
+		require.NoError(t, json.Unmarshal(data, &schema))
+		require.NoError(t, cat.AddSchemaFile(schema))
+	}
+	return &cat
+}
+
+func get(t *testing.T, app *fiber.App, method string, params url.Values) (*http.Response, []byte) {
+	t.Helper()
+
+	target := "/xrpc/" + method
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+// assertOutput validates a response body against the output schema of the method
+func assertOutput(t *testing.T, cat *lexicon.BaseCatalog, method string, body []byte) {
+	t.Helper()
+
+	data, err := atdata.UnmarshalJSON(body)
+	require.NoError(t, err)
+	data["$type"] = method
+	assert.NoError(t, lexicon.ValidateRecord(cat, data, method, 0))
+}
+
+// assertError checks for an XRPC error body with the given name
+func assertError(t *testing.T, resp *http.Response, body []byte, status int, name string) {
+	t.Helper()
+
+	assert.Equal(t, status, resp.StatusCode)
+	assert.Equal(t, fiber.MIMEApplicationJSON, resp.Header.Get(fiber.HeaderContentType))
+
+	var xrpcErr struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	require.NoError(t, json.Unmarshal(body, &xrpcErr), string(body))
+	assert.Equal(t, name, xrpcErr.Error)
+	assert.NotEmpty(t, xrpcErr.Message)
+}
+
+func TestDescribeFeedGenerator(t *testing.T) {
+	app := newApp(t, "")
+
+	resp, body := get(t, app, "app.bsky.feed.describeFeedGenerator", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assertOutput(t, newCatalog(t), "app.bsky.feed.describeFeedGenerator", body)
+	assert.JSONEq(t, `{"did": "`+serviceDID+`", "feeds": [{"uri": "`+feedURI+`"}]}`, string(body))
+}
+
+func TestGetFeedSkeleton(t *testing.T) {
+	app := newApp(t, "")
+	cat := newCatalog(t)
+
+	resp, body := get(t, app, "app.bsky.feed.getFeedSkeleton", url.Values{"feed": {feedURI}, "limit": {"2"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assertOutput(t, cat, "app.bsky.feed.getFeedSkeleton", body)
+
+	var page models.FeedResponse
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Feed, 2)
+	require.NotNil(t, page.Cursor)
+	assert.Equal(t, "norwegian", page.Feed[0].FeedContext)
+
+	// The last page has no cursor
+	resp, body = get(t, app, "app.bsky.feed.getFeedSkeleton", url.Values{"feed": {feedURI}, "cursor": {*page.Cursor}})
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assertOutput(t, cat, "app.bsky.feed.getFeedSkeleton", body)
+	assert.NotContains(t, string(body), "cursor")
+}
+
+func TestGetFeedSkeletonErrors(t *testing.T) {
+	app := newApp(t, "")
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+		error  string
+	}{
+		{"missing feed", url.Values{}, "InvalidRequest"},
+		{"invalid feed uri", url.Values{"feed": {"norwegian"}}, "InvalidRequest"},
+		{"invalid limit", url.Values{"feed": {feedURI}, "limit": {"0"}}, "InvalidRequest"},
+		{"invalid cursor", url.Values{"feed": {feedURI}, "cursor": {"abc"}}, "InvalidRequest"},
+		{"other generator", url.Values{"feed": {"at://did:web:other.example.com/app.bsky.feed.generator/norwegian"}}, "UnknownFeed"},
+		{"other collection", url.Values{"feed": {"at://" + serviceDID + "/app.bsky.feed.post/norwegian"}}, "UnknownFeed"},
+		{"unknown record key", url.Values{"feed": {"at://" + serviceDID + "/app.bsky.feed.generator/swedish"}}, "UnknownFeed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := get(t, app, "app.bsky.feed.getFeedSkeleton", tc.params)
+			assertError(t, resp, body, http.StatusBadRequest, tc.error)
+		})
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	app := newApp(t, "")
+
+	resp, body := get(t, app, "app.bsky.feed.getFeed", nil)
+	assertError(t, resp, body, http.StatusNotImplemented, "MethodNotImplemented")
+}
+
+func TestServiceDID(t *testing.T) {
+	did := "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	app := newApp(t, did)
+
+	resp, body := get(t, app, "app.bsky.feed.describeFeedGenerator", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"did": "`+did+`", "feeds": [{"uri": "at://`+did+`/app.bsky.feed.generator/norwegian"}]}`, string(body))
+
+	resp, body = get(t, app, "app.bsky.feed.getFeedSkeleton", url.Values{"feed": {"at://" + did + "/app.bsky.feed.generator/norwegian"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	// Feed URIs of the hostname no longer belong to the generator
+	resp, body = get(t, app, "app.bsky.feed.getFeedSkeleton", url.Values{"feed": {feedURI}})
+	assertError(t, resp, body, http.StatusBadRequest, "UnknownFeed")
+
+	// The PLC directory serves the DID document
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/.well-known/did.json", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestWellKnownDID(t *testing.T) {
+	app := newApp(t, "")
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/.well-known/did.json", nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var doc struct {
+		ID      string `json:"id"`
+		Service []struct {
+			ID              string `json:"id"`
+			Type            string `json:"type"`
+			ServiceEndpoint string `json:"serviceEndpoint"`
+		} `json:"service"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+	assert.Equal(t, serviceDID, doc.ID)
+	require.Len(t, doc.Service, 1)
+	assert.Equal(t, "#bsky_fg", doc.Service[0].ID)
+	assert.Equal(t, "https://"+hostname, doc.Service[0].ServiceEndpoint)
+}
+
+func TestSendInteractionsRequiresViewer(t *testing.T) {
+	app := newApp(t, "")
+
+	body := `{"interactions": [{"item": "at://did:plc:author1/app.bsky.feed.post/3kznmn7xqxl22", "event": "app.bsky.feed.defs#requestLess", "feedContext": "norwegian"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/xrpc/app.bsky.feed.sendInteractions", strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	// Invalid tokens are treated as anonymous
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer invalid")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assertError(t, resp, data, http.StatusUnauthorized, "AuthenticationRequired")
+}
+
+// viewerToken signs a service token of the viewer for the method, the returned verifier accepts it
+func viewerToken(t *testing.T, viewer string, method string) (*auth.Verifier, string) {
+	t.Helper()
+
+	key, err := crypto.GeneratePrivateKeyK256()
+	require.NoError(t, err)
+	pub, err := key.PublicKey()
+	require.NoError(t, err)
+
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(viewer),
+		Handle: syntax.Handle("invalid.handle"),
+		Keys:   map[string]identity.Key{"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()}},
+	})
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := encode(map[string]string{"alg": "ES256K", "typ": "JWT"}) + "." + encode(map[string]interface{}{
+		"iss": viewer,
+		"aud": serviceDID,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"lxm": method,
+	})
+	sig, err := key.HashAndSign([]byte(signingInput))
+	require.NoError(t, err)
+
+	return auth.NewVerifier(serviceDID, &dir), signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestSendInteractionsRejectsUnknownEvents(t *testing.T) {
+	const method = "app.bsky.feed.sendInteractions"
+	verifier, token := viewerToken(t, "did:plc:viewer", method)
+
+	feedMap, err := feeds.InitializeFeeds(&config.TomlConfig{Feeds: []config.TomlFeed{{Id: "norwegian"}}}, &store{}, nil)
+	require.NoError(t, err)
+	app := server.Server(&server.ServerConfig{Hostname: hostname, Feeds: feedMap, Auth: verifier})
+
+	body := `{"interactions": [
+		{"item": "at://did:plc:author1/app.bsky.feed.post/3kznmn7xqxl22", "event": "app.bsky.feed.defs#requestLess", "feedContext": "norwegian"},
+		{"item": "at://did:plc:author1/app.bsky.feed.post/3kznmn7xqxl23", "event": "spam", "feedContext": "norwegian"}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/xrpc/"+method, strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assertError(t, resp, data, http.StatusBadRequest, "InvalidRequest")
+	assert.Contains(t, string(data), "spam")
+}
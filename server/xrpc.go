@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// XRPC error names from the atproto specification and the app.bsky.feed lexicons
+const (
+	xrpcInvalidRequest       = "InvalidRequest"
+	xrpcAuthRequired         = "AuthenticationRequired"
+	xrpcMethodNotImplemented = "MethodNotImplemented"
+	xrpcPayloadTooLarge      = "PayloadTooLarge"
+	xrpcRateLimitExceeded    = "RateLimitExceeded"
+	xrpcInternalServerError  = "InternalServerError"
+	xrpcUnknownFeed          = "UnknownFeed"
+)
+
+const feedGeneratorCollection = "app.bsky.feed.generator"
+
+// xrpcError is an error with an XRPC error name, handlers return it and errorHandler renders the body
+type xrpcError struct {
+	Status  int
+	Name    string
+	Message string
+}
+
+func (e *xrpcError) Error() string {
+	return e.Name + ": " + e.Message
+}
+
+func newXRPCError(status int, name string, message string) *xrpcError {
+	return &xrpcError{Status: status, Name: name, Message: message}
+}
+
+// errorHandler renders XRPC errors, and any error returned on an XRPC route, as an XRPC error body
+// that clients can show to users
+func errorHandler(c *fiber.Ctx, err error) error {
+	var xrpcErr *xrpcError
+	if errors.As(err, &xrpcErr) {
+		return c.Status(xrpcErr.Status).JSON(fiber.Map{"error": xrpcErr.Name, "message": xrpcErr.Message})
+	}
+	if !strings.HasPrefix(c.Path(), "/xrpc/") {
+		return fiber.DefaultErrorHandler(c, err)
+	}
+
+	status := fiber.StatusInternalServerError
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		status = fiberErr.Code
+	}
+
+	switch status {
+	case fiber.StatusBadRequest:
+		return errorHandler(c, newXRPCError(status, xrpcInvalidRequest, err.Error()))
+	case fiber.StatusUnauthorized:
+		return errorHandler(c, newXRPCError(status, xrpcAuthRequired, err.Error()))
+	case fiber.StatusNotFound, fiber.StatusMethodNotAllowed, fiber.StatusNotImplemented:
+		return errorHandler(c, newXRPCError(fiber.StatusNotImplemented, xrpcMethodNotImplemented, "Method not implemented"))
+	case fiber.StatusRequestEntityTooLarge:
+		return errorHandler(c, newXRPCError(status, xrpcPayloadTooLarge, err.Error()))
+	case fiber.StatusTooManyRequests:
+		return errorHandler(c, newXRPCError(status, xrpcRateLimitExceeded, err.Error()))
+	default:
+		log.WithError(err).WithField("path", c.Path()).Error("XRPC request failed")
+		return errorHandler(c, newXRPCError(fiber.StatusInternalServerError, xrpcInternalServerError, "Internal server error"))
+	}
+}
+
+// feedRecordKey validates that a feed AT-URI names a feed generator record of the service DID and
+// returns its record key, which is the feed id. Invalid URIs are an InvalidRequest, and feeds
+// of other generators an UnknownFeed.
+func feedRecordKey(feed string, serviceDID string) (string, error) {
+	if feed == "" {
+		return "", newXRPCError(fiber.StatusBadRequest, xrpcInvalidRequest, "feed is required")
+	}
+
+	uri, err := syntax.ParseATURI(feed)
+	if err != nil {
+		return "", newXRPCError(fiber.StatusBadRequest, xrpcInvalidRequest, "Invalid feed URI: "+feed)
+	}
+
+	if uri.Authority().String() != serviceDID ||
+		uri.Collection().String() != feedGeneratorCollection ||
+		uri.RecordKey().String() == "" {
+		return "", newXRPCError(fiber.StatusBadRequest, xrpcUnknownFeed, "Unknown feed: "+feed)
+	}
+	return uri.RecordKey().String(), nil
+}
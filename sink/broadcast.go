@@ -0,0 +1,145 @@
+package sink
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"norsky/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	broadcastClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "norsky_live_clients",
+		Help: "Number of clients subscribed to the live post stream",
+	})
+
+	broadcastDroppedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "norsky_live_dropped_clients_total",
+		Help: "Number of live stream clients dropped because they fell behind",
+	})
+)
+
+// DefaultBroadcastBuffer is the number of posts buffered per live client before it is dropped
+const DefaultBroadcastBuffer = 100
+
+// Subscription is a live stream client of a Broadcaster
+type Subscription struct {
+	// Key identifies the subscription, e.g. to unsubscribe it from another request
+	Key string
+	// Posts receives the matching posts, it is closed when the subscription ends
+	Posts <-chan models.Post
+
+	posts chan models.Post
+	match func(models.Post) bool
+}
+
+// Broadcaster is a sink that forwards created posts to live subscribers. Send never blocks the
+// workers: a subscriber whose buffer is full is dropped and has its channel closed.
+type Broadcaster struct {
+	bufferSize int
+
+	mu            sync.Mutex
+	subscriptions map[string]*Subscription
+	closed        bool
+}
+
+func NewBroadcaster(bufferSize int) *Broadcaster {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBroadcastBuffer
+	}
+	return &Broadcaster{
+		bufferSize:    bufferSize,
+		subscriptions: make(map[string]*Subscription),
+	}
+}
+
+// Subscribe adds a subscriber receiving the posts that match, a nil match receives all posts
+func (b *Broadcaster) Subscribe(match func(models.Post) bool) *Subscription {
+	posts := make(chan models.Post, b.bufferSize)
+	subscription := &Subscription{
+		Key:   newSubscriptionKey(),
+		Posts: posts,
+		posts: posts,
+		match: match,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(posts)
+		return subscription
+	}
+	b.subscriptions[subscription.Key] = subscription
+	broadcastClients.Inc()
+	return subscription
+}
+
+// Unsubscribe ends a subscription and closes its channel, it reports whether the key was subscribed
+func (b *Broadcaster) Unsubscribe(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscription, ok := b.subscriptions[key]
+	if !ok {
+		return false
+	}
+	b.remove(subscription)
+	return true
+}
+
+// Send forwards created posts to the matching subscribers, other events are ignored
+func (b *Broadcaster) Send(ctx context.Context, event models.PostEvent) error {
+	created, ok := event.(models.CreatePostEvent)
+	if !ok {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscription := range b.subscriptions {
+		if subscription.match != nil && !subscription.match(created.Post) {
+			continue
+		}
+		select {
+		case subscription.posts <- created.Post:
+		default:
+			log.WithField("key", subscription.Key).Warn("Dropping live stream client that fell behind")
+			broadcastDroppedClients.Inc()
+			b.remove(subscription)
+		}
+	}
+	return nil
+}
+
+// Close ends all subscriptions, later subscriptions are closed right away
+func (b *Broadcaster) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscription := range b.subscriptions {
+		b.remove(subscription)
+	}
+	b.closed = true
+	return nil
+}
+
+// remove must be called with the lock held
+func (b *Broadcaster) remove(subscription *Subscription) {
+	delete(b.subscriptions, subscription.Key)
+	close(subscription.posts)
+	broadcastClients.Dec()
+}
+
+func newSubscriptionKey() string {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+var _ PostSink = (*Broadcaster)(nil)
@@ -0,0 +1,83 @@
+package sink_test
+
+import (
+	"context"
+	"norsky/models"
+	"norsky/sink"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createEvent(uri string, langs ...string) models.CreatePostEvent {
+	return models.CreatePostEvent{Post: models.Post{Uri: uri, Languages: langs}}
+}
+
+// drain returns the uris buffered for a subscription without blocking
+func drain(subscription *sink.Subscription) []string {
+	uris := []string{}
+	for {
+		select {
+		case post, ok := <-subscription.Posts:
+			if !ok {
+				return uris
+			}
+			uris = append(uris, post.Uri)
+		default:
+			return uris
+		}
+	}
+}
+
+func TestBroadcasterForwardsMatchingPosts(t *testing.T) {
+	b := sink.NewBroadcaster(10)
+	all := b.Subscribe(nil)
+	nynorsk := b.Subscribe(func(post models.Post) bool {
+		return len(post.Languages) > 0 && post.Languages[0] == "nn"
+	})
+	assert.NotEqual(t, all.Key, nynorsk.Key)
+
+	ctx := context.Background()
+	require.NoError(t, b.Send(ctx, createEvent("at://1", "nb")))
+	require.NoError(t, b.Send(ctx, createEvent("at://2", "nn")))
+	require.NoError(t, b.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://1"}}))
+
+	assert.Equal(t, []string{"at://1", "at://2"}, drain(all))
+	assert.Equal(t, []string{"at://2"}, drain(nynorsk))
+}
+
+func TestBroadcasterDropsSlowClients(t *testing.T) {
+	b := sink.NewBroadcaster(2)
+	slow := b.Subscribe(nil)
+
+	ctx := context.Background()
+	for _, uri := range []string{"at://1", "at://2", "at://3"} {
+		require.NoError(t, b.Send(ctx, createEvent(uri)))
+	}
+
+	// The buffered posts are still delivered before the channel is closed
+	assert.Equal(t, []string{"at://1", "at://2"}, drain(slow))
+	_, ok := <-slow.Posts
+	assert.False(t, ok)
+	assert.False(t, b.Unsubscribe(slow.Key))
+}
+
+func TestBroadcasterUnsubscribeAndClose(t *testing.T) {
+	b := sink.NewBroadcaster(10)
+	first := b.Subscribe(nil)
+	second := b.Subscribe(nil)
+
+	assert.True(t, b.Unsubscribe(first.Key))
+	assert.False(t, b.Unsubscribe(first.Key))
+	_, ok := <-first.Posts
+	assert.False(t, ok)
+
+	require.NoError(t, b.Close())
+	_, ok = <-second.Posts
+	assert.False(t, ok)
+
+	// Subscribing after Close ends right away
+	_, ok = <-b.Subscribe(nil).Posts
+	assert.False(t, ok)
+}
@@ -0,0 +1,210 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"norsky/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	writerBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "norsky_post_writer_batch_size",
+		Help:    "Number of post events written per batch",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12), // 1 up to 2048 posts
+	})
+
+	writerFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "norsky_post_writer_flush_duration_seconds",
+		Help:    "Duration of writing a batch of posts to the database",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14), // 1ms up to ~8s
+	})
+
+	writerFlushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "norsky_post_writer_flushes_total",
+		Help: "Number of batch flushes by trigger (size, interval, shutdown) and result",
+	}, []string{"trigger", "result"})
+
+	writerQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "norsky_post_writer_queue_length",
+		Help: "Number of post events waiting to be added to a batch",
+	})
+
+	writerBlockedSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "norsky_post_writer_blocked_seconds_total",
+		Help: "Time workers spent waiting for room in the database write queue",
+	})
+)
+
+const (
+	DefaultWriteBatchSize     = 500
+	DefaultWriteFlushInterval = time.Second
+)
+
+// Store is the part of the database the DB sink writes to
+type Store interface {
+	CreatePosts(ctx context.Context, posts []models.Post) error
+	DeletePosts(ctx context.Context, uris []string) error
+}
+
+// DBConfig controls when buffered events are flushed
+type DBConfig struct {
+	// BatchSize flushes the buffer as soon as it holds this many events
+	BatchSize int
+	// FlushInterval flushes a partial batch when no full batch was written for this long
+	FlushInterval time.Duration
+	// QueueSize is the number of events that can wait while a batch is written, defaults to two batches
+	QueueSize int
+	// Flushed receives the events of each batch once it is written, e.g. to invalidate cached feed pages
+	Flushed PostSink
+}
+
+// DBSink buffers events and writes them to the database in batches from a single goroutine.
+// Sends block when the queue is full, so a slow database pushes back on the workers and the websocket reader.
+type DBSink struct {
+	store     Store
+	config    DBConfig
+	queue     chan models.PostEvent
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDBSink creates a sink writing to store, e.g. a *db.DB, and starts its writer goroutine
+func NewDBSink(store Store, config DBConfig) *DBSink {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultWriteBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = DefaultWriteFlushInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = config.BatchSize * 2
+	}
+
+	s := &DBSink{
+		store:  store,
+		config: config,
+		queue:  make(chan models.PostEvent, config.QueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Send queues an event, blocking until there is room in the queue or ctx is done
+func (s *DBSink) Send(ctx context.Context, event models.PostEvent) error {
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+	}
+
+	start := time.Now()
+	defer func() { writerBlockedSeconds.Add(time.Since(start).Seconds()) }()
+
+	select {
+	case s.queue <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close writes the queued events and stops the writer goroutine
+func (s *DBSink) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+func (s *DBSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	ctx := context.Background()
+	batch := make([]models.PostEvent, 0, s.config.BatchSize)
+	for {
+		select {
+		case event := <-s.queue:
+			batch = append(batch, event)
+			if len(batch) >= s.config.BatchSize {
+				batch = s.write(ctx, batch, "size")
+				ticker.Reset(s.config.FlushInterval)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				batch = s.write(ctx, batch, "interval")
+			}
+		case <-s.stop:
+			// Take whatever the workers managed to queue before shutting down
+		drain:
+			for {
+				select {
+				case event := <-s.queue:
+					batch = append(batch, event)
+				default:
+					break drain
+				}
+			}
+			if len(batch) > 0 {
+				shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				s.write(shutdownCtx, batch, "shutdown")
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// write flushes the batch and returns it emptied for reuse, failed batches are logged and dropped
+func (s *DBSink) write(ctx context.Context, batch []models.PostEvent, trigger string) []models.PostEvent {
+	writerQueueLength.Set(float64(len(s.queue)))
+	writerBatchSize.Observe(float64(len(batch)))
+
+	var creates []models.Post
+	var deletes []string
+	for _, event := range batch {
+		switch event := event.(type) {
+		case models.CreatePostEvent, models.UpdatePostEvent:
+			creates = append(creates, event.EventPost())
+		case models.DeletePostEvent:
+			deletes = append(deletes, event.Post.Uri)
+		}
+	}
+
+	// Deletes go last so a post created and deleted within one batch is gone
+	start := time.Now()
+	err := errors.Join(s.store.CreatePosts(ctx, creates), s.store.DeletePosts(ctx, deletes))
+	writerFlushDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		log.WithError(err).WithField("events", len(batch)).Error("Failed to write posts to database")
+		writerFlushes.WithLabelValues(trigger, "error").Inc()
+	} else {
+		log.WithField("events", len(batch)).Debug("Wrote posts to database")
+		writerFlushes.WithLabelValues(trigger, "success").Inc()
+	}
+
+	// Also after a failed write, part of the batch may have been written
+	if s.config.Flushed != nil {
+		for _, event := range batch {
+			if err := s.config.Flushed.Send(ctx, event); err != nil {
+				log.WithError(err).Error("Failed to send written post event")
+			}
+		}
+	}
+
+	return batch[:0]
+}
+
+var _ PostSink = (*DBSink)(nil)
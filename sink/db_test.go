@@ -0,0 +1,170 @@
+package sink_test
+
+import (
+	"context"
+	"fmt"
+	"norsky/models"
+	"norsky/sink"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStore collects the batches written by a DBSink
+type recordingStore struct {
+	mu      sync.Mutex
+	batches [][]models.Post
+	deletes []string
+	block   chan struct{}
+}
+
+func (r *recordingStore) CreatePosts(ctx context.Context, posts []models.Post) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, posts)
+	return nil
+}
+
+func (r *recordingStore) DeletePosts(ctx context.Context, uris []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deletes = append(r.deletes, uris...)
+	return nil
+}
+
+func (r *recordingStore) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sizes := make([]int, len(r.batches))
+	for i, batch := range r.batches {
+		sizes[i] = len(batch)
+	}
+	return sizes
+}
+
+func testPost(i int) models.Post {
+	return models.Post{Uri: fmt.Sprintf("at://did:plc:test/app.bsky.feed.post/%d", i), CreatedAt: int64(i)}
+}
+
+func TestDBSinkFlushesOnSize(t *testing.T) {
+	store := &recordingStore{}
+	s := sink.NewDBSink(store, sink.DBConfig{BatchSize: 3, FlushInterval: time.Hour})
+
+	ctx := context.Background()
+	for i := 0; i < 7; i++ {
+		require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(i)}))
+	}
+
+	assert.Eventually(t, func() bool { return len(store.sizes()) == 2 }, time.Second, 5*time.Millisecond)
+
+	// The remaining post is flushed on close
+	require.NoError(t, s.Close())
+	assert.Equal(t, []int{3, 3, 1}, store.sizes())
+}
+
+func TestDBSinkFlushesOnInterval(t *testing.T) {
+	store := &recordingStore{}
+	s := sink.NewDBSink(store, sink.DBConfig{BatchSize: 100, FlushInterval: 20 * time.Millisecond})
+	defer s.Close()
+
+	ctx := context.Background()
+	require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(1)}))
+	require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(2)}))
+
+	assert.Eventually(t, func() bool {
+		sizes := store.sizes()
+		return len(sizes) == 1 && sizes[0] == 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestDBSinkWritesDeletes(t *testing.T) {
+	store := &recordingStore{}
+	s := sink.NewDBSink(store, sink.DBConfig{BatchSize: 10, FlushInterval: time.Hour})
+
+	ctx := context.Background()
+	require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(1)}))
+	require.NoError(t, s.Send(ctx, models.DeletePostEvent{Post: testPost(2)}))
+	require.NoError(t, s.Close())
+
+	assert.Equal(t, []int{1}, store.sizes())
+	assert.Equal(t, []string{testPost(2).Uri}, store.deletes)
+}
+
+func TestDBSinkBlocksWhenQueueIsFull(t *testing.T) {
+	store := &recordingStore{block: make(chan struct{})}
+	s := sink.NewDBSink(store, sink.DBConfig{BatchSize: 1, FlushInterval: time.Hour, QueueSize: 1})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// The first post is stuck in the database, the second fills the queue
+	require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(1)}))
+	require.Eventually(t, func() bool {
+		return s.Send(ctx, models.CreatePostEvent{Post: testPost(2)}) == nil
+	}, time.Second, 5*time.Millisecond)
+
+	sendCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Send(sendCtx, models.CreatePostEvent{Post: testPost(3)}), context.DeadlineExceeded)
+
+	// Once the database catches up the sink accepts posts again
+	close(store.block)
+	assert.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(4)}))
+}
+
+// writtenSink checks that every event it receives is already in the store
+type writtenSink struct {
+	store *recordingStore
+
+	mu      sync.Mutex
+	uris    []string
+	missing []string
+}
+
+func (w *writtenSink) Send(ctx context.Context, event models.PostEvent) error {
+	w.store.mu.Lock()
+	written := false
+	for _, batch := range w.store.batches {
+		for _, post := range batch {
+			written = written || post.Uri == event.EventPost().Uri
+		}
+	}
+	w.store.mu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.uris = append(w.uris, event.EventPost().Uri)
+	if !written {
+		w.missing = append(w.missing, event.EventPost().Uri)
+	}
+	return nil
+}
+
+func (w *writtenSink) Close() error { return nil }
+
+func TestDBSinkSendsWrittenEventsToFlushed(t *testing.T) {
+	store := &recordingStore{block: make(chan struct{})}
+	flushed := &writtenSink{store: store}
+	s := sink.NewDBSink(store, sink.DBConfig{BatchSize: 2, FlushInterval: time.Hour, Flushed: flushed})
+
+	ctx := context.Background()
+	require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(1)}))
+	require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: testPost(2)}))
+
+	// Nothing is passed on while the batch is being written
+	time.Sleep(20 * time.Millisecond)
+	flushed.mu.Lock()
+	assert.Empty(t, flushed.uris)
+	flushed.mu.Unlock()
+
+	close(store.block)
+	require.NoError(t, s.Close())
+	assert.Equal(t, []string{testPost(1).Uri, testPost(2).Uri}, flushed.uris)
+	assert.Empty(t, flushed.missing)
+}
@@ -0,0 +1,386 @@
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"norsky/models"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// FileFormat is the encoding of the files written by a FileSink
+type FileFormat string
+
+const (
+	FormatJSONL   FileFormat = "jsonl"
+	FormatCSV     FileFormat = "csv"
+	FormatParquet FileFormat = "parquet"
+)
+
+func ParseFileFormat(value string) (FileFormat, error) {
+	switch FileFormat(value) {
+	case FormatJSONL, FormatCSV, FormatParquet:
+		return FileFormat(value), nil
+	default:
+		return "", fmt.Errorf("invalid format %q, expected jsonl, csv or parquet", value)
+	}
+}
+
+// Compression compresses whole JSONL and CSV files, for Parquet it is the column compression codec
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+func ParseCompression(value string) (Compression, error) {
+	switch Compression(value) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return Compression(value), nil
+	default:
+		return "", fmt.Errorf("invalid compression %q, expected none, gzip or zstd", value)
+	}
+}
+
+// Parquet rows are buffered in memory until a row group is written
+const parquetRowGroupSize = 10000
+
+// FileConfig controls the files written by a FileSink
+type FileConfig struct {
+	// Dir is the directory the files are written to, it is created if missing
+	Dir string
+	// Prefix starts every file name, defaults to "posts"
+	Prefix      string
+	Format      FileFormat
+	Compression Compression
+	// RotateInterval starts a new file at every multiple of the interval in UTC, e.g. 24h for daily files.
+	// The current file is finished when the interval ends, even if no events arrive. Zero disables it.
+	RotateInterval time.Duration
+	// RotateSize starts a new file once the current one holds this many bytes, zero disables it.
+	// Parquet files are only measured when a row group is written.
+	RotateSize int64
+}
+
+// FileSink writes events to rotating files. Files are written with a .part suffix that is
+// removed when the file is complete, so only finished files are picked up by readers.
+type FileSink struct {
+	config  FileConfig
+	mu      sync.Mutex
+	current *outputFile
+	closed  bool
+	now     func() time.Time
+
+	// Stop the interval rotation, nil without a RotateInterval
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewFileSink(config FileConfig) (*FileSink, error) {
+	if config.Prefix == "" {
+		config.Prefix = "posts"
+	}
+	if config.Format == "" {
+		config.Format = FormatJSONL
+	}
+	if config.Compression == "" {
+		config.Compression = CompressionNone
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	s := &FileSink{config: config, now: time.Now}
+	if config.RotateInterval > 0 {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.rotateOnInterval()
+	}
+	return s, nil
+}
+
+func (s *FileSink) Send(ctx context.Context, event models.PostEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Workers may still be running while shutting down, don't start new files
+	if s.closed {
+		return errors.New("file sink is closed")
+	}
+
+	now := s.now()
+	if s.current != nil && s.current.full(now, s.config.RotateSize) {
+		if err := s.current.close(); err != nil {
+			return err
+		}
+		s.current = nil
+	}
+
+	if s.current == nil {
+		file, err := s.open(now)
+		if err != nil {
+			return err
+		}
+		s.current = file
+	}
+
+	if err := s.current.encoder.encode(event); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", s.current.path, err)
+	}
+	return nil
+}
+
+// rotateOnInterval finishes the current file when its interval ends, so quiet periods don't keep it open
+func (s *FileSink) rotateOnInterval() {
+	defer close(s.done)
+
+	for {
+		now := s.now()
+		timer := time.NewTimer(now.Truncate(s.config.RotateInterval).Add(s.config.RotateInterval).Sub(now))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		if s.current != nil && s.current.full(s.now(), 0) {
+			if err := s.current.close(); err != nil {
+				log.WithError(err).Error("Failed to rotate posts file")
+			}
+			s.current = nil
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close finishes the current file
+func (s *FileSink) Close() error {
+	if s.stop != nil {
+		s.closeOnce.Do(func() { close(s.stop) })
+		<-s.done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.close()
+	s.current = nil
+	return err
+}
+
+// open starts a new file named after the current time
+func (s *FileSink) open(now time.Time) (*outputFile, error) {
+	ext := "." + string(s.config.Format)
+	if s.config.Format != FormatParquet {
+		switch s.config.Compression {
+		case CompressionGzip:
+			ext += ".gz"
+		case CompressionZstd:
+			ext += ".zst"
+		}
+	}
+
+	// Size based rotation can start several files within a second
+	base := fmt.Sprintf("%s-%s", s.config.Prefix, now.UTC().Format("20060102T150405Z"))
+	path := filepath.Join(s.config.Dir, base+ext)
+	for i := 1; fileExists(path) || fileExists(path+".part"); i++ {
+		path = filepath.Join(s.config.Dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+	}
+
+	file, err := os.Create(path + ".part")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	out := &outputFile{path: path, file: file, counter: &countingWriter{w: file}}
+	if s.config.RotateInterval > 0 {
+		out.rotateAt = now.Truncate(s.config.RotateInterval).Add(s.config.RotateInterval)
+	}
+
+	var w io.Writer = out.counter
+	if s.config.Format != FormatParquet {
+		switch s.config.Compression {
+		case CompressionGzip:
+			out.compressor = gzip.NewWriter(out.counter)
+		case CompressionZstd:
+			out.compressor, err = zstd.NewWriter(out.counter)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+			}
+		}
+		if out.compressor != nil {
+			w = out.compressor
+		}
+	}
+
+	switch s.config.Format {
+	case FormatCSV:
+		out.encoder, err = newCSVEncoder(w)
+	case FormatParquet:
+		out.encoder = newParquetEncoder(w, s.config.Compression)
+	default:
+		out.encoder = &jsonlEncoder{encoder: json.NewEncoder(w)}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	log.WithField("path", path).Info("Writing posts to new file")
+	return out, nil
+}
+
+// outputFile is a file being written, with the layers stacked on top of it
+type outputFile struct {
+	path       string
+	file       *os.File
+	counter    *countingWriter
+	compressor io.WriteCloser
+	encoder    recordEncoder
+	rotateAt   time.Time
+}
+
+// full reports whether the file should be rotated before writing another event
+func (f *outputFile) full(now time.Time, maxSize int64) bool {
+	if !f.rotateAt.IsZero() && !now.Before(f.rotateAt) {
+		return true
+	}
+	return maxSize > 0 && f.counter.n >= maxSize
+}
+
+// close flushes all layers and moves the file to its final name
+func (f *outputFile) close() error {
+	errs := []error{f.encoder.close()}
+	if f.compressor != nil {
+		errs = append(errs, f.compressor.Close())
+	}
+	errs = append(errs, f.file.Close())
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to close %s: %w", f.path, err)
+	}
+
+	if err := os.Rename(f.path+".part", f.path); err != nil {
+		return fmt.Errorf("failed to finish %s: %w", f.path, err)
+	}
+	log.WithFields(log.Fields{
+		"path":  f.path,
+		"bytes": f.counter.n,
+	}).Info("Finished posts file")
+	return nil
+}
+
+// countingWriter counts the bytes written to the file for size based rotation
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recordEncoder writes events in one file format
+type recordEncoder interface {
+	encode(event models.PostEvent) error
+	close() error
+}
+
+type jsonlEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *jsonlEncoder) encode(event models.PostEvent) error {
+	return e.encoder.Encode(newJSONLine(event))
+}
+
+func (e *jsonlEncoder) close() error {
+	return nil
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) (*csvEncoder, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return nil, fmt.Errorf("failed to write csv header: %w", err)
+	}
+	return &csvEncoder{writer: writer}, nil
+}
+
+func (e *csvEncoder) encode(event models.PostEvent) error {
+	if err := e.writer.Write(NewRecord(event).csvRow()); err != nil {
+		return err
+	}
+	// Flush every row so the size of the file is known for rotation
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvEncoder) close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type parquetEncoder struct {
+	writer *parquet.GenericWriter[Record]
+	rows   int
+}
+
+func newParquetEncoder(w io.Writer, compression Compression) *parquetEncoder {
+	options := []parquet.WriterOption{}
+	switch compression {
+	case CompressionGzip:
+		options = append(options, parquet.Compression(&parquet.Gzip))
+	case CompressionZstd:
+		options = append(options, parquet.Compression(&parquet.Zstd))
+	}
+	return &parquetEncoder{writer: parquet.NewGenericWriter[Record](w, options...)}
+}
+
+func (e *parquetEncoder) encode(event models.PostEvent) error {
+	if _, err := e.writer.Write([]Record{NewRecord(event)}); err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%parquetRowGroupSize == 0 {
+		return e.writer.Flush()
+	}
+	return nil
+}
+
+func (e *parquetEncoder) close() error {
+	return e.writer.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+var _ PostSink = (*FileSink)(nil)
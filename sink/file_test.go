@@ -0,0 +1,127 @@
+package sink_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"norsky/models"
+	"norsky/sink"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeEvents(t *testing.T, s sink.PostSink, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Send(context.Background(), models.CreatePostEvent{
+			Post: models.Post{
+				Uri:       fmt.Sprintf("at://did:plc:test/app.bsky.feed.post/%d", i),
+				CreatedAt: 1700000000 + int64(i),
+				Text:      "Dette er en helt vanlig norsk tekst",
+				Languages: []string{"nb"},
+				Author:    "did:plc:test",
+			},
+			Detection: &models.LanguageDetection{Language: "nb", Confidence: 0.9},
+		}))
+	}
+}
+
+func outputFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	return files
+}
+
+func TestFileSinkWritesGzipCSV(t *testing.T) {
+	dir := t.TempDir()
+	s, err := sink.NewFileSink(sink.FileConfig{Dir: dir, Format: sink.FormatCSV, Compression: sink.CompressionGzip})
+	require.NoError(t, err)
+
+	writeEvents(t, s, 3)
+
+	// Unfinished files keep their .part suffix
+	files := outputFiles(t, dir)
+	require.Len(t, files, 1)
+	assert.Equal(t, ".part", filepath.Ext(files[0]))
+
+	require.NoError(t, s.Close())
+	files = outputFiles(t, dir)
+	require.Len(t, files, 1)
+	assert.Regexp(t, `posts-\d{8}T\d{6}Z\.csv\.gz$`, files[0])
+
+	f, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	rows, err := csv.NewReader(gz).ReadAll()
+	require.NoError(t, err)
+
+	require.Len(t, rows, 4)
+	assert.Equal(t, []string{"event", "uri", "author", "created_at", "text", "languages", "parent_uri", "detected_language", "confidence"}, rows[0])
+	assert.Equal(t, []string{"create", "at://did:plc:test/app.bsky.feed.post/0", "did:plc:test", "2023-11-14T22:13:20Z", "Dette er en helt vanlig norsk tekst", "nb", "", "nb", "0.9000"}, rows[1])
+}
+
+func TestFileSinkWritesParquet(t *testing.T) {
+	dir := t.TempDir()
+	s, err := sink.NewFileSink(sink.FileConfig{Dir: dir, Format: sink.FormatParquet, Compression: sink.CompressionZstd})
+	require.NoError(t, err)
+
+	writeEvents(t, s, 5)
+	require.NoError(t, s.Close())
+
+	files := outputFiles(t, dir)
+	require.Len(t, files, 1)
+
+	records, err := parquet.ReadFile[sink.Record](files[0])
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	assert.Equal(t, "at://did:plc:test/app.bsky.feed.post/4", records[4].Uri)
+	assert.Equal(t, []string{"nb"}, records[4].Languages)
+	assert.Equal(t, "nb", records[4].DetectedLanguage)
+	assert.Equal(t, int64(1700000004), records[4].CreatedAt.Unix())
+}
+
+func TestFileSinkRotatesOnSize(t *testing.T) {
+	dir := t.TempDir()
+	s, err := sink.NewFileSink(sink.FileConfig{Dir: dir, Format: sink.FormatJSONL, RotateSize: 1})
+	require.NoError(t, err)
+
+	// Every line fills a file, so each event starts a new one
+	writeEvents(t, s, 3)
+	require.NoError(t, s.Close())
+
+	files := outputFiles(t, dir)
+	assert.Len(t, files, 3)
+	for _, file := range files {
+		assert.Equal(t, ".jsonl", filepath.Ext(file))
+	}
+}
+
+func TestFileSinkRotatesOnIntervalWithoutEvents(t *testing.T) {
+	dir := t.TempDir()
+	s, err := sink.NewFileSink(sink.FileConfig{Dir: dir, Format: sink.FormatJSONL, RotateInterval: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer s.Close()
+
+	writeEvents(t, s, 2)
+
+	// The file is finished once its interval ends, no further event is needed
+	require.Eventually(t, func() bool {
+		files := outputFiles(t, dir)
+		return len(files) == 1 && filepath.Ext(files[0]) == ".jsonl"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	data, err := os.ReadFile(outputFiles(t, dir)[0])
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+}
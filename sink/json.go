@@ -0,0 +1,68 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"norsky/models"
+)
+
+// jsonLine is a post event written as a single line of JSON
+type jsonLine struct {
+	Event string `json:"event"`
+	models.Post
+	DetectedLanguage string  `json:"detectedLanguage,omitempty"`
+	Confidence       float64 `json:"confidence,omitempty"`
+}
+
+func newJSONLine(event models.PostEvent) jsonLine {
+	line := jsonLine{Event: eventName(event), Post: event.EventPost()}
+	if create, ok := event.(models.CreatePostEvent); ok && create.Detection != nil {
+		line.DetectedLanguage = create.Detection.Language
+		line.Confidence = create.Detection.Confidence
+	}
+	return line
+}
+
+// JSONSink writes each event as a JSON object on its own line, e.g. to stdout
+type JSONSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *JSONSink) Send(ctx context.Context, event models.PostEvent) error {
+	// Workers send concurrently, keep lines from interleaving
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.encoder.Encode(newJSONLine(event)); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONSink) Close() error {
+	return nil
+}
+
+// eventName returns the short name of an event used in output
+func eventName(event models.PostEvent) string {
+	switch event.(type) {
+	case models.CreatePostEvent:
+		return "create"
+	case models.UpdatePostEvent:
+		return "update"
+	case models.DeletePostEvent:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+var _ PostSink = (*JSONSink)(nil)
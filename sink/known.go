@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"context"
+	"sync"
+
+	"norsky/models"
+)
+
+// DefaultKnownPosts is how many accepted posts a KnownPostsFilter remembers
+const DefaultKnownPosts = 100_000
+
+// KnownPostsFilter forwards updates and deletes only for posts it forwarded the create of. The firehose
+// deletes posts of the whole network, sinks without a database use it to leave out the deletes of posts
+// they never wrote. Only the most recent posts are remembered, deletes of older posts are dropped.
+type KnownPostsFilter struct {
+	sink PostSink
+
+	mu    sync.Mutex
+	known map[string]int // uri to its slot in order
+	order []string       // ring of remembered uris, the oldest is replaced first
+	next  int
+}
+
+// NewKnownPostsFilter remembers up to size posts, DefaultKnownPosts when size is zero
+func NewKnownPostsFilter(sink PostSink, size int) *KnownPostsFilter {
+	if size <= 0 {
+		size = DefaultKnownPosts
+	}
+	return &KnownPostsFilter{
+		sink:  sink,
+		known: make(map[string]int, size),
+		order: make([]string, size),
+	}
+}
+
+func (f *KnownPostsFilter) Send(ctx context.Context, event models.PostEvent) error {
+	uri := event.EventPost().Uri
+
+	f.mu.Lock()
+	switch event.(type) {
+	case models.CreatePostEvent:
+		f.remember(uri)
+	case models.DeletePostEvent:
+		if _, ok := f.known[uri]; !ok {
+			f.mu.Unlock()
+			return nil
+		}
+		delete(f.known, uri)
+	default:
+		if _, ok := f.known[uri]; !ok {
+			f.mu.Unlock()
+			return nil
+		}
+	}
+	f.mu.Unlock()
+
+	return f.sink.Send(ctx, event)
+}
+
+func (f *KnownPostsFilter) remember(uri string) {
+	if _, ok := f.known[uri]; ok {
+		return
+	}
+	// Forget the oldest post, unless it was deleted and has been created again in a newer slot
+	if oldest := f.order[f.next]; oldest != "" && f.known[oldest] == f.next {
+		delete(f.known, oldest)
+	}
+	f.order[f.next] = uri
+	f.known[uri] = f.next
+	f.next = (f.next + 1) % len(f.order)
+}
+
+func (f *KnownPostsFilter) Close() error {
+	return f.sink.Close()
+}
+
+var _ PostSink = (*KnownPostsFilter)(nil)
@@ -0,0 +1,54 @@
+package sink_test
+
+import (
+	"bytes"
+	"context"
+	"norsky/models"
+	"norsky/sink"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKnownPostsFilterDropsDeletesOfUnknownPosts(t *testing.T) {
+	var out bytes.Buffer
+	s := sink.NewKnownPostsFilter(sink.NewJSONSink(&out), 10)
+
+	ctx := context.Background()
+	require.NoError(t, s.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://did:plc:other/app.bsky.feed.post/1"}}))
+	require.NoError(t, s.Send(ctx, models.UpdatePostEvent{Post: models.Post{Uri: "at://did:plc:other/app.bsky.feed.post/1"}}))
+	assert.Empty(t, out.String())
+	require.NoError(t, s.Close())
+}
+
+func TestKnownPostsFilterForwardsDeletesOfWrittenPosts(t *testing.T) {
+	var out bytes.Buffer
+	s := sink.NewKnownPostsFilter(sink.NewJSONSink(&out), 10)
+
+	ctx := context.Background()
+	require.NoError(t, s.Send(ctx, createEvent("at://1", "nb")))
+	require.NoError(t, s.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://1"}}))
+	// A post is only deleted once
+	require.NoError(t, s.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://1"}}))
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	assert.Contains(t, string(lines[1]), `"event":"delete"`)
+}
+
+func TestKnownPostsFilterForgetsOldestPosts(t *testing.T) {
+	var out bytes.Buffer
+	s := sink.NewKnownPostsFilter(sink.NewJSONSink(&out), 2)
+
+	ctx := context.Background()
+	for _, uri := range []string{"at://1", "at://2", "at://3"} {
+		require.NoError(t, s.Send(ctx, createEvent(uri)))
+	}
+	out.Reset()
+
+	require.NoError(t, s.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://1"}}))
+	assert.Empty(t, out.String())
+	require.NoError(t, s.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://3"}}))
+	assert.Contains(t, out.String(), "at://3")
+}
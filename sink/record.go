@@ -0,0 +1,67 @@
+package sink
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"norsky/models"
+)
+
+// Record is the stable flat schema of a post event in CSV and Parquet files.
+// Columns are only ever added at the end, never renamed or removed.
+type Record struct {
+	Event            string    `parquet:"event,dict"`
+	Uri              string    `parquet:"uri"`
+	Author           string    `parquet:"author"`
+	CreatedAt        time.Time `parquet:"created_at,timestamp(millisecond)"`
+	Text             string    `parquet:"text"`
+	Languages        []string  `parquet:"languages,list"`
+	ParentUri        string    `parquet:"parent_uri,optional"`
+	DetectedLanguage string    `parquet:"detected_language,optional"`
+	Confidence       float64   `parquet:"confidence,optional"`
+}
+
+// csvHeader names the CSV columns in the order written by csvRow
+var csvHeader = []string{
+	"event", "uri", "author", "created_at", "text", "languages", "parent_uri", "detected_language", "confidence",
+}
+
+func NewRecord(event models.PostEvent) Record {
+	post := event.EventPost()
+	record := Record{
+		Event:     eventName(event),
+		Uri:       post.Uri,
+		Author:    post.Author,
+		CreatedAt: time.Unix(post.CreatedAt, 0).UTC(),
+		Text:      post.Text,
+		Languages: post.Languages,
+	}
+	if post.ParentUri != nil {
+		record.ParentUri = *post.ParentUri
+	}
+	if create, ok := event.(models.CreatePostEvent); ok && create.Detection != nil {
+		record.DetectedLanguage = create.Detection.Language
+		record.Confidence = create.Detection.Confidence
+	}
+	return record
+}
+
+// csvRow formats the record as CSV fields, languages are separated by spaces
+func (r Record) csvRow() []string {
+	confidence := ""
+	if r.DetectedLanguage != "" {
+		confidence = strconv.FormatFloat(r.Confidence, 'f', 4, 64)
+	}
+	return []string{
+		r.Event,
+		r.Uri,
+		r.Author,
+		r.CreatedAt.Format(time.RFC3339),
+		r.Text,
+		strings.Join(r.Languages, " "),
+		r.ParentUri,
+		r.DetectedLanguage,
+		confidence,
+	}
+}
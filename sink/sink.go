@@ -0,0 +1,49 @@
+// Package sink delivers post events from the firehose to where they are stored or printed
+package sink
+
+import (
+	"context"
+	"errors"
+
+	"norsky/models"
+)
+
+// PostSink receives the post events accepted by the firehose workers
+type PostSink interface {
+	// Send delivers an event, it may block to push back on the workers while the sink is behind
+	Send(ctx context.Context, event models.PostEvent) error
+	// Close flushes buffered events and releases resources, no events may be sent afterwards
+	Close() error
+}
+
+// Fanout sends every event to all of its sinks in order
+type Fanout struct {
+	sinks []PostSink
+}
+
+func NewFanout(sinks ...PostSink) *Fanout {
+	return &Fanout{sinks: sinks}
+}
+
+// Send delivers the event to every sink, a failing sink doesn't stop delivery to the others
+func (f *Fanout) Send(ctx context.Context, event models.PostEvent) error {
+	var errs []error
+	for _, sink := range f.sinks {
+		if err := sink.Send(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *Fanout) Close() error {
+	var errs []error
+	for _, sink := range f.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var _ PostSink = (*Fanout)(nil)
@@ -0,0 +1,54 @@
+package sink_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"norsky/models"
+	"norsky/sink"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingSink rejects every event
+type failingSink struct{}
+
+func (failingSink) Send(ctx context.Context, event models.PostEvent) error {
+	return errors.New("rejected")
+}
+
+func (failingSink) Close() error { return nil }
+
+func TestJSONSinkWritesOneLinePerEvent(t *testing.T) {
+	var out bytes.Buffer
+	s := sink.NewJSONSink(&out)
+
+	ctx := context.Background()
+	require.NoError(t, s.Send(ctx, models.CreatePostEvent{Post: models.Post{
+		Uri:       "at://did:plc:test/app.bsky.feed.post/1",
+		CreatedAt: 1700000000,
+		Text:      "Hei på deg",
+		Languages: []string{"nb"},
+		Author:    "did:plc:test",
+	}, Detection: &models.LanguageDetection{Language: "nb", Confidence: 0.92}}))
+	require.NoError(t, s.Send(ctx, models.DeletePostEvent{Post: models.Post{Uri: "at://did:plc:test/app.bsky.feed.post/1"}}))
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"event":"create","id":0,"createdAt":1700000000,"text":"Hei på deg","languages":["nb"],"uri":"at://did:plc:test/app.bsky.feed.post/1","author":"did:plc:test","detectedLanguage":"nb","confidence":0.92}`, string(lines[0]))
+	assert.JSONEq(t, `{"event":"delete","id":0,"createdAt":0,"text":"","languages":null,"uri":"at://did:plc:test/app.bsky.feed.post/1","author":""}`, string(lines[1]))
+}
+
+func TestFanoutDeliversToAllSinks(t *testing.T) {
+	var first, second bytes.Buffer
+	fanout := sink.NewFanout(sink.NewJSONSink(&first), failingSink{}, sink.NewJSONSink(&second))
+
+	err := fanout.Send(context.Background(), models.CreatePostEvent{Post: models.Post{Uri: "at://did:plc:test/app.bsky.feed.post/1"}})
+
+	assert.EqualError(t, err, "rejected")
+	assert.Equal(t, first.String(), second.String())
+	assert.NotEmpty(t, first.String())
+	assert.NoError(t, fanout.Close())
+}